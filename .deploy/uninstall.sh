@@ -16,6 +16,7 @@ sudo rm -f /usr/local/bin/collector
 
 echo "[4/5] Removing data directory..."
 sudo rm -rf /var/lib/collector
+sudo rm -rf /sys/fs/bpf/collector
 
 echo "[5/5] Leaving /etc/collector.env in place (manual cleanup optional)."
 
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	// ProtocolVersion is sent with every request and response. Agent and
+	// reporter refuse to talk when it differs.
+	ProtocolVersion = 1
+
+	DefaultSocket = "/run/collector/agent.sock"
+
+	// requests understood by the agent
+	OpHello    = "hello"
+	OpSnapshot = "snapshot"
+	OpReset    = "reset"
+	OpCleanup  = "cleanup"
+
+	ioTimeout = 10 * time.Second
+)
+
+// Request is one JSON document sent by the reporter.
+type Request struct {
+	Version int    `json:"version"`
+	Op      string `json:"op"`
+}
+
+// Response answers a Request. Error is set when the operation failed.
+type Response struct {
+	Version int         `json:"version"`
+	Error   string      `json:"error,omitempty"`
+	Iface   string      `json:"iface,omitempty"` // hello only
+	Peers   []PeerStats `json:"peers,omitempty"` // snapshot only
+}
+
+// PeerStats is one entry of a snapshot.
+type PeerStats struct {
+	Peer  model.Peer       `json:"peer"`
+	Stats bpfgo.SiaIPStats `json:"stats"`
+}
+
+// SocketPath returns AGENT_SOCKET or the default socket path.
+func SocketPath() string {
+	if p := os.Getenv("AGENT_SOCKET"); p != "" {
+		return p
+	}
+	return DefaultSocket
+}
+
+// Server answers reporter requests from a counter source, normally the
+// BPF maps.
+type Server struct {
+	Src   counters.Source
+	Iface string
+
+	mu sync.Mutex // one operation on the maps at a time
+}
+
+// Listen creates the Unix socket at path, replacing a stale one. The socket
+// is only accessible to the owner and, when gid >= 0, to that group.
+func Listen(path string, gid int) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Serve handles connections on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req Request
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("agent: read request: %v", err)
+			}
+			return
+		}
+
+		resp := s.handle(req)
+		conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+		if err := enc.Encode(resp); err != nil {
+			log.Printf("agent: write response: %v", err)
+			return
+		}
+	}
+}
+
+func (s *Server) handle(req Request) Response {
+	resp := Response{Version: ProtocolVersion}
+	if req.Version != ProtocolVersion {
+		resp.Error = fmt.Sprintf("unsupported protocol version %d (agent speaks %d)", req.Version, ProtocolVersion)
+		return resp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	switch req.Op {
+	case OpHello:
+		resp.Iface = s.Iface
+	case OpSnapshot:
+		var snap map[model.Peer]bpfgo.SiaIPStats
+		if snap, err = s.Src.Snapshot(); err == nil {
+			resp.Peers = make([]PeerStats, 0, len(snap))
+			for p, st := range snap {
+				resp.Peers = append(resp.Peers, PeerStats{Peer: p, Stats: st})
+			}
+		}
+	case OpReset:
+		err = s.Src.Reset()
+	case OpCleanup:
+		err = s.Src.Cleanup()
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
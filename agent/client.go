@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+)
+
+var _ counters.Source = (*Client)(nil)
+
+// Client is a counters.Source reading a `collector agent` over its Unix
+// socket. It reconnects when the agent restarts.
+type Client struct {
+	Path string
+
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// Dial connects to the agent at path and checks the protocol version.
+func Dial(path string) (*Client, Response, error) {
+	c := &Client{Path: path}
+	hello, err := c.Hello()
+	if err != nil {
+		return nil, Response{}, err
+	}
+	return c, hello, nil
+}
+
+// Hello returns the interface the agent is attached to.
+func (c *Client) Hello() (Response, error) {
+	return c.call(OpHello)
+}
+
+func (c *Client) Snapshot() (map[model.Peer]bpfgo.SiaIPStats, error) {
+	resp, err := c.call(OpSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[model.Peer]bpfgo.SiaIPStats, len(resp.Peers))
+	for _, p := range resp.Peers {
+		out[p.Peer] = p.Stats
+	}
+	return out, nil
+}
+
+func (c *Client) Reset() error {
+	_, err := c.call(OpReset)
+	return err
+}
+
+func (c *Client) Cleanup() error {
+	_, err := c.call(OpCleanup)
+	return err
+}
+
+// Close drops the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disconnect()
+}
+
+// call sends one request. A broken connection is retried once on a fresh
+// one, so an agent restart costs no more than a single failed flush.
+func (c *Client) call(op string) (Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, err := c.roundTrip(op)
+	var re remoteError
+	if err != nil && !errors.As(err, &re) {
+		c.disconnect()
+		resp, err = c.roundTrip(op)
+	}
+	if err != nil && !errors.As(err, &re) {
+		c.disconnect()
+	}
+	return resp, err
+}
+
+// remoteError is an error reported by the agent; the connection is fine.
+type remoteError struct{ msg string }
+
+func (e remoteError) Error() string { return "agent: " + e.msg }
+
+func (c *Client) roundTrip(op string) (Response, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("unix", c.Path, ioTimeout)
+		if err != nil {
+			return Response{}, fmt.Errorf("connect to agent: %w", err)
+		}
+		c.conn = conn
+		c.dec = json.NewDecoder(conn)
+		c.enc = json.NewEncoder(conn)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := c.enc.Encode(Request{Version: ProtocolVersion, Op: op}); err != nil {
+		return Response{}, fmt.Errorf("agent %s: %w", op, err)
+	}
+	var resp Response
+	if err := c.dec.Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("agent %s: %w", op, err)
+	}
+	if resp.Version != ProtocolVersion {
+		return resp, remoteError{fmt.Sprintf("protocol version %d, reporter speaks %d", resp.Version, ProtocolVersion)}
+	}
+	if resp.Error != "" {
+		return resp, remoteError{resp.Error}
+	}
+	return resp, nil
+}
+
+func (c *Client) disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.dec, c.enc = nil, nil, nil
+	return err
+}
@@ -1,52 +1,146 @@
 package agg
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"net"
-	"os"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/back2basic/collector/alert"
 	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
 	"github.com/back2basic/collector/dns"
+	"github.com/back2basic/collector/geo"
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/privacy"
+	"github.com/back2basic/collector/quota"
+	"github.com/back2basic/collector/sink"
 	"github.com/back2basic/collector/storage"
 )
 
 // Aggregator persists live counters into SQLite and then resets them.
 type Aggregator struct {
-	h  *bpfgo.Handles
-	db *sql.DB
+	src counters.Source
+	db  *sql.DB
+	mu  sync.Mutex // serialises flushes
+
+	mode      string          // AGG_MODE: ModeIP or ModePrefix
+	prefixLen model.PrefixLen // AGG_PREFIX_V4 / AGG_PREFIX_V6
+	pushGroup string          // PUSH_GROUP: storage grouping for the daily push
+	geo       *geo.DB         // nil unless GEOIP_*_DB is configured
+	sinks     *sink.Dispatcher
+	alerts    *alert.Engine   // nil unless an ALERT_* rule is set
+	quota     *quota.Engine   // nil unless a QUOTA_* limit is set
+	privacy   *privacy.Policy // nil unless PRIVACY_MODE or RAW_IP_RETENTION_DAYS is set
+	hostd     *hostd.Mapper   // nil unless HOSTD_API_URL is set
+	hostname  string          // SIA_HOSTNAME, stored in every row
+	iface     string
+	resolve   bool // look up reverse DNS names
+}
+
+// capacityLogger is implemented by sources with bounded maps.
+type capacityLogger interface {
+	LogCapacity()
 }
 
-func New(h *bpfgo.Handles, db *sql.DB) *Aggregator {
-	return &Aggregator{h: h, db: db}
+// New returns an aggregator reading src. iface is stored as the interface
+// of every row.
+func New(src counters.Source, db *sql.DB, iface string) (*Aggregator, error) {
+	hostname := Hostname()
+	// quota blocks need the BPF maps; other sources can only notify
+	h, _ := src.(*bpfgo.Handles)
+	pol, err := privacy.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("privacy: %w", err)
+	}
+	q := quota.FromEnv(hostname, h)
+	if q.BlockSpan() > 0 && h == nil {
+		return nil, fmt.Errorf("QUOTA_ACTIONS=block needs the BPF maps of the single-process daemon; " +
+			"use log or webhook with this source")
+	}
+	mapper := hostd.MapperFromEnv()
+	mapper.RecordUsage(storage.ContractUsage{})
+	// blocks act on the stored subjects: a pseudonym cannot be blocked and
+	// a truncated network would block every peer in it
+	if span := q.BlockSpan(); span > 0 && pol.Minimises(span) {
+		return nil, fmt.Errorf("QUOTA_ACTIONS=block needs raw addresses for the whole quota period; " +
+			"drop it with PRIVACY_MODE=hmac or truncate, or raise RAW_IP_RETENTION_DAYS")
+	}
+	return &Aggregator{
+		src:       src,
+		db:        db,
+		mode:      modeFromEnv(),
+		prefixLen: model.PrefixLenFromEnv(),
+		pushGroup: pushGroupFromEnv(),
+		geo:       geo.OpenFromEnv(),
+		sinks:     sink.NewDispatcher(sink.FromEnv(), 64),
+		alerts:    alert.FromEnv(),
+		quota:     q,
+		privacy:   pol,
+		hostd:     mapper,
+		hostname:  hostname,
+		iface:     iface,
+		resolve:   !pol.DropDNS(),
+	}, nil
+}
+
+// SetDNS turns reverse DNS lookups for stored rows on or off. A privacy
+// mode keeps them off.
+func (a *Aggregator) SetDNS(enabled bool) {
+	a.resolve = enabled && !a.privacy.DropDNS()
+}
+
+// Privacy returns the policy applied to stored and exported peers, or nil.
+func (a *Aggregator) Privacy() *privacy.Policy {
+	return a.privacy
+}
+
+// Close waits for queued sink batches and alerts to be sent.
+func (a *Aggregator) Close() {
+	a.sinks.Close()
+	a.alerts.Close()
 }
 
 // FlushOnce performs a single synchronous flush of current counters to the DB.
 func (a *Aggregator) FlushOnce() {
-	// call the same internal flush implementation used by the ticker
-	a.flush()
+	a.FlushAt(time.Now())
 }
 
-func (a *Aggregator) Run(flushInterval time.Duration, exteralFlushInterval time.Duration) {
+// Run flushes every flushInterval and runs the external work every
+// exteralFlushInterval until ctx is done. It then flushes and pushes once
+// more before returning.
+func (a *Aggregator) Run(ctx context.Context, flushInterval time.Duration, exteralFlushInterval time.Duration) {
 	flushTicker := time.NewTicker(flushInterval)
 	defer flushTicker.Stop()
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Printf("aggregator: get hostname: %v", err)
-	}
 	extTimer := alignedTicker(exteralFlushInterval)
+	defer extTimer.Stop()
+
+	go a.hostd.Run(ctx)
 
 	var extTicker *time.Ticker
+	defer func() {
+		if extTicker != nil {
+			extTicker.Stop()
+		}
+	}()
+
 	for {
 		select {
+		case <-ctx.Done():
+			log.Println("agg: final flush")
+			a.FlushAt(time.Now())
+			a.pushDaily()
+			return
+
 		case <-flushTicker.C:
-			a.flush()
+			a.FlushAt(time.Now())
 
 		case <-extTimer.C:
-            bpfgo.CleanupZeroEntriesUsingHandles(a.h.IP4Stats, a.h.IP6Stats)
-			pushDailyToAppwrite(hostname)
+			a.external()
 			extTicker = time.NewTicker(exteralFlushInterval)
 
 		case <-func() <-chan time.Time {
@@ -55,123 +149,167 @@ func (a *Aggregator) Run(flushInterval time.Duration, exteralFlushInterval time.
 			}
 			return nil
 		}():
-            bpfgo.CleanupZeroEntriesUsingHandles(a.h.IP4Stats, a.h.IP6Stats)
-			pushDailyToAppwrite(hostname)
+			a.external()
 		}
 	}
 }
 
-func (a *Aggregator) flush() {
-	now := time.Now().UTC().Truncate(time.Minute)
+// external runs the periodic housekeeping, quota checks and the daily
+// remote push.
+func (a *Aggregator) external() {
+	if err := a.src.Cleanup(); err != nil {
+		log.Printf("agg: cleanup: %v", err)
+	}
+	if cl, ok := a.src.(capacityLogger); ok {
+		cl.LogCapacity()
+	}
+	dns.LogStats()
+	dns.Save()
+	a.quota.Check(time.Now())
+	a.privacy.Purge(time.Now())
+	a.pushDaily()
+}
+
+// FlushAt stores the current counters as the flush at t (truncated to the
+// minute) and resets them. Replays pass the capture time.
+func (a *Aggregator) FlushAt(t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	at := t.UTC()
+	now := at.Truncate(time.Minute)
 
-	tx, err := a.db.Begin()
+	snap, err := a.src.Snapshot()
 	if err != nil {
-		fmt.Println("agg: begin tx:", err)
+		log.Printf("agg: collect: %v", err)
 		return
 	}
 
-	stmt, err := tx.Prepare(`
-        INSERT INTO traffic (
-            timestamp,
-            ip,
-            dns,
-            consensus_up,
-            consensus_down,
-            siamux_up,
-            siamux_down,
-            quic_up,
-            quic_down
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `)
-	if err != nil {
-		fmt.Println("agg: prepare:", err)
-		_ = tx.Rollback()
+	if err := a.store(at, a.records(now, snap)); err != nil {
+		// keep the counters so the next flush retries them
+		log.Printf("agg: insert: %v", err)
 		return
 	}
-	defer stmt.Close()
 
-	// IPv4
-	iter := a.h.IP4Stats.Iterate()
-	var ip uint32
-	var st bpfgo.SiaIPStats
+	// Persisted, now reset live counters
+	if err := a.src.Reset(); err != nil {
+		log.Printf("reset counters: %v", err)
+	}
+}
+
+// Annotate turns live counters into rows as the next flush would, before
+// the prefix rollup and the privacy policy, without storing or resetting
+// anything. The live dashboard uses it to group by ASN, country, renter or
+// contract.
+func (a *Aggregator) Annotate(snap map[model.Peer]bpfgo.SiaIPStats) []model.TrafficRecord {
+	return a.records(time.Now().UTC().Truncate(time.Minute), snap)
+}
 
-	for iter.Next(&ip, &st) {
-		if st.ConsensusDown == 0 &&
-			st.ConsensusUp == 0 &&
-			st.SiamuxDown == 0 &&
-			st.SiamuxUp == 0 &&
-			st.QuicDown == 0 &&
-			st.QuicUp == 0 {
-			continue
-		}
-		ipStr := fmt.Sprintf("%d.%d.%d.%d",
-			byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24))
-
-		// Use existing dns.Resolve which has its own cache and TTL
-		dnsName := dns.Resolve(net.ParseIP(ipStr))
-
-		_, err := stmt.Exec(
-			now.Unix(),
-			ipStr,
-			dnsName,
-			st.ConsensusUp,
-			st.ConsensusDown,
-			st.SiamuxUp,
-			st.SiamuxDown,
-			st.QuicUp,
-			st.QuicDown,
-		)
-		if err != nil {
-			fmt.Println("agg: insert ipv4:", err)
-		}
+// records turns a snapshot into rows, ordered by address.
+func (a *Aggregator) records(now time.Time, snap map[model.Peer]bpfgo.SiaIPStats) []model.TrafficRecord {
+	peers := make([]model.Peer, 0, len(snap))
+	for p := range snap {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Less(peers[j]) })
+
+	recs := make([]model.TrafficRecord, 0, len(peers))
+	for _, p := range peers {
+		recs = append(recs, a.record(now, p, snap[p]))
 	}
+	return recs
+}
 
-	// IPv6
-	iter6 := a.h.IP6Stats.Iterate()
-	var ip6 [16]byte
-	var st6 bpfgo.SiaIPStats
+// store writes one flush worth of records and hands them to the sinks and
+// the alert engine. The privacy policy is applied first so every copy holds
+// the same minimised peers. at is the flush time.
+func (a *Aggregator) store(at time.Time, recs []model.TrafficRecord) error {
+	now := at.Truncate(time.Minute)
 
-	for iter6.Next(&ip6, &st6) {
-		if st6.ConsensusDown == 0 &&
-			st6.ConsensusUp == 0 &&
-			st6.SiamuxDown == 0 &&
-			st6.SiamuxUp == 0 &&
-			st6.QuicDown == 0 &&
-			st6.QuicUp == 0 {
+	if a.mode == ModePrefix {
+		recs = rollupByPrefix(recs)
+	}
+	recs = a.privacy.Apply(recs)
+
+	if err := storage.InsertTraffic(a.db, recs); err != nil {
+		return err
+	}
+
+	a.sinks.Minute(a.hostname, at, recs)
+	a.alerts.Evaluate(a.hostname, recs, now)
+
+	if a.mode != ModePrefix && a.resolve {
+		a.backfillDNS(now)
+	}
+	return nil
+}
+
+// backfillDNS fills in names for rows written before their background
+// lookup completed. Only the last day is considered.
+func (a *Aggregator) backfillDNS(now time.Time) {
+	since := now.Add(-24 * time.Hour).Unix()
+
+	peers, err := storage.PendingDNS(since)
+	if err != nil {
+		log.Printf("agg: pending dns: %v", err)
+		return
+	}
+
+	filled := 0
+	for _, p := range peers {
+		e, ok := dns.Cached(p.IP())
+		if !ok || e.Name == "" {
 			continue
 		}
-		ipStr := net.IP(ip6[:]).String()
-
-		dnsName := dns.Resolve(net.ParseIP(ipStr))
-
-		_, err := stmt.Exec(
-			now.Unix(),
-			ipStr,
-			dnsName,
-			st6.ConsensusUp,
-			st6.ConsensusDown,
-			st6.SiamuxUp,
-			st6.SiamuxDown,
-			st6.QuicUp,
-			st6.QuicDown,
-		)
-		if err != nil {
-			fmt.Println("agg: insert ipv6:", err)
+		if err := storage.BackfillDNS(p, e.Name, int(e.Verified), since); err != nil {
+			log.Printf("agg: backfill dns %s: %v", p, err)
+			continue
 		}
+		filled++
 	}
-
-	if err := tx.Commit(); err != nil {
-		fmt.Println("agg: commit:", err)
+	if filled > 0 {
+		log.Printf("agg: backfilled dns for %d peers", filled)
 	}
+}
 
-	// Persisted, now reset live counters
-	if err := bpfgo.ResetCountersUsingHandles(a.h.IP4Stats, a.h.IP6Stats); err != nil {
-		log.Printf("reset counters: %v", err)
+func (a *Aggregator) record(now time.Time, p model.Peer, st bpfgo.SiaIPStats) model.TrafficRecord {
+	info := a.geo.Lookup(p.IP())
+	r := model.TrafficRecord{
+		Hostname:      a.hostname,
+		Interface:     a.iface,
+		IP:            p.String(),
+		Prefix:        a.prefixLen.Of(p.Addr).String(),
+		Country:       info.Country,
+		ASN:           info.ASN,
+		ASOrg:         info.ASOrg,
+		ConsensusUp:   st.ConsensusUp,
+		ConsensusDown: st.ConsensusDown,
+		SiamuxUp:      st.SiamuxUp,
+		SiamuxDown:    st.SiamuxDown,
+		QuicUp:        st.QuicUp,
+		QuicDown:      st.QuicDown,
+		OtherUp:       st.OtherUp,
+		OtherDown:     st.OtherDown,
+		Timestamp:     now.Unix(),
 	}
+	if ann, ok := a.hostd.Lookup(p); ok {
+		r.RenterKey = ann.RenterKey
+		r.ContractID = ann.ContractID
+	}
+	// names are meaningless once peers are rolled up into prefixes
+	if a.mode != ModePrefix && a.resolve {
+		// Never block the flush on the resolver: take whatever is cached
+		// and let backfillDNS fill in the rest later.
+		e := dns.Lookup(p.IP())
+		r.DNS = e.Name
+		r.DNSVerified = int(e.Verified)
+	}
+	return r
 }
 
-func pushDailyToAppwrite(hostname string) {
-	rows, err := storage.QueryDailyTotals()
+// pushDaily sends today's totals to Appwrite and the configured sinks.
+func (a *Aggregator) pushDaily() {
+	rows, err := storage.QueryHostDailyTotals(a.hostname, a.pushGroup)
 	if err != nil {
 		log.Printf("AGG: daily SQLite query error: %v", err)
 		return
@@ -181,7 +319,9 @@ func pushDailyToAppwrite(hostname string) {
 		return
 	}
 
-	if err := storage.PushDailyToAppwrite(hostname, rows); err != nil {
+	a.sinks.Daily(a.hostname, time.Now().Format("2006-01-02"), rows)
+
+	if err := storage.PushDailyToAppwrite(a.hostname, rows); err != nil {
 		log.Printf("AGG: Appwrite daily push error: %v", err)
 	}
 }
@@ -0,0 +1,162 @@
+package agg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func peer(t *testing.T, s string) model.Peer {
+	t.Helper()
+	p, err := model.ParsePeer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newAggregator(t *testing.T, src counters.Source) *Aggregator {
+	t.Helper()
+	a, err := New(src, storage.DB, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Close)
+	return a
+}
+
+func totals(t *testing.T, group string) map[string]model.AggregatedRecord {
+	t.Helper()
+	recs, err := storage.QueryDailyTotalsBy(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]model.AggregatedRecord)
+	for _, r := range recs {
+		out[r.IP] = r
+	}
+	return out
+}
+
+func TestFlushAtStoresAndResets(t *testing.T) {
+	storagetest.Open(t)
+	t.Setenv("SIA_HOSTNAME", "host-a")
+	mem := counters.NewMemory()
+	mem.Add(peer(t, "192.0.2.1"), bpfgo.SiaIPStats{SiamuxDown: 100, QuicUp: 5})
+	mem.Add(peer(t, "2001:db8::1"), bpfgo.SiaIPStats{ConsensusUp: 7})
+
+	a := newAggregator(t, mem)
+	a.FlushAt(time.Now())
+
+	got := totals(t, storage.GroupIP)
+	if r := got["192.0.2.1"]; r.SiamuxDown != 100 || r.QuicUp != 5 {
+		t.Fatalf("192.0.2.1 = %+v", r)
+	}
+	if r := got["2001:db8::1"]; r.ConsensusUp != 7 {
+		t.Fatalf("2001:db8::1 = %+v", r)
+	}
+	if snap, _ := mem.Snapshot(); len(snap) != 0 {
+		t.Fatalf("counters not reset after the flush: %v", snap)
+	}
+
+	// the next flush only adds what was counted since
+	mem.Add(peer(t, "192.0.2.1"), bpfgo.SiaIPStats{SiamuxDown: 1})
+	a.FlushAt(time.Now())
+	if r := totals(t, storage.GroupHost)["host-a"]; r.SiamuxDown != 101 {
+		t.Fatalf("host total siamux_down = %d, want 101", r.SiamuxDown)
+	}
+}
+
+func TestFlushAtKeepsCountersOnError(t *testing.T) {
+	storagetest.Open(t)
+	mem := counters.NewMemory()
+	mem.Add(peer(t, "192.0.2.1"), bpfgo.SiaIPStats{QuicDown: 42})
+
+	a := newAggregator(t, mem)
+	storage.DB.Close() // every insert fails
+	a.FlushAt(time.Now())
+
+	snap, _ := mem.Snapshot()
+	if st := snap[peer(t, "192.0.2.1")]; st.QuicDown != 42 {
+		t.Fatalf("counters after a failed flush = %+v, want them kept for the retry", st)
+	}
+}
+
+func TestFlushAtPrefixMode(t *testing.T) {
+	storagetest.Open(t)
+	t.Setenv("AGG_MODE", ModePrefix)
+	mem := counters.NewMemory()
+	mem.Add(peer(t, "192.0.2.1"), bpfgo.SiaIPStats{QuicUp: 1})
+	mem.Add(peer(t, "192.0.2.200"), bpfgo.SiaIPStats{QuicUp: 2})
+
+	a := newAggregator(t, mem)
+	a.FlushAt(time.Now())
+
+	got := totals(t, storage.GroupIP)
+	if len(got) != 1 || got["192.0.2.0/24"].QuicUp != 3 {
+		t.Fatalf("stored rows = %v, want one row for 192.0.2.0/24", got)
+	}
+}
+
+func TestNewRejectsBlockingMinimisedPeers(t *testing.T) {
+	storagetest.Open(t)
+	t.Setenv("QUOTA_IP_MONTHLY", "1TB")
+	t.Setenv("QUOTA_ACTIONS", "log,block")
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"raw addresses", nil, true},
+		{"hmac", map[string]string{"PRIVACY_MODE": "hmac", "PRIVACY_KEY": "0123456789abcdef"}, false},
+		{"truncate", map[string]string{"PRIVACY_MODE": "truncate"}, false},
+		{"nodns", map[string]string{"PRIVACY_MODE": "nodns"}, true},
+		{"retention shorter than a month", map[string]string{"RAW_IP_RETENTION_DAYS": "7"}, false},
+		{"retention longer than a month", map[string]string{"RAW_IP_RETENTION_DAYS": "40"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			// the daemon's source; New only keeps the handles
+			a, err := New(&bpfgo.Handles{}, storage.DB, "eth0")
+			if (err == nil) != tc.ok {
+				t.Fatalf("New: err = %v, want ok=%v", err, tc.ok)
+			}
+			if a != nil {
+				a.Close()
+			}
+		})
+	}
+}
+
+func TestNewRejectsBlockingWithoutBPF(t *testing.T) {
+	storagetest.Open(t)
+	t.Setenv("QUOTA_IP_DAILY", "1TB")
+
+	for _, tc := range []struct {
+		actions string
+		ok      bool
+	}{
+		{"log,webhook", true},
+		{"log,block", false},
+	} {
+		t.Run(tc.actions, func(t *testing.T) {
+			t.Setenv("QUOTA_ACTIONS", tc.actions)
+			// any source but the BPF handles, e.g. collector replay
+			a, err := New(counters.NewMemory(), storage.DB, "eth0")
+			if (err == nil) != tc.ok {
+				t.Fatalf("New: err = %v, want ok=%v", err, tc.ok)
+			}
+			if a != nil {
+				a.Close()
+			}
+		})
+	}
+}
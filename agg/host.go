@@ -0,0 +1,20 @@
+package agg
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Hostname returns the identity this collector reports under: SIA_HOSTNAME
+// from the env file, or the system hostname when that is empty.
+func Hostname() string {
+	if h := strings.TrimSpace(os.Getenv("SIA_HOSTNAME")); h != "" {
+		return h
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		log.Printf("agg: get hostname: %v", err)
+	}
+	return h
+}
@@ -0,0 +1,66 @@
+package agg
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+)
+
+// Storage modes selected with AGG_MODE.
+const (
+	// ModeIP stores one row per peer; the peer's prefix is kept alongside
+	// so totals can still be grouped by subnet.
+	ModeIP = "ip"
+	// ModePrefix stores one row per prefix instead of per peer, which keeps
+	// rotating IPv6 privacy addresses and NAT pools down to a single row.
+	ModePrefix = "prefix"
+)
+
+func modeFromEnv() string {
+	switch m := strings.ToLower(os.Getenv("AGG_MODE")); m {
+	case "", ModeIP:
+		return ModeIP
+	case ModePrefix:
+		return ModePrefix
+	default:
+		log.Printf("agg: unknown AGG_MODE %q, using %s", m, ModeIP)
+		return ModeIP
+	}
+}
+
+// pushGroupFromEnv returns the grouping used for the daily Appwrite push.
+// PUSH_GROUP=prefix (or asn, country) pushes one row per group even when
+// per-IP rows are stored.
+func pushGroupFromEnv() string {
+	g := strings.ToLower(os.Getenv("PUSH_GROUP"))
+	if g == "" {
+		return storage.GroupIP
+	}
+	if !storage.ValidGroup(g) {
+		log.Printf("agg: unknown PUSH_GROUP %q, using %s", g, storage.GroupIP)
+		return storage.GroupIP
+	}
+	return g
+}
+
+// rollupByPrefix merges records sharing a prefix into one record keyed by
+// that prefix.
+func rollupByPrefix(recs []model.TrafficRecord) []model.TrafficRecord {
+	idx := make(map[string]int, len(recs))
+	out := make([]model.TrafficRecord, 0, len(recs))
+
+	for _, r := range recs {
+		if i, ok := idx[r.Prefix]; ok {
+			out[i].Add(r)
+			continue
+		}
+		idx[r.Prefix] = len(out)
+		r.IP = r.Prefix
+		r.DNS = ""
+		out = append(out, r)
+	}
+	return out
+}
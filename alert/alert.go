@@ -0,0 +1,406 @@
+package alert
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// Rules evaluated after each flush.
+const (
+	RulePeerRate = "peer_rate" // one peer above a byte rate
+	RuleHostRate = "host_rate" // all peers together above a byte rate
+	RuleNewPeers = "new_peers" // burst of peers not seen within the window
+	RuleZScore   = "zscore"    // peer far above its own recent history
+)
+
+// Alert states.
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// Traffic classes a rule can watch; ClassAll sums every counter.
+const (
+	ClassConsensus = "consensus"
+	ClassSiamux    = "siamux"
+	ClassQuic      = "quic"
+	ClassOther     = "other"
+	ClassAll       = "all"
+)
+
+const (
+	defaultNewPeerWindow = 24 * time.Hour
+	defaultMinSamples    = 10
+	defaultAlpha         = 0.1
+	defaultZMinBytes     = 1 << 20
+	defaultInterval      = time.Minute
+)
+
+// Alert is one notification. A firing alert is sent once per key until it
+// resolves (or ALERT_REPEAT has passed); a Resolved alert follows when the
+// condition clears.
+type Alert struct {
+	Key       string    `json:"key"`
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Hostname  string    `json:"hostname"`
+	Subject   string    `json:"subject"` // peer, or "host"
+	Class     string    `json:"class,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// Config holds the rule thresholds. A zero threshold disables the rule.
+type Config struct {
+	PeerRate      float64 // bytes/s
+	PeerClass     string
+	HostRate      float64 // bytes/s
+	HostClass     string
+	NewPeers      int // new peers per flush
+	NewPeerWindow time.Duration
+	ZScore        float64
+	ZClass        string
+	ZMinSamples   int
+	ZMinBytes     uint64  // ignore intervals smaller than this
+	Alpha         float64 // EWMA smoothing factor for the z-score history
+	Repeat        time.Duration
+}
+
+func (c Config) enabled() bool {
+	return c.PeerRate > 0 || c.HostRate > 0 || c.NewPeers > 0 || c.ZScore > 0
+}
+
+// ewma tracks an exponentially weighted mean and variance.
+type ewma struct {
+	mean, variance float64
+	n              int
+	last           time.Time
+}
+
+func (w *ewma) add(x, alpha float64) {
+	if w.n == 0 {
+		w.mean = x
+	} else {
+		diff := x - w.mean
+		incr := alpha * diff
+		w.mean += incr
+		w.variance = (1 - alpha) * (w.variance + diff*incr)
+	}
+	w.n++
+}
+
+type active struct {
+	alert Alert
+	sent  time.Time
+}
+
+// Engine evaluates the rules against each flush and notifies the outputs.
+type Engine struct {
+	cfg     Config
+	out     *notifier
+	active  map[string]*active
+	history map[string]*ewma
+	seen    map[string]time.Time
+	last    time.Time
+	warm    bool // a first flush has populated seen
+}
+
+// New returns an engine for cfg sending to outputs. It returns nil when no
+// rule is enabled; a nil *Engine ignores all calls.
+func New(cfg Config, outputs []Output) *Engine {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.NewPeerWindow <= 0 {
+		cfg.NewPeerWindow = defaultNewPeerWindow
+	}
+	if cfg.ZMinSamples <= 0 {
+		cfg.ZMinSamples = defaultMinSamples
+	}
+	if cfg.Alpha <= 0 || cfg.Alpha >= 1 {
+		cfg.Alpha = defaultAlpha
+	}
+	return &Engine{
+		cfg:     cfg,
+		out:     newNotifier(outputs, 64),
+		active:  make(map[string]*active),
+		history: make(map[string]*ewma),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// FromEnv configures an engine from the ALERT_* variables.
+func FromEnv() *Engine {
+	cfg := Config{
+		ZMinSamples: envInt("ALERT_ZSCORE_MIN_SAMPLES", defaultMinSamples),
+		ZMinBytes:   uint64(envInt("ALERT_ZSCORE_MIN_BYTES", defaultZMinBytes)),
+		NewPeers:    envInt("ALERT_NEW_PEERS", 0),
+	}
+	cfg.PeerClass, cfg.PeerRate = envRule("ALERT_PEER_RATE", ClassConsensus)
+	cfg.HostClass, cfg.HostRate = envRule("ALERT_HOST_RATE", ClassAll)
+	cfg.ZClass, cfg.ZScore = envRule("ALERT_ZSCORE", ClassConsensus)
+	cfg.NewPeerWindow = envDuration("ALERT_NEW_PEER_WINDOW", defaultNewPeerWindow)
+	cfg.Repeat = envDuration("ALERT_REPEAT", 0)
+	if v := os.Getenv("ALERT_ZSCORE_ALPHA"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.Alpha = f
+		}
+	}
+
+	e := New(cfg, OutputsFromEnv())
+	if e != nil {
+		log.Printf("alert: peer_rate=%s:%.0f host_rate=%s:%.0f new_peers=%d zscore=%s:%.1f",
+			cfg.PeerClass, cfg.PeerRate, cfg.HostClass, cfg.HostRate, cfg.NewPeers, cfg.ZClass, cfg.ZScore)
+	}
+	return e
+}
+
+// Close waits for queued notifications to be delivered.
+func (e *Engine) Close() {
+	if e == nil {
+		return
+	}
+	e.out.close()
+}
+
+// Evaluate runs every enabled rule against one flush worth of records
+// taken at now.
+func (e *Engine) Evaluate(hostname string, recs []model.TrafficRecord, now time.Time) {
+	if e == nil {
+		return
+	}
+	interval := defaultInterval
+	if !e.last.IsZero() && now.After(e.last) {
+		interval = now.Sub(e.last)
+	}
+	e.last = now
+	secs := interval.Seconds()
+
+	firing := make(map[string]Alert)
+	fire := func(a Alert) {
+		a.State = Firing
+		a.Hostname = hostname
+		a.Time = now
+		firing[a.Key] = a
+	}
+
+	var hostBytes uint64
+	newPeers := 0
+	for _, r := range recs {
+		if e.cfg.PeerRate > 0 {
+			rate := float64(classBytes(r, e.cfg.PeerClass)) / secs
+			if rate > e.cfg.PeerRate {
+				fire(Alert{
+					Key: RulePeerRate + ":" + r.IP, Rule: RulePeerRate,
+					Subject: r.IP, Class: e.cfg.PeerClass,
+					Value: rate, Threshold: e.cfg.PeerRate,
+					Message: fmt.Sprintf("%s %s at %s/s (limit %s/s)",
+						r.IP, e.cfg.PeerClass, humanBytes(rate), humanBytes(e.cfg.PeerRate)),
+				})
+			}
+		}
+
+		hostBytes += classBytes(r, e.cfg.HostClass)
+
+		if _, ok := e.seen[r.IP]; !ok {
+			newPeers++
+		}
+		e.seen[r.IP] = now
+
+		if e.cfg.ZScore > 0 {
+			if a, ok := e.zscore(r, now); ok {
+				fire(a)
+			}
+		}
+	}
+
+	if e.cfg.HostRate > 0 {
+		rate := float64(hostBytes) / secs
+		if rate > e.cfg.HostRate {
+			fire(Alert{
+				Key: RuleHostRate, Rule: RuleHostRate,
+				Subject: "host", Class: e.cfg.HostClass,
+				Value: rate, Threshold: e.cfg.HostRate,
+				Message: fmt.Sprintf("host %s traffic at %s/s (limit %s/s)",
+					e.cfg.HostClass, humanBytes(rate), humanBytes(e.cfg.HostRate)),
+			})
+		}
+	}
+
+	// after a restart every peer is new; only count from the second flush
+	if e.cfg.NewPeers > 0 && e.warm && newPeers >= e.cfg.NewPeers {
+		fire(Alert{
+			Key: RuleNewPeers, Rule: RuleNewPeers,
+			Subject: "host",
+			Value:   float64(newPeers), Threshold: float64(e.cfg.NewPeers),
+			Message: fmt.Sprintf("%d new peers in one flush (limit %d, window %s)",
+				newPeers, e.cfg.NewPeers, e.cfg.NewPeerWindow),
+		})
+	}
+	e.warm = true
+
+	e.prune(now)
+	e.dispatch(firing, now)
+}
+
+// zscore scores r against the EWMA of its earlier intervals and then adds
+// it to the history.
+func (e *Engine) zscore(r model.TrafficRecord, now time.Time) (Alert, bool) {
+	x := float64(classBytes(r, e.cfg.ZClass))
+	w, ok := e.history[r.IP]
+	if !ok {
+		w = &ewma{}
+		e.history[r.IP] = w
+	}
+	defer func() {
+		w.add(x, e.cfg.Alpha)
+		w.last = now
+	}()
+
+	if w.n < e.cfg.ZMinSamples || w.variance <= 0 || x < float64(e.cfg.ZMinBytes) {
+		return Alert{}, false
+	}
+	z := (x - w.mean) / math.Sqrt(w.variance)
+	if z <= e.cfg.ZScore {
+		return Alert{}, false
+	}
+	return Alert{
+		Key: RuleZScore + ":" + r.IP, Rule: RuleZScore,
+		Subject: r.IP, Class: e.cfg.ZClass,
+		Value: z, Threshold: e.cfg.ZScore,
+		Message: fmt.Sprintf("%s %s %s in one flush, z=%.1f against a mean of %s",
+			r.IP, e.cfg.ZClass, humanBytes(x), z, humanBytes(w.mean)),
+	}, true
+}
+
+// dispatch sends new alerts, repeats long-running ones after cfg.Repeat and
+// resolves the ones that no longer fire.
+func (e *Engine) dispatch(firing map[string]Alert, now time.Time) {
+	for key, a := range firing {
+		cur, ok := e.active[key]
+		if !ok {
+			e.active[key] = &active{alert: a, sent: now}
+			e.out.send(a)
+			continue
+		}
+		cur.alert = a
+		if e.cfg.Repeat > 0 && now.Sub(cur.sent) >= e.cfg.Repeat {
+			cur.sent = now
+			e.out.send(a)
+		}
+	}
+
+	for key, cur := range e.active {
+		if _, ok := firing[key]; ok {
+			continue
+		}
+		a := cur.alert
+		a.State = Resolved
+		a.Time = now
+		a.Message = "resolved: " + a.Message
+		delete(e.active, key)
+		e.out.send(a)
+	}
+}
+
+// prune forgets peers that have not been seen within the new-peer window.
+func (e *Engine) prune(now time.Time) {
+	for ip, t := range e.seen {
+		if now.Sub(t) > e.cfg.NewPeerWindow {
+			delete(e.seen, ip)
+		}
+	}
+	for ip, w := range e.history {
+		if now.Sub(w.last) > e.cfg.NewPeerWindow {
+			delete(e.history, ip)
+		}
+	}
+}
+
+func classBytes(r model.TrafficRecord, class string) uint64 {
+	switch class {
+	case ClassConsensus:
+		return r.ConsensusUp + r.ConsensusDown
+	case ClassSiamux:
+		return r.SiamuxUp + r.SiamuxDown
+	case ClassQuic:
+		return r.QuicUp + r.QuicDown
+	case ClassOther:
+		return r.OtherUp + r.OtherDown
+	default:
+		return r.ConsensusUp + r.ConsensusDown + r.SiamuxUp + r.SiamuxDown +
+			r.QuicUp + r.QuicDown + r.OtherUp + r.OtherDown
+	}
+}
+
+func humanBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/div, "KMGTPE"[exp])
+}
+
+// envRule parses "<threshold>" or "<class>:<threshold>".
+func envRule(name, defClass string) (string, float64) {
+	v := os.Getenv(name)
+	if v == "" {
+		return defClass, 0
+	}
+	class := defClass
+	if c, t, ok := strings.Cut(v, ":"); ok {
+		class, v = strings.ToLower(strings.TrimSpace(c)), t
+	}
+	switch class {
+	case ClassConsensus, ClassSiamux, ClassQuic, ClassOther, ClassAll:
+	default:
+		log.Printf("alert: %s: unknown class %q, rule disabled", name, class)
+		return defClass, 0
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || f < 0 {
+		log.Printf("alert: invalid value for %s: %q, rule disabled", name, v)
+		return class, 0
+	}
+	return class, f
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("alert: invalid value for %s: %q", name, v)
+		return def
+	}
+	return n
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("alert: invalid value for %s: %q", name, v)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,190 @@
+package alert
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// recorder is an Output keeping every alert it is sent.
+type recorder struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Send(a Alert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+// run evaluates one flush per element of flushes, a minute apart, and
+// returns the alerts as "state key" strings once they are delivered.
+func run(t *testing.T, cfg Config, flushes [][]model.TrafficRecord) []string {
+	t.Helper()
+	rec := &recorder{}
+	e := New(cfg, []Output{rec})
+	if e == nil {
+		t.Fatal("no rule enabled")
+	}
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	for i, recs := range flushes {
+		e.Evaluate("h1", recs, start.Add(time.Duration(i)*time.Minute))
+	}
+	e.Close()
+
+	var out []string
+	for _, a := range rec.alerts {
+		if a.Hostname != "h1" {
+			t.Errorf("alert %s without the hostname", a.Key)
+		}
+		out = append(out, a.State+" "+a.Key)
+	}
+	return out
+}
+
+func peer(ip string, consensus, siamux uint64) model.TrafficRecord {
+	return model.TrafficRecord{IP: ip, ConsensusUp: consensus, SiamuxDown: siamux}
+}
+
+func TestNewWithoutRules(t *testing.T) {
+	e := New(Config{}, nil)
+	if e != nil {
+		t.Fatal("engine without rules is not nil")
+	}
+	// a nil engine ignores all calls
+	e.Evaluate("h1", []model.TrafficRecord{peer("192.0.2.1", 1, 0)}, time.Now())
+	e.Close()
+}
+
+func TestRules(t *testing.T) {
+	const a, b, c, d = "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		flushes [][]model.TrafficRecord
+		want    []string
+	}{{
+		// 100 B/s over a one minute flush is 6000 bytes
+		name: "peer rate fires once per peer and resolves",
+		cfg:  Config{PeerRate: 100, PeerClass: ClassConsensus},
+		flushes: [][]model.TrafficRecord{
+			{peer(a, 6001, 0), peer(b, 6000, 1<<20)}, // siamux is not watched
+			{peer(a, 9000, 0), peer(b, 0, 0)},
+			{peer(a, 10, 0)},
+		},
+		want: []string{"firing peer_rate:" + a, "resolved peer_rate:" + a},
+	}, {
+		name: "host rate sums every peer",
+		cfg:  Config{HostRate: 100, HostClass: ClassAll},
+		flushes: [][]model.TrafficRecord{
+			{peer(a, 3000, 0), peer(b, 0, 2000)},
+			{peer(a, 3000, 0), peer(b, 0, 3001)},
+			{peer(a, 3000, 0), peer(b, 1000, 3000)},
+			{peer(a, 10, 0)},
+		},
+		want: []string{"firing host_rate", "resolved host_rate"},
+	}, {
+		name: "host rate per class",
+		cfg:  Config{HostRate: 100, HostClass: ClassSiamux},
+		flushes: [][]model.TrafficRecord{
+			{peer(a, 1<<20, 0), peer(b, 0, 6000)},
+			{peer(a, 0, 3001), peer(b, 0, 3000)},
+		},
+		want: []string{"firing host_rate"},
+	}, {
+		name: "new peers skip the first flush",
+		cfg:  Config{NewPeers: 2},
+		flushes: [][]model.TrafficRecord{
+			{peer(a, 1, 0), peer(b, 1, 0), peer(c, 1, 0)},
+			{peer(a, 1, 0), peer(d, 1, 0)},
+			{peer(a, 1, 0), peer(b, 1, 0), peer(c, 1, 0), peer(d, 1, 0), peer("192.0.2.5", 1, 0)},
+			{peer("192.0.2.6", 1, 0), peer("192.0.2.7", 1, 0)},
+			{peer(a, 1, 0)},
+		},
+		want: []string{"firing new_peers", "resolved new_peers"},
+	}, {
+		name: "new peers after the window",
+		cfg:  Config{NewPeers: 2, NewPeerWindow: 90 * time.Second},
+		flushes: [][]model.TrafficRecord{
+			{peer(a, 1, 0), peer(b, 1, 0)},
+			{},
+			{},
+			{peer(a, 1, 0), peer(b, 1, 0)},
+		},
+		want: []string{"firing new_peers"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := run(t, tt.cfg, tt.flushes)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("alerts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	cfg := Config{PeerRate: 100, PeerClass: ClassConsensus, Repeat: 2 * time.Minute}
+	high := []model.TrafficRecord{peer("192.0.2.1", 1<<20, 0)}
+	got := run(t, cfg, [][]model.TrafficRecord{high, high, high, high})
+	want := []string{"firing peer_rate:192.0.2.1", "firing peer_rate:192.0.2.1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("alerts = %q, want %q", got, want)
+	}
+}
+
+func TestZScore(t *testing.T) {
+	const (
+		steady   = "192.0.2.1" // varied history, then a spike
+		flat     = "192.0.2.2" // constant history: zero variance
+		early    = "192.0.2.3" // spike during warm-up
+		small    = "192.0.2.4" // spike below ZMinBytes
+		minBytes = 10000
+	)
+	cfg := Config{ZScore: 3, ZClass: ClassConsensus, ZMinSamples: 5, ZMinBytes: minBytes, Alpha: 0.3}
+
+	var flushes [][]model.TrafficRecord
+	for i := 0; i < 8; i++ {
+		n := uint64(1000 + 200*(i%2))
+		recs := []model.TrafficRecord{peer(steady, n, 0), peer(flat, 1000, 0), peer(small, n/100, 0)}
+		if i == 2 {
+			recs = append(recs, peer(early, 1<<20, 0))
+		} else {
+			recs = append(recs, peer(early, n, 0))
+		}
+		flushes = append(flushes, recs)
+	}
+	flushes = append(flushes,
+		[]model.TrafficRecord{peer(steady, 1<<20, 0), peer(flat, 1<<20, 0), peer(early, 1000, 0), peer(small, minBytes-1, 0)},
+		[]model.TrafficRecord{peer(steady, 1100, 0)},
+	)
+
+	got := run(t, cfg, flushes)
+	want := []string{"firing zscore:" + steady, "resolved zscore:" + steady}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("alerts = %q, want %q", got, want)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	var w ewma
+	for _, x := range []float64{10, 10, 10} {
+		w.add(x, 0.5)
+	}
+	if w.mean != 10 || w.variance != 0 || w.n != 3 {
+		t.Fatalf("constant input: %+v", w)
+	}
+	w.add(20, 0.5)
+	// mean moves half way; variance = (1-a)*(0 + diff*a*diff) = 0.5*50
+	if w.mean != 15 || w.variance != 25 {
+		t.Fatalf("after a step: mean %v variance %v, want 15 and 25", w.mean, w.variance)
+	}
+}
@@ -0,0 +1,121 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// Output delivers alerts.
+type Output interface {
+	Name() string
+	Send(Alert) error
+}
+
+// OutputsFromEnv returns the log output (unless ALERT_LOG=0) and a webhook
+// for every URL in ALERT_WEBHOOK.
+func OutputsFromEnv() []Output {
+	var out []Output
+	if os.Getenv("ALERT_LOG") != "0" {
+		out = append(out, Log{})
+	}
+	for _, u := range strings.Split(os.Getenv("ALERT_WEBHOOK"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			out = append(out, &Webhook{URL: u})
+		}
+	}
+	return out
+}
+
+// Log writes alerts to the collector log.
+type Log struct{}
+
+func (Log) Name() string { return "log" }
+
+func (Log) Send(a Alert) error {
+	log.Printf("ALERT [%s] %s %s: %s", a.State, a.Hostname, a.Rule, a.Message)
+	return nil
+}
+
+// Webhook POSTs each alert as JSON. The message is repeated in a "text"
+// field so Slack and Mattermost incoming webhooks display it as is.
+type Webhook struct {
+	URL string
+
+	client *http.Client
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Send(a Alert) error {
+	body, err := json.Marshal(struct {
+		Alert
+		Text string `json:"text"`
+	}{a, fmt.Sprintf("[%s] %s: %s", a.State, a.Hostname, a.Message)})
+	if err != nil {
+		return err
+	}
+
+	if w.client == nil {
+		w.client = &http.Client{Timeout: webhookTimeout}
+	}
+	resp, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// notifier delivers alerts on a background goroutine so a slow webhook
+// never delays a flush.
+type notifier struct {
+	outputs []Output
+	queue   chan Alert
+	wg      sync.WaitGroup
+}
+
+func newNotifier(outputs []Output, queueSize int) *notifier {
+	n := &notifier{outputs: outputs, queue: make(chan Alert, queueSize)}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+func (n *notifier) send(a Alert) {
+	select {
+	case n.queue <- a:
+	default:
+		log.Printf("alert: queue full, dropping %s %s", a.State, a.Key)
+	}
+}
+
+func (n *notifier) close() {
+	close(n.queue)
+	n.wg.Wait()
+}
+
+func (n *notifier) run() {
+	defer n.wg.Done()
+	for a := range n.queue {
+		for _, o := range n.outputs {
+			if err := o.Send(a); err != nil {
+				log.Printf("alert: %s: %v", o.Name(), err)
+			}
+		}
+	}
+}
@@ -18,6 +18,28 @@ char LICENSE[] SEC("license") = "GPL";
 #define PORT_SIAMUX    2
 #define PORT_QUIC      3
 
+// collector_config indexes
+#define CFG_COUNT_OTHER 0
+#define CFG_ALLOW4      1   // set when cidr4_allow has entries
+#define CFG_ALLOW6      2   // set when cidr6_allow has entries
+
+// traffic classes returned by classify()
+#define CLASS_NONE      0
+#define CLASS_CONSENSUS 1
+#define CLASS_SIAMUX    2
+#define CLASS_QUIC      3
+#define CLASS_OTHER     4
+
+#define OVERFLOW_IP4   0
+#define OVERFLOW_IP6   1
+
+#define BLOCKED_IP4    0
+#define BLOCKED_IP6    1
+
+#ifndef EEXIST
+#define EEXIST 17
+#endif
+
 struct sia_ip_stats {
     __u64 consensus_up;
     __u64 consensus_down;
@@ -25,6 +47,18 @@ struct sia_ip_stats {
     __u64 siamux_down;
     __u64 quic_up;
     __u64 quic_down;
+    __u64 other_up;         // only counted when CFG_COUNT_OTHER is set
+    __u64 other_down;
+};
+
+struct lpm_key4 {
+    __u32 prefixlen;
+    __u32 addr;                      // network order
+};
+
+struct lpm_key6 {
+    __u32 prefixlen;
+    struct in6_addr addr;
 };
 
 struct {
@@ -34,6 +68,14 @@ struct {
     __type(value, __u16);
 } port_config SEC(".maps");
 
+// Feature switches written by the Go loader, indexed by CFG_*.
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 4);
+    __type(key, __u32);
+    __type(value, __u32);
+} collector_config SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 65535);
@@ -55,12 +97,210 @@ struct {
     __type(value, __u32);
 } tc_last_ip4 SEC(".maps");
 
+// Peer filters, managed from Go (CIDR_DENY / CIDR_ALLOW, `collector filter`).
+// A peer matching a deny prefix is never accounted. When an allow list has
+// entries, only peers matching it are accounted.
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key4);
+    __type(value, __u8);
+} cidr4_deny SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key4);
+    __type(value, __u8);
+} cidr4_allow SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key6);
+    __type(value, __u8);
+} cidr6_deny SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key6);
+    __type(value, __u8);
+} cidr6_allow SEC(".maps");
+
+// Blocklist, managed from Go (quota enforcement, `collector filter add
+// block`). New Sia connections from a matching peer (TCP SYN, QUIC long
+// header) are dropped at XDP; established flows are left alone.
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 4096);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key4);
+    __type(value, __u8);
+} blocklist4 SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 4096);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct lpm_key6);
+    __type(value, __u8);
+} blocklist6 SEC(".maps");
+
+// Packets dropped because of the blocklist, indexed by BLOCKED_IP4 /
+// BLOCKED_IP6.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, __u64);
+} block_drops SEC(".maps");
+
+// Number of peers that could not be inserted because ip4_stats/ip6_stats
+// was full. Indexed by OVERFLOW_IP4 / OVERFLOW_IP6, summed over CPUs in Go.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, __u64);
+} map_overflow SEC(".maps");
+
 static __always_inline __u16 get_port(__u32 name)
 {
     __u16 *p = bpf_map_lookup_elem(&port_config, &name);
     return p ? *p : 0;
 }
 
+static __always_inline __u32 get_config(__u32 key)
+{
+    __u32 *v = bpf_map_lookup_elem(&collector_config, &key);
+    return v ? *v : 0;
+}
+
+static __always_inline bool peer_allowed4(__u32 ip)
+{
+    struct lpm_key4 k = { .prefixlen = 32, .addr = ip };
+
+    if (bpf_map_lookup_elem(&cidr4_deny, &k))
+        return false;
+    if (get_config(CFG_ALLOW4) && !bpf_map_lookup_elem(&cidr4_allow, &k))
+        return false;
+    return true;
+}
+
+static __always_inline bool peer_allowed6(struct in6_addr *ip6)
+{
+    struct lpm_key6 k = { .prefixlen = 128, .addr = *ip6 };
+
+    if (bpf_map_lookup_elem(&cidr6_deny, &k))
+        return false;
+    if (get_config(CFG_ALLOW6) && !bpf_map_lookup_elem(&cidr6_allow, &k))
+        return false;
+    return true;
+}
+
+static __always_inline void count_overflow(__u32 which)
+{
+    __u64 *c = bpf_map_lookup_elem(&map_overflow, &which);
+    if (c)
+        *c += 1;
+}
+
+static __always_inline void count_block(__u32 which)
+{
+    __u64 *c = bpf_map_lookup_elem(&block_drops, &which);
+    if (c)
+        *c += 1;
+}
+
+static __always_inline bool blocked4(__u32 ip)
+{
+    struct lpm_key4 k = { .prefixlen = 32, .addr = ip };
+    return bpf_map_lookup_elem(&blocklist4, &k) != NULL;
+}
+
+static __always_inline bool blocked6(struct in6_addr *ip6)
+{
+    struct lpm_key6 k = { .prefixlen = 128, .addr = *ip6 };
+    return bpf_map_lookup_elem(&blocklist6, &k) != NULL;
+}
+
+/*
+ * classify maps a packet to a traffic class before any map entry is
+ * created, so flows that match no configured port never allocate a key
+ * in ip4_stats/ip6_stats unless CFG_COUNT_OTHER is set.
+ */
+static __always_inline int classify(__u8 proto, __u16 sport, __u16 dport,
+                                    bool egress)
+{
+    __u16 port = egress ? sport : dport;
+
+    if (proto == IPPROTO_TCP) {
+        if (port == get_port(PORT_CONSENSUS))
+            return CLASS_CONSENSUS;
+        if (port == get_port(PORT_SIAMUX))
+            return CLASS_SIAMUX;
+    } else if (proto == IPPROTO_UDP) {
+        if (port == get_port(PORT_QUIC))
+            return CLASS_QUIC;
+    }
+
+    return get_config(CFG_COUNT_OTHER) ? CLASS_OTHER : CLASS_NONE;
+}
+
+/*
+ * new_conn reports whether an ingress packet opens a Sia connection: a TCP
+ * SYN without ACK to the consensus or siamux port, or a QUIC long header
+ * packet (Initial/Handshake) to the QUIC port.
+ */
+static __always_inline bool new_conn(__u8 proto, void *l4, void *data_end,
+                                     __u16 sport, __u16 dport)
+{
+    int class = classify(proto, sport, dport, false);
+
+    if (proto == IPPROTO_TCP) {
+        struct tcphdr *th = l4;
+        if ((void *)(th + 1) > data_end)
+            return false;
+        return (class == CLASS_CONSENSUS || class == CLASS_SIAMUX) &&
+               th->syn && !th->ack;
+    }
+    if (proto == IPPROTO_UDP && class == CLASS_QUIC) {
+        __u8 *first = (__u8 *)l4 + sizeof(struct udphdr);
+        if ((void *)(first + 1) > data_end)
+            return false;
+        return (*first & 0x80) != 0;
+    }
+    return false;
+}
+
+static __always_inline void add_bytes(struct sia_ip_stats *st, int class,
+                                      __u64 bytes, bool egress)
+{
+    switch (class) {
+    case CLASS_CONSENSUS:
+        if (egress) st->consensus_up   += bytes;
+        else        st->consensus_down += bytes;
+        break;
+    case CLASS_SIAMUX:
+        if (egress) st->siamux_up   += bytes;
+        else        st->siamux_down += bytes;
+        break;
+    case CLASS_QUIC:
+        if (egress) st->quic_up   += bytes;
+        else        st->quic_down += bytes;
+        break;
+    case CLASS_OTHER:
+        if (egress) st->other_up   += bytes;
+        else        st->other_down += bytes;
+        break;
+    }
+}
+
 static __always_inline void account_ipv4(__u32 ip, __u8 proto,
                                          __u16 sport, __u16 dport,
                                          __u64 bytes, bool egress)
@@ -68,34 +308,27 @@ static __always_inline void account_ipv4(__u32 ip, __u8 proto,
     struct sia_ip_stats *st;
     struct sia_ip_stats zero = {};
 
+    int class = classify(proto, sport, dport, egress);
+    if (class == CLASS_NONE)
+        return;
+    if (!peer_allowed4(ip))
+        return;
+
     st = bpf_map_lookup_elem(&ip4_stats, &ip);
     if (!st) {
-        bpf_map_update_elem(&ip4_stats, &ip, &zero, BPF_ANY);
+        // EEXIST means another CPU inserted the key first, anything else
+        // (E2BIG) means the map is full and this peer goes uncounted.
+        long err = bpf_map_update_elem(&ip4_stats, &ip, &zero, BPF_NOEXIST);
+        if (err && err != -EEXIST) {
+            count_overflow(OVERFLOW_IP4);
+            return;
+        }
         st = bpf_map_lookup_elem(&ip4_stats, &ip);
         if (!st)
             return;
     }
 
-    __u16 p_consensus = get_port(PORT_CONSENSUS);
-    __u16 p_siamux    = get_port(PORT_SIAMUX);
-    __u16 p_quic      = get_port(PORT_QUIC);
-
-    __u16 port = egress ? sport : dport;
-
-    if (proto == IPPROTO_TCP) {
-        if (port == p_consensus) {
-            if (egress) st->consensus_up   += bytes;
-            else        st->consensus_down += bytes;
-        } else if (port == p_siamux) {
-            if (egress) st->siamux_up   += bytes;
-            else        st->siamux_down += bytes;
-        }
-    } else if (proto == IPPROTO_UDP) {
-        if (port == p_quic) {
-            if (egress) st->quic_up   += bytes;
-            else        st->quic_down += bytes;
-        }
-    }
+    add_bytes(st, class, bytes, egress);
 }
 
 static __always_inline void account_ipv6(struct in6_addr *ip6, __u8 proto,
@@ -105,34 +338,25 @@ static __always_inline void account_ipv6(struct in6_addr *ip6, __u8 proto,
     struct sia_ip_stats *st;
     struct sia_ip_stats zero = {};
 
+    int class = classify(proto, sport, dport, egress);
+    if (class == CLASS_NONE)
+        return;
+    if (!peer_allowed6(ip6))
+        return;
+
     st = bpf_map_lookup_elem(&ip6_stats, ip6);
     if (!st) {
-        bpf_map_update_elem(&ip6_stats, ip6, &zero, BPF_ANY);
+        long err = bpf_map_update_elem(&ip6_stats, ip6, &zero, BPF_NOEXIST);
+        if (err && err != -EEXIST) {
+            count_overflow(OVERFLOW_IP6);
+            return;
+        }
         st = bpf_map_lookup_elem(&ip6_stats, ip6);
         if (!st)
             return;
     }
 
-    __u16 p_consensus = get_port(PORT_CONSENSUS);
-    __u16 p_siamux    = get_port(PORT_SIAMUX);
-    __u16 p_quic      = get_port(PORT_QUIC);
-
-    __u16 port = egress ? sport : dport;
-
-    if (proto == IPPROTO_TCP) {
-        if (port == p_consensus) {
-            if (egress) st->consensus_up   += bytes;
-            else        st->consensus_down += bytes;
-        } else if (port == p_siamux) {
-            if (egress) st->siamux_up   += bytes;
-            else        st->siamux_down += bytes;
-        }
-    } else if (proto == IPPROTO_UDP) {
-        if (port == p_quic) {
-            if (egress) st->quic_up   += bytes;
-            else        st->quic_down += bytes;
-        }
-    }
+    add_bytes(st, class, bytes, egress);
 }
 
 /*
@@ -140,46 +364,53 @@ static __always_inline void account_ipv6(struct in6_addr *ip6, __u8 proto,
  * bytes for the packet (Ethernet frame length at XDP, skb->len at TC).
  * We keep computing sport/dport and proto as before, but we pass
  * bytes_l2 into account_* so the existing counters reflect full-frame bytes.
+ *
+ * They return true when an ingress packet must be dropped (see blocklist4).
  */
 
-static __always_inline int handle_ipv4(void *data, void *data_end,
+static __always_inline bool handle_ipv4(void *data, void *data_end,
                                        __u64 bytes_l2,
                                        bool egress)
 {
     struct iphdr *iph = data;
     if ((void *)(iph + 1) > data_end)
-        return 0;
+        return false;
 
     __u8 proto = iph->protocol;
     __u32 ihl = iph->ihl * 4;
     if ((void *)iph + ihl > data_end)
-        return 0;
+        return false;
 
     __u16 sport = 0, dport = 0;
 
     void *l4 = (void *)iph + ihl;
     if (l4 > data_end)
-        return 0;
+        return false;
 
     if (proto == IPPROTO_TCP) {
         struct tcphdr *th = l4;
         if ((void *)(th + 1) > data_end)
-            return 0;
+            return false;
         sport = bpf_ntohs(th->source);
         dport = bpf_ntohs(th->dest);
     } else if (proto == IPPROTO_UDP) {
         struct udphdr *uh = l4;
         if ((void *)(uh + 1) > data_end)
-            return 0;
+            return false;
         sport = bpf_ntohs(uh->source);
         dport = bpf_ntohs(uh->dest);
     } else {
-        return 0;
+        return false;
     }
 
     __u32 src = iph->saddr;
     __u32 dst = iph->daddr;
 
+    if (!egress && blocked4(src) && new_conn(proto, l4, data_end, sport, dport)) {
+        count_block(BLOCKED_IP4);
+        return true;
+    }
+
     // For ingress: client is src, for egress: client is dst
     __u32 client = egress ? dst : src;
 
@@ -192,49 +423,54 @@ static __always_inline int handle_ipv4(void *data, void *data_end,
         bpf_map_update_elem(&tc_last_ip4, &key1, &dst, BPF_ANY);
     }
 
-    return 0;
+    return false;
 }
 
-static __always_inline int handle_ipv6(void *data, void *data_end,
+static __always_inline bool handle_ipv6(void *data, void *data_end,
                                        __u64 bytes_l2,
                                        bool egress)
 {
     struct ipv6hdr *ip6h = data;
     if ((void *)(ip6h + 1) > data_end)
-        return 0;
+        return false;
 
     __u8 proto = ip6h->nexthdr;
     void *l4 = ip6h + 1;
     if (l4 > data_end)
-        return 0;
+        return false;
 
     __u16 sport = 0, dport = 0;
 
     if (proto == IPPROTO_TCP) {
         struct tcphdr *th = l4;
         if ((void *)(th + 1) > data_end)
-            return 0;
+            return false;
         sport = bpf_ntohs(th->source);
         dport = bpf_ntohs(th->dest);
     } else if (proto == IPPROTO_UDP) {
         struct udphdr *uh = l4;
         if ((void *)(uh + 1) > data_end)
-            return 0;
+            return false;
         sport = bpf_ntohs(uh->source);
         dport = bpf_ntohs(uh->dest);
     } else {
-        return 0;
+        return false;
     }
 
     struct in6_addr src = ip6h->saddr;
     struct in6_addr dst = ip6h->daddr;
 
+    if (!egress && blocked6(&src) && new_conn(proto, l4, data_end, sport, dport)) {
+        count_block(BLOCKED_IP6);
+        return true;
+    }
+
     struct in6_addr client = egress ? dst : src;
 
     // Use bytes_l2 (full on-wire bytes) as the metric stored in the existing counters.
     account_ipv6(&client, proto, sport, dport, bytes_l2, egress);
 
-    return 0;
+    return false;
 }
 
 SEC("xdp")
@@ -253,13 +489,14 @@ int xdp_ingress(struct xdp_md *ctx)
     __u16 h_proto = bpf_ntohs(eth->h_proto);
     void *nh = eth + 1;
 
+    bool drop = false;
     if (h_proto == ETH_P_IP) {
-        handle_ipv4(nh, data_end, bytes_l2, false);
+        drop = handle_ipv4(nh, data_end, bytes_l2, false);
     } else if (h_proto == ETH_P_IPV6) {
-        handle_ipv6(nh, data_end, bytes_l2, false);
+        drop = handle_ipv6(nh, data_end, bytes_l2, false);
     }
 
-    return XDP_PASS;
+    return drop ? XDP_DROP : XDP_PASS;
 }
 
 SEC("tc")
@@ -21,6 +21,18 @@ type SiaIn6Addr struct {
 	}
 }
 
+type SiaLpmKey4 struct {
+	_         structs.HostLayout
+	Prefixlen uint32
+	Addr      uint32
+}
+
+type SiaLpmKey6 struct {
+	_         structs.HostLayout
+	Prefixlen uint32
+	Addr      SiaIn6Addr
+}
+
 type SiaSiaIpStats struct {
 	_             structs.HostLayout
 	ConsensusUp   uint64
@@ -29,6 +41,8 @@ type SiaSiaIpStats struct {
 	SiamuxDown    uint64
 	QuicUp        uint64
 	QuicDown      uint64
+	OtherUp       uint64
+	OtherDown     uint64
 }
 
 // LoadSia returns the embedded CollectionSpec for Sia.
@@ -81,10 +95,19 @@ type SiaProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type SiaMapSpecs struct {
-	Ip4Stats   *ebpf.MapSpec `ebpf:"ip4_stats"`
-	Ip6Stats   *ebpf.MapSpec `ebpf:"ip6_stats"`
-	PortConfig *ebpf.MapSpec `ebpf:"port_config"`
-	TcLastIp4  *ebpf.MapSpec `ebpf:"tc_last_ip4"`
+	BlockDrops      *ebpf.MapSpec `ebpf:"block_drops"`
+	Blocklist4      *ebpf.MapSpec `ebpf:"blocklist4"`
+	Blocklist6      *ebpf.MapSpec `ebpf:"blocklist6"`
+	Cidr4Allow      *ebpf.MapSpec `ebpf:"cidr4_allow"`
+	Cidr4Deny       *ebpf.MapSpec `ebpf:"cidr4_deny"`
+	Cidr6Allow      *ebpf.MapSpec `ebpf:"cidr6_allow"`
+	Cidr6Deny       *ebpf.MapSpec `ebpf:"cidr6_deny"`
+	CollectorConfig *ebpf.MapSpec `ebpf:"collector_config"`
+	Ip4Stats        *ebpf.MapSpec `ebpf:"ip4_stats"`
+	Ip6Stats        *ebpf.MapSpec `ebpf:"ip6_stats"`
+	MapOverflow     *ebpf.MapSpec `ebpf:"map_overflow"`
+	PortConfig      *ebpf.MapSpec `ebpf:"port_config"`
+	TcLastIp4       *ebpf.MapSpec `ebpf:"tc_last_ip4"`
 }
 
 // SiaVariableSpecs contains global variables before they are loaded into the kernel.
@@ -113,16 +136,34 @@ func (o *SiaObjects) Close() error {
 //
 // It can be passed to LoadSiaObjects or ebpf.CollectionSpec.LoadAndAssign.
 type SiaMaps struct {
-	Ip4Stats   *ebpf.Map `ebpf:"ip4_stats"`
-	Ip6Stats   *ebpf.Map `ebpf:"ip6_stats"`
-	PortConfig *ebpf.Map `ebpf:"port_config"`
-	TcLastIp4  *ebpf.Map `ebpf:"tc_last_ip4"`
+	BlockDrops      *ebpf.Map `ebpf:"block_drops"`
+	Blocklist4      *ebpf.Map `ebpf:"blocklist4"`
+	Blocklist6      *ebpf.Map `ebpf:"blocklist6"`
+	Cidr4Allow      *ebpf.Map `ebpf:"cidr4_allow"`
+	Cidr4Deny       *ebpf.Map `ebpf:"cidr4_deny"`
+	Cidr6Allow      *ebpf.Map `ebpf:"cidr6_allow"`
+	Cidr6Deny       *ebpf.Map `ebpf:"cidr6_deny"`
+	CollectorConfig *ebpf.Map `ebpf:"collector_config"`
+	Ip4Stats        *ebpf.Map `ebpf:"ip4_stats"`
+	Ip6Stats        *ebpf.Map `ebpf:"ip6_stats"`
+	MapOverflow     *ebpf.Map `ebpf:"map_overflow"`
+	PortConfig      *ebpf.Map `ebpf:"port_config"`
+	TcLastIp4       *ebpf.Map `ebpf:"tc_last_ip4"`
 }
 
 func (m *SiaMaps) Close() error {
 	return _SiaClose(
+		m.BlockDrops,
+		m.Blocklist4,
+		m.Blocklist6,
+		m.Cidr4Allow,
+		m.Cidr4Deny,
+		m.Cidr6Allow,
+		m.Cidr6Deny,
+		m.CollectorConfig,
 		m.Ip4Stats,
 		m.Ip6Stats,
+		m.MapOverflow,
 		m.PortConfig,
 		m.TcLastIp4,
 	)
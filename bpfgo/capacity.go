@@ -0,0 +1,152 @@
+package bpfgo
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	// indexes into the map_overflow per-CPU array (see prog.c)
+	OVERFLOW_IP4 = 0
+	OVERFLOW_IP6 = 1
+
+	defaultWarnPercent = 80
+)
+
+// MapUsage describes how full one of the per-peer stats maps is.
+type MapUsage struct {
+	Name       string
+	Entries    int
+	MaxEntries uint32
+	Overflows  uint64 // peers dropped because the map was full (since load)
+}
+
+// Percent returns the occupancy of the map in percent.
+func (u MapUsage) Percent() float64 {
+	if u.MaxEntries == 0 {
+		return 0
+	}
+	return float64(u.Entries) * 100 / float64(u.MaxEntries)
+}
+
+// configureStatsMaps applies MAP_MAX_ENTRIES and MAP_TYPE to the ip4_stats and
+// ip6_stats specs before the collection is created.
+//
+// MAP_TYPE=lru switches both maps to BPF_MAP_TYPE_LRU_HASH so the least
+// recently active peers are evicted instead of new peers being refused.
+func configureStatsMaps(spec *ebpf.CollectionSpec) error {
+	var maxEntries uint32
+	if v := os.Getenv("MAP_MAX_ENTRIES"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid value for MAP_MAX_ENTRIES: %q", v)
+		}
+		maxEntries = uint32(n)
+	}
+
+	var mapType ebpf.MapType
+	switch t := strings.ToLower(os.Getenv("MAP_TYPE")); t {
+	case "", "hash":
+	case "lru":
+		mapType = ebpf.LRUHash
+	default:
+		return fmt.Errorf("invalid value for MAP_TYPE: %q (want hash or lru)", t)
+	}
+
+	for _, name := range []string{"ip4_stats", "ip6_stats"} {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("missing map spec %s", name)
+		}
+		if maxEntries != 0 {
+			ms.MaxEntries = maxEntries
+		}
+		if mapType != ebpf.UnspecifiedMap {
+			ms.Type = mapType
+		}
+	}
+	return nil
+}
+
+// Usage counts the entries of ip4_stats and ip6_stats and reads the overflow
+// counters maintained by the BPF program.
+func (h *Handles) Usage() ([]MapUsage, error) {
+	out := make([]MapUsage, 0, 2)
+	for _, m := range []struct {
+		name     string
+		m        *ebpf.Map
+		overflow uint32
+	}{
+		{"ip4_stats", h.IP4Stats, OVERFLOW_IP4},
+		{"ip6_stats", h.IP6Stats, OVERFLOW_IP6},
+	} {
+		if m.m == nil {
+			continue
+		}
+		n, err := countEntries(m.m)
+		if err != nil {
+			return nil, fmt.Errorf("count %s: %w", m.name, err)
+		}
+		u := MapUsage{Name: m.name, Entries: n, MaxEntries: m.m.MaxEntries()}
+		if h.Overflow != nil {
+			var perCPU []uint64
+			if err := h.Overflow.Lookup(m.overflow, &perCPU); err != nil {
+				return nil, fmt.Errorf("read overflow counter for %s: %w", m.name, err)
+			}
+			for _, c := range perCPU {
+				u.Overflows += c
+			}
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// LogCapacity logs the occupancy of the stats maps and warns when a map is
+// above MAP_WARN_PERCENT (default 80) or has started dropping peers.
+func (h *Handles) LogCapacity() {
+	warn := float64(defaultWarnPercent)
+	if v := os.Getenv("MAP_WARN_PERCENT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			warn = f
+		}
+	}
+
+	usage, err := h.Usage()
+	if err != nil {
+		log.Printf("bpf: map usage: %v", err)
+		return
+	}
+
+	for _, u := range usage {
+		switch {
+		case u.Overflows > 0:
+			log.Printf("WARNING: bpf: %s full, %d peers not counted (%d/%d entries); raise MAP_MAX_ENTRIES or set MAP_TYPE=lru",
+				u.Name, u.Overflows, u.Entries, u.MaxEntries)
+		case u.Percent() >= warn:
+			log.Printf("WARNING: bpf: %s at %.1f%% capacity (%d/%d entries)",
+				u.Name, u.Percent(), u.Entries, u.MaxEntries)
+		}
+	}
+}
+
+// countEntries iterates the map and returns the number of keys.
+func countEntries(m *ebpf.Map) (int, error) {
+	keyBuf := make([]byte, m.KeySize())
+	valBuf := make([]byte, m.ValueSize())
+
+	n := 0
+	it := m.Iterate()
+	for it.Next(&keyBuf, &valBuf) {
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return n, fmt.Errorf("iterate map: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,375 @@
+package bpfgo
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	// indexes into the block_drops per-CPU array (see prog.c)
+	BLOCKED_IP4 = 0
+	BLOCKED_IP6 = 1
+
+	// default bpffs directory for maps shared with `collector filter`
+	defaultPinPath = "/sys/fs/bpf/collector"
+
+	CFG_ALLOW4 = 1
+	CFG_ALLOW6 = 2
+
+	FilterDeny  = "deny"
+	FilterAllow = "allow"
+	FilterBlock = "block" // drop new connections (blocklist4/blocklist6)
+)
+
+// ErrNotInList is returned by Filters.Remove for a prefix that is not listed.
+var ErrNotInList = errors.New("not in list")
+
+// pinnedMaps are pinned under PinPath() so the CLI can edit them while the
+// daemon is running.
+var pinnedMaps = []string{
+	"collector_config",
+	"cidr4_deny",
+	"cidr4_allow",
+	"cidr6_deny",
+	"cidr6_allow",
+	"blocklist4",
+	"blocklist6",
+}
+
+// lpmKey4 and lpmKey6 match struct lpm_key4/lpm_key6 in prog.c.
+type lpmKey4 struct {
+	Prefixlen uint32
+	Addr      [4]byte
+}
+
+type lpmKey6 struct {
+	Prefixlen uint32
+	Addr      [16]byte
+}
+
+// FilterEntry is one prefix in an allow or deny list.
+type FilterEntry struct {
+	List   string
+	Prefix netip.Prefix
+}
+
+// Filters gives access to the CIDR allow/deny LPM tries consulted by
+// xdp_ingress and tc_egress before a peer is accounted, and to the
+// blocklist xdp_ingress uses to drop new connections.
+type Filters struct {
+	config *ebpf.Map
+	deny4  *ebpf.Map
+	allow4 *ebpf.Map
+	deny6  *ebpf.Map
+	allow6 *ebpf.Map
+	block4 *ebpf.Map
+	block6 *ebpf.Map
+
+	owned bool // maps were opened from bpffs and must be closed
+}
+
+// PinPath returns the bpffs directory used for pinned maps (BPF_PIN_PATH).
+func PinPath() string {
+	if p := os.Getenv("BPF_PIN_PATH"); p != "" {
+		return filepath.Clean(p)
+	}
+	return defaultPinPath
+}
+
+// pinFilterMaps marks the filter maps for pinning by name.
+func pinFilterMaps(spec *ebpf.CollectionSpec) (*ebpf.CollectionOptions, error) {
+	for _, name := range pinnedMaps {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return nil, fmt.Errorf("missing map spec %s", name)
+		}
+		ms.Pinning = ebpf.PinByName
+	}
+
+	path := PinPath()
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("create pin path %s: %w", path, err)
+	}
+	return &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: path}}, nil
+}
+
+// Filters returns the filter maps of a loaded collection.
+func (h *Handles) Filters() (*Filters, error) {
+	f := &Filters{}
+	for name, dst := range f.maps() {
+		m, ok := h.Coll.Maps[name]
+		if !ok {
+			return nil, fmt.Errorf("missing map %s", name)
+		}
+		*dst = m
+	}
+	return f, nil
+}
+
+// OpenFilters opens the filter maps pinned by a running collector.
+func OpenFilters() (*Filters, error) {
+	f := &Filters{owned: true}
+	for name, dst := range f.maps() {
+		m, err := ebpf.LoadPinnedMap(filepath.Join(PinPath(), name), nil)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("open pinned map %s (is the collector running?): %w", name, err)
+		}
+		*dst = m
+	}
+	return f, nil
+}
+
+func (f *Filters) maps() map[string]**ebpf.Map {
+	return map[string]**ebpf.Map{
+		"collector_config": &f.config,
+		"cidr4_deny":       &f.deny4,
+		"cidr4_allow":      &f.allow4,
+		"cidr6_deny":       &f.deny6,
+		"cidr6_allow":      &f.allow6,
+		"blocklist4":       &f.block4,
+		"blocklist6":       &f.block6,
+	}
+}
+
+// Close releases maps opened with OpenFilters.
+func (f *Filters) Close() {
+	if !f.owned {
+		return
+	}
+	for _, m := range f.maps() {
+		if *m != nil {
+			(*m).Close()
+		}
+	}
+}
+
+// Add inserts prefix into the allow, deny or block list.
+func (f *Filters) Add(list string, p netip.Prefix) error {
+	m, key, err := f.lookup(list, p)
+	if err != nil {
+		return err
+	}
+	var one uint8 = 1
+	if err := m.Put(key, one); err != nil {
+		return fmt.Errorf("add %s %s: %w", list, p, err)
+	}
+	return f.syncAllowFlags()
+}
+
+// Remove deletes prefix from the allow, deny or block list.
+func (f *Filters) Remove(list string, p netip.Prefix) error {
+	m, key, err := f.lookup(list, p)
+	if err != nil {
+		return err
+	}
+	if err := m.Delete(key); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("%s %s: %w", list, p, ErrNotInList)
+		}
+		return fmt.Errorf("remove %s %s: %w", list, p, err)
+	}
+	return f.syncAllowFlags()
+}
+
+// List returns every configured prefix, deny entries first and blocked
+// ones last.
+func (f *Filters) List() ([]FilterEntry, error) {
+	var out []FilterEntry
+	for _, l := range []struct {
+		list string
+		m    *ebpf.Map
+		v6   bool
+	}{
+		{FilterDeny, f.deny4, false},
+		{FilterDeny, f.deny6, true},
+		{FilterAllow, f.allow4, false},
+		{FilterAllow, f.allow6, true},
+		{FilterBlock, f.block4, false},
+		{FilterBlock, f.block6, true},
+	} {
+		prefixes, err := listPrefixes(l.m, l.v6)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", l.list, err)
+		}
+		for _, p := range prefixes {
+			out = append(out, FilterEntry{List: l.list, Prefix: p})
+		}
+	}
+	return out, nil
+}
+
+// BlockDrops returns the number of packets xdp_ingress dropped because of
+// the blocklist since the program was loaded.
+func (h *Handles) BlockDrops() (uint64, error) {
+	if h.BlockDrop == nil {
+		return 0, nil
+	}
+	var total uint64
+	for _, k := range []uint32{BLOCKED_IP4, BLOCKED_IP6} {
+		var perCPU []uint64
+		if err := h.BlockDrop.Lookup(k, &perCPU); err != nil {
+			return 0, fmt.Errorf("read block_drops: %w", err)
+		}
+		for _, c := range perCPU {
+			total += c
+		}
+	}
+	return total, nil
+}
+
+// lookup picks the map for list and p's address family and encodes the key.
+func (f *Filters) lookup(list string, p netip.Prefix) (*ebpf.Map, interface{}, error) {
+	p = p.Masked()
+	v4 := p.Addr().Is4()
+
+	var m *ebpf.Map
+	switch list {
+	case FilterDeny:
+		m = f.deny6
+		if v4 {
+			m = f.deny4
+		}
+	case FilterAllow:
+		m = f.allow6
+		if v4 {
+			m = f.allow4
+		}
+	case FilterBlock:
+		m = f.block6
+		if v4 {
+			m = f.block4
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown filter list %q (want %s, %s or %s)", list, FilterDeny, FilterAllow, FilterBlock)
+	}
+
+	if v4 {
+		return m, lpmKey4{Prefixlen: uint32(p.Bits()), Addr: p.Addr().As4()}, nil
+	}
+	return m, lpmKey6{Prefixlen: uint32(p.Bits()), Addr: p.Addr().As16()}, nil
+}
+
+// syncAllowFlags enables allow-list enforcement per family only while the
+// corresponding allow list has entries.
+func (f *Filters) syncAllowFlags() error {
+	for _, a := range []struct {
+		key uint32
+		m   *ebpf.Map
+		v6  bool
+	}{
+		{CFG_ALLOW4, f.allow4, false},
+		{CFG_ALLOW6, f.allow6, true},
+	} {
+		prefixes, err := listPrefixes(a.m, a.v6)
+		if err != nil {
+			return err
+		}
+		var v uint32
+		if len(prefixes) > 0 {
+			v = 1
+		}
+		if err := f.config.Put(a.key, v); err != nil {
+			return fmt.Errorf("update collector_config: %w", err)
+		}
+	}
+	return nil
+}
+
+func listPrefixes(m *ebpf.Map, v6 bool) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	var val uint8
+
+	if v6 {
+		var k lpmKey6
+		it := m.Iterate()
+		for it.Next(&k, &val) {
+			out = append(out, netip.PrefixFrom(netip.AddrFrom16(k.Addr), int(k.Prefixlen)))
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		var k lpmKey4
+		it := m.Iterate()
+		for it.Next(&k, &val) {
+			out = append(out, netip.PrefixFrom(netip.AddrFrom4(k.Addr), int(k.Prefixlen)))
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out, nil
+}
+
+// ParsePrefixList parses a comma separated list of CIDRs. A bare address is
+// treated as a single host prefix.
+func ParsePrefixList(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		p, err := ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// ParsePrefix parses a CIDR or a bare address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid prefix %q: %w", s, err)
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// loadFilters adds the prefixes from CIDR_DENY and CIDR_ALLOW. Entries
+// already pinned from an earlier run are kept.
+func loadFilters(h *Handles) error {
+	f, err := h.Filters()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range []struct{ list, env string }{
+		{FilterDeny, "CIDR_DENY"},
+		{FilterAllow, "CIDR_ALLOW"},
+	} {
+		prefixes, err := ParsePrefixList(os.Getenv(l.env))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", l.env, err)
+		}
+		for _, p := range prefixes {
+			if err := f.Add(l.list, p); err != nil {
+				return err
+			}
+			fmt.Printf("Loaded %s prefix %s into filter map\n", l.list, p)
+		}
+	}
+
+	// allow flags may be stale if the pinned config map was reused
+	return f.syncAllowFlags()
+}
@@ -2,6 +2,7 @@ package bpfgo
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
@@ -19,29 +20,62 @@ const (
 	PORT_CONSENSUS = 1
 	PORT_SIAMUX    = 2
 	PORT_QUIC      = 3
+
+	// collector_config indexes (see prog.c)
+	CFG_COUNT_OTHER = 0
 )
 
 type Handles struct {
+	Iface     string // interface the programs are attached to
 	Coll      *ebpf.Collection
 	IP4Stats  *ebpf.Map
 	IP6Stats  *ebpf.Map
 	TCLastIP4 *ebpf.Map
+	Overflow  *ebpf.Map // nil when the BPF object predates map_overflow
+	BlockDrop *ebpf.Map // nil when the BPF object predates block_drops
 	XDPLink   link.Link
 	TCLink    link.Link
 }
 
+// Load loads the BPF object and attaches it to iface.
 func Load(iface string) (*Handles, error) {
+	return load(iface, false)
+}
+
+// LoadPinned is Load with ip4_stats and ip6_stats pinned as well, so the
+// counters survive a restart of `collector agent`.
+func LoadPinned(iface string) (*Handles, error) {
+	return load(iface, true)
+}
+
+func load(iface string, pinStats bool) (*Handles, error) {
 	spec, err := ebpf.LoadCollectionSpec(bpfObjPath)
 	if err != nil {
 		return nil, fmt.Errorf("load BPF spec: %w", err)
 	}
 
-	coll, err := ebpf.NewCollection(spec)
+	// Apply MAP_MAX_ENTRIES / MAP_TYPE before the maps are created
+	if err := configureStatsMaps(spec); err != nil {
+		return nil, err
+	}
+
+	// Filter maps are pinned so `collector filter` can edit them at runtime
+	opts, err := pinFilterMaps(spec)
+	if err != nil {
+		return nil, err
+	}
+	if pinStats {
+		for _, name := range []string{"ip4_stats", "ip6_stats"} {
+			spec.Maps[name].Pinning = ebpf.PinByName
+		}
+	}
+
+	coll, err := ebpf.NewCollectionWithOptions(spec, *opts)
 	if err != nil {
 		return nil, fmt.Errorf("new collection: %w", err)
 	}
 
-	h := &Handles{Coll: coll}
+	h := &Handles{Iface: iface, Coll: coll}
 
 	// Resolve maps
 	ip4Stats, ok := coll.Maps["ip4_stats"]
@@ -62,11 +96,31 @@ func Load(iface string) (*Handles, error) {
 	}
 	h.TCLastIP4 = tcLast
 
+	if overflow, ok := coll.Maps["map_overflow"]; ok {
+		h.Overflow = overflow
+	} else {
+		log.Println("bpf: map_overflow not found in BPF object, overflow counting disabled")
+	}
+
+	if drops, ok := coll.Maps["block_drops"]; ok {
+		h.BlockDrop = drops
+	}
+
 	// Load ports from env into port_config
 	if err := loadPorts(coll); err != nil {
 		return nil, fmt.Errorf("loadPorts: %w", err)
 	}
 
+	// Load feature switches from env into collector_config
+	if err := loadConfig(coll); err != nil {
+		return nil, fmt.Errorf("loadConfig: %w", err)
+	}
+
+	// Load CIDR_DENY / CIDR_ALLOW into the filter maps
+	if err := loadFilters(h); err != nil {
+		return nil, fmt.Errorf("loadFilters: %w", err)
+	}
+
 	// Attach XDP + TC
 	if err := attachPrograms(h, iface); err != nil {
 		h.Close()
@@ -116,6 +170,28 @@ func loadPorts(coll *ebpf.Collection) error {
 	return nil
 }
 
+// loadConfig writes the COUNT_OTHER switch into collector_config. When set,
+// traffic that matches none of the configured ports is metered per peer in
+// the other_up/other_down counters instead of being ignored.
+func loadConfig(coll *ebpf.Collection) error {
+	cfgMap, ok := coll.Maps["collector_config"]
+	if !ok {
+		return fmt.Errorf("collector_config map not found in BPF object")
+	}
+
+	var countOther uint32
+	if os.Getenv("COUNT_OTHER") == "1" {
+		countOther = 1
+		fmt.Println("Counting non-Sia traffic in the other class")
+	}
+
+	k := uint32(CFG_COUNT_OTHER)
+	if err := cfgMap.Put(unsafe.Pointer(&k), unsafe.Pointer(&countOther)); err != nil {
+		return fmt.Errorf("failed to write COUNT_OTHER to collector_config: %v", err)
+	}
+	return nil
+}
+
 func attachPrograms(h *Handles, iface string) error {
 	ifaceObj, err := net.InterfaceByName(iface)
 	if err != nil {
@@ -5,40 +5,76 @@ import (
 	"encoding/binary"
 	"fmt"
 
+	"github.com/back2basic/collector/model"
 	"github.com/cilium/ebpf"
 )
 
 // New semantic stats struct (matches BPF struct)
 type SiaIPStats struct {
-	ConsensusUp   uint64
-	ConsensusDown uint64
-	SiamuxUp      uint64
-	SiamuxDown    uint64
-	QuicUp        uint64
-	QuicDown      uint64
+	ConsensusUp   uint64 `json:"consensus_up"`
+	ConsensusDown uint64 `json:"consensus_down"`
+	SiamuxUp      uint64 `json:"siamux_up"`
+	SiamuxDown    uint64 `json:"siamux_down"`
+	QuicUp        uint64 `json:"quic_up"`
+	QuicDown      uint64 `json:"quic_down"`
+	OtherUp       uint64 `json:"other_up"` // only counted when COUNT_OTHER=1
+	OtherDown     uint64 `json:"other_down"`
 }
 
-// New pinned map paths (matches your Makefile install paths)
-// const (
-// 	PinIP4Stats  = "/sys/fs/bpf/collector/ip4_stats"
-// 	PinIP6Stats  = "/sys/fs/bpf/collector/ip6_stats"
-// 	PinPortCfg   = "/sys/fs/bpf/collector/port_config"
-// 	PinTCLastIP4 = "/sys/fs/bpf/collector/tc_last_ip4"
-// )
+// IsZero reports whether no bytes were counted in any class.
+func (s SiaIPStats) IsZero() bool {
+	return s.ConsensusUp == 0 && s.ConsensusDown == 0 &&
+		s.SiamuxUp == 0 && s.SiamuxDown == 0 &&
+		s.QuicUp == 0 && s.QuicDown == 0 &&
+		s.OtherUp == 0 && s.OtherDown == 0
+}
+
+// Add accumulates the counters of o into s.
+func (s *SiaIPStats) Add(o SiaIPStats) {
+	s.ConsensusUp += o.ConsensusUp
+	s.ConsensusDown += o.ConsensusDown
+	s.SiamuxUp += o.SiamuxUp
+	s.SiamuxDown += o.SiamuxDown
+	s.QuicUp += o.QuicUp
+	s.QuicDown += o.QuicDown
+	s.OtherUp += o.OtherUp
+	s.OtherDown += o.OtherDown
+}
 
-// func openPinned(path string) (*ebpf.Map, error) {
-// 	return ebpf.LoadPinnedMap(path, nil)
-// }
+// Snapshot returns the non-zero counters of ip4_stats and ip6_stats.
+func (h *Handles) Snapshot() (map[model.Peer]SiaIPStats, error) {
+	out := make(map[model.Peer]SiaIPStats)
+	for _, m := range []struct {
+		name string
+		m    *ebpf.Map
+	}{
+		{"ip4_stats", h.IP4Stats},
+		{"ip6_stats", h.IP6Stats},
+	} {
+		var k model.Peer
+		var st SiaIPStats
+		it := m.m.Iterate()
+		for it.Next(&k, &st) {
+			if !st.IsZero() {
+				out[k] = st
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, fmt.Errorf("iterate %s: %w", m.name, err)
+		}
+	}
+	return out, nil
+}
 
-// func IntToIP4(nn uint32) net.IP {
-// 	b := make([]byte, 4)
-// 	binary.BigEndian.PutUint32(b, nn)
-// 	return net.IPv4(b[0], b[1], b[2], b[3])
-// }
+// Reset zeroes the counters of every peer, keeping the keys.
+func (h *Handles) Reset() error {
+	return ResetCountersUsingHandles(h.IP4Stats, h.IP6Stats)
+}
 
-// func IPv6FromKey(key [16]byte) net.IP {
-// 	return net.IP(key[:])
-// }
+// Cleanup deletes peers whose counters are all zero.
+func (h *Handles) Cleanup() error {
+	return CleanupZeroEntriesUsingHandles(h.IP4Stats, h.IP6Stats)
+}
 
 // ResetCountersUsingHandles sets every map value to zero while preserving keys.
 func ResetCountersUsingHandles(ip4Map, ip6Map *ebpf.Map) error {
@@ -153,11 +189,7 @@ func deleteZeroValueKeys(m *ebpf.Map) error {
 				// if unmarshal fails, treat as non-zero to avoid accidental deletion
 				isZero = false
 			} else {
-				if s.ConsensusUp != 0 || s.ConsensusDown != 0 ||
-					s.SiamuxUp != 0 || s.SiamuxDown != 0 ||
-					s.QuicUp != 0 || s.QuicDown != 0 {
-					isZero = false
-				}
+				isZero = s.IsZero()
 			}
 		} else {
 			// fallback: raw bytes all zero?
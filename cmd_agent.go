@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/back2basic/collector/agent"
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/privs"
+)
+
+// runAgent is the privileged half of a split deployment: it attaches the
+// BPF programs with pinned counters and serves snapshots on a Unix socket.
+// Storage, DNS, sinks and the dashboard run in `collector report`.
+func runAgent(args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	socket := fs.String("socket", agent.SocketPath(), "Unix socket to serve snapshots on (AGENT_SOCKET)")
+	group := fs.String("group", os.Getenv("AGENT_SOCKET_GROUP"), "group allowed to connect, default owner only (AGENT_SOCKET_GROUP)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	iface := os.Getenv("INTERFACE")
+	if iface == "" {
+		fmt.Fprintln(os.Stderr, "agent: missing INTERFACE in env file.")
+		return 2
+	}
+
+	gid := -1
+	if *group != "" {
+		var err error
+		if gid, err = privs.LookupGroup(*group); err != nil {
+			fmt.Fprintf(os.Stderr, "agent: %v\n", err)
+			return 2
+		}
+	}
+
+	// Pinned counters survive agent restarts until the reporter reads them
+	h, err := bpfgo.LoadPinned(iface)
+	if err != nil {
+		log.Printf("agent: load BPF: %v", err)
+		return 1
+	}
+	defer h.Close()
+
+	ln, err := agent.Listen(*socket, gid)
+	if err != nil {
+		log.Printf("agent: listen on %s: %v", *socket, err)
+		return 1
+	}
+
+	dropPrivileges(h)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		t := time.NewTicker(5 * time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				h.LogCapacity()
+			}
+		}
+	}()
+
+	log.Printf("agent: serving %s counters on %s (protocol v%d)", iface, *socket, agent.ProtocolVersion)
+	srv := &agent.Server{Src: h, Iface: iface}
+	if err := srv.Serve(ctx, ln); err != nil {
+		log.Printf("agent: %v", err)
+		return 1
+	}
+	log.Println("agent: shutdown, counters stay in the pinned maps")
+	return 0
+}
+
+// runReport is the unprivileged half: the daemon's aggregator, dashboard,
+// sinks and pushes, reading the counters from `collector agent`.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	socket := fs.String("socket", agent.SocketPath(), "agent socket (AGENT_SOCKET)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c, hello, err := agent.Dial(*socket)
+	if err != nil {
+		log.Printf("report: %v", err)
+		return 1
+	}
+	defer c.Close()
+	log.Printf("report: reading %s counters from agent at %s", hello.Iface, *socket)
+
+	startDNS()
+	privs.LogCaps()
+	if err := runWorkers(c, hello.Iface); err != nil {
+		log.Printf("report: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/back2basic/collector/bpfgo"
+)
+
+const filterUsage = `usage:
+  collector filter list
+  collector filter add <allow|deny|block> <cidr>
+  collector filter del <allow|deny|block> <cidr>`
+
+// runFilter edits the CIDR allow/deny and block maps pinned by the running
+// daemon.
+func runFilter(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, filterUsage)
+		return 2
+	}
+
+	f, err := bpfgo.OpenFilters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "filter: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	switch args[0] {
+	case "list":
+		entries, err := f.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "filter: %v\n", err)
+			return 1
+		}
+		for _, e := range entries {
+			fmt.Printf("%-5s %s\n", e.List, e.Prefix)
+		}
+		return 0
+
+	case "add", "del":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, filterUsage)
+			return 2
+		}
+		p, err := bpfgo.ParsePrefix(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "filter: %v\n", err)
+			return 2
+		}
+		if args[0] == "add" {
+			err = f.Add(args[1], p)
+		} else {
+			err = f.Remove(args[1], p)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "filter: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, filterUsage)
+	return 2
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/model"
+)
+
+const hostdUsage = `usage:
+  collector hostd peers                      map peers with HOSTD_API_URL once
+  collector hostd stub [-listen addr] <file> serve a stub hostd API from a JSON file`
+
+// runHostd checks the hostd integration, against a real hostd or a stub.
+func runHostd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, hostdUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "peers":
+		c := hostd.ClientFromEnv()
+		if c == nil {
+			fmt.Fprintln(os.Stderr, "hostd: HOSTD_API_URL is not set")
+			return 2
+		}
+		m := hostd.NewMapper(c, 0)
+		if err := m.Refresh(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "hostd: %v\n", err)
+			return 1
+		}
+		peers := m.Peers()
+		keys := make([]model.Peer, 0, len(peers))
+		for p := range peers {
+			keys = append(keys, p)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+		for _, p := range keys {
+			fmt.Printf("%-39s %-70s %s\n", p, peers[p].RenterKey, peers[p].ContractID)
+		}
+		return 0
+
+	case "stub":
+		fs := flag.NewFlagSet("hostd stub", flag.ContinueOnError)
+		listen := fs.String("listen", "127.0.0.1:9980", "address to serve the stub API on")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, hostdUsage)
+			return 2
+		}
+		s, err := hostd.LoadStub(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hostd: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "hostd: stub with %d contracts and %d sessions on http://%s/api\n",
+			len(s.Contracts), len(s.Sessions), *listen)
+		if err := http.ListenAndServe(*listen, s.Handler()); err != nil {
+			fmt.Fprintf(os.Stderr, "hostd: %v\n", err)
+			return 1
+		}
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, hostdUsage)
+		return 2
+	}
+}
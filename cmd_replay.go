@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/agg"
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/replay"
+	"github.com/back2basic/collector/storage"
+)
+
+// runReplay accounts a capture file with the rules of prog.c and, unless
+// -dry is given, stores and pushes the result like the daemon would.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Minute, "simulated flush interval")
+	local := fs.String("local", "", "comma separated host addresses, decides direction (required for COUNT_OTHER)")
+	dry := fs.Bool("dry", false, "only print the totals, do not store or push")
+	resolve := fs.Bool("dns", false, "resolve reverse DNS names for stored rows")
+	iface := fs.String("iface", "replay", "interface name stored with each row")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: collector replay [flags] file.pcap")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := replay.ClassifierFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+	for _, s := range strings.Split(*local, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: invalid -local address %q\n", s)
+			return 2
+		}
+		c.Local[a.Unmap()] = true
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	r, err := replay.NewReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+
+	mem := counters.NewMemory()
+
+	var flush replay.FlushFunc
+	if !*dry {
+		ag, err := agg.New(mem, storage.DB, *iface)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		ag.SetDNS(*resolve)
+		defer ag.Close()
+		flush = ag.FlushAt
+	}
+
+	sum, err := replay.Run(r, c, mem, *interval, flush)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	printReplaySummary(sum)
+	return 0
+}
+
+func printReplaySummary(sum replay.Summary) {
+	fmt.Printf("packets: %d read, %d accounted, %d ignored\n",
+		sum.Packets, sum.Accounted, sum.Packets-sum.Accounted)
+	if sum.Packets > 0 {
+		fmt.Printf("capture: %s .. %s, %d flushes\n",
+			sum.First.Format(time.RFC3339), sum.Last.Format(time.RFC3339), sum.Flushes)
+	}
+
+	peers := make([]model.Peer, 0, len(sum.Totals))
+	for p := range sum.Totals {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Less(peers[j]) })
+
+	var total bpfgo.SiaIPStats
+	fmt.Printf("\n%-40s %14s %14s %14s %14s %14s %14s %14s %14s\n", "PEER",
+		"CONS_UP", "CONS_DOWN", "SIAMUX_UP", "SIAMUX_DOWN", "QUIC_UP", "QUIC_DOWN", "OTHER_UP", "OTHER_DOWN")
+	row := func(name string, s bpfgo.SiaIPStats) {
+		fmt.Printf("%-40s %14d %14d %14d %14d %14d %14d %14d %14d\n", name,
+			s.ConsensusUp, s.ConsensusDown, s.SiamuxUp, s.SiamuxDown,
+			s.QuicUp, s.QuicDown, s.OtherUp, s.OtherDown)
+	}
+	for _, p := range peers {
+		s := sum.Totals[p]
+		row(p.String(), s)
+		total.Add(s)
+	}
+	row("TOTAL", total)
+}
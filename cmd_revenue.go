@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/back2basic/collector/agg"
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/quota"
+	"github.com/back2basic/collector/revenue"
+	"github.com/back2basic/collector/storage"
+)
+
+// runRevenue compares the data traffic stored for this host with the
+// revenue hostd's bandwidth prices and contracts account for.
+func runRevenue(args []string) int {
+	fs := flag.NewFlagSet("revenue", flag.ContinueOnError)
+	days := fs.Int("days", 7, "number of UTC days to report, including today")
+	factor := fs.Float64("factor", 2, "flag peers whose expected revenue exceeds this multiple of what their contracts paid")
+	minSize := fs.String("min-bytes", "1GB", "never flag peers with less data traffic in the period")
+	ingress := fs.String("ingress-price", "", "ingress price in SC/TB, default from hostd settings")
+	egress := fs.String("egress-price", "", "egress price in SC/TB, default from hostd settings")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *days < 1 {
+		fmt.Fprintln(os.Stderr, "revenue: -days must be at least 1")
+		return 2
+	}
+	minBytes, err := quota.ParseSize(*minSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revenue: -min-bytes: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var (
+		prices    hostd.Settings
+		contracts []hostd.Contract
+	)
+	c := hostd.ClientFromEnv()
+	if c != nil {
+		if prices, err = c.Settings(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "revenue: hostd %v\n", err)
+			return 1
+		}
+		if contracts, err = c.ActiveContracts(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "revenue: hostd %v\n", err)
+			return 1
+		}
+	} else if *ingress == "" || *egress == "" {
+		fmt.Fprintln(os.Stderr, "revenue: set HOSTD_API_URL, or -ingress-price and -egress-price")
+		return 2
+	}
+	for _, p := range []struct {
+		flag string
+		dst  *hostd.Currency
+	}{{*ingress, &prices.IngressPrice}, {*egress, &prices.EgressPrice}} {
+		if p.flag == "" {
+			continue
+		}
+		if *p.dst, err = hostd.ParsePerTB(p.flag); err != nil {
+			fmt.Fprintf(os.Stderr, "revenue: %v\n", err)
+			return 2
+		}
+	}
+
+	now := time.Now().UTC()
+	since := now.Truncate(24*time.Hour).AddDate(0, 0, 1-*days)
+	rows, err := storage.QueryPeerDays(agg.Hostname(), since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revenue: %v\n", err)
+		return 1
+	}
+
+	// snapshots taken here and by the daemon's hostd mapper limit paid
+	// revenue to the period
+	if err := (storage.ContractUsage{}).SaveUsage(now.Format("2006-01-02"), contracts); err != nil {
+		fmt.Fprintf(os.Stderr, "revenue: save contract usage: %v\n", err)
+	}
+	baselines, err := storage.UsageBaselines(since.Format("2006-01-02"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revenue: %v\n", err)
+		return 1
+	}
+
+	rep := revenue.Build(rows, contracts, baselines, prices, revenue.Options{Factor: *factor, MinBytes: minBytes})
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			fmt.Fprintf(os.Stderr, "revenue: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	printRevenue(rep, since)
+	return 0
+}
+
+func printRevenue(rep revenue.Report, since time.Time) {
+	fmt.Printf("prices: ingress %s SC/TB, egress %s SC/TB\n",
+		rep.Prices.IngressPrice.PerTB(), rep.Prices.EgressPrice.PerTB())
+	fmt.Printf("since %s: expected %s SC for measured traffic, active contracts earned %s SC for bandwidth in the period\n",
+		since.Format("2006-01-02"), rep.Expected.SC(), rep.Paid.SC())
+
+	fmt.Printf("\n%-10s %-40s %14s %14s %16s\n", "DAY", "PEER", "INGRESS", "EGRESS", "EXPECTED_SC")
+	for _, d := range rep.Days {
+		fmt.Printf("%-10s %-40s %14d %14d %16s\n", d.Day, d.Peer, d.Ingress, d.Egress, d.Expected.SC())
+	}
+
+	fmt.Printf("\n%-40s %-20s %-20s %16s %16s %-10s  %s\n", "PEER", "RENTER", "CONTRACT", "EXPECTED_SC", "PAID_SC", "PAID_SINCE", "FLAG")
+	for _, p := range rep.Peers {
+		fmt.Printf("%-40s %-20s %-20s %16s %16s %-10s  %s\n", p.Peer, short(p.RenterKey), short(p.ContractID),
+			p.Expected.SC(), p.Paid.SC(), p.PaidSince, p.Flag)
+	}
+	if n := len(rep.Flagged()); n > 0 {
+		fmt.Printf("\n%d peers flagged\n", n)
+	}
+}
+
+// short abbreviates renter keys and contract IDs for the table.
+func short(s string) string {
+	if len(s) <= 20 {
+		return s
+	}
+	return s[:19] + "…"
+}
@@ -0,0 +1,157 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/httpauth"
+)
+
+// Filters edits the BPF filter lists; *bpfgo.Filters implements it.
+type Filters interface {
+	Add(list string, p netip.Prefix) error
+	Remove(list string, p netip.Prefix) error
+}
+
+// Flusher writes the current counters; *agg.Aggregator implements it.
+type Flusher interface {
+	FlushOnce()
+}
+
+// API is the admin interface of a running collector: filter list edits and
+// forced flushes. Every route needs ScopeAdmin.
+type API struct {
+	Listen  string
+	Auth    *httpauth.Config
+	Flusher Flusher
+	Filters Filters // nil without BPF maps (collector report)
+}
+
+// FromEnv returns the API configured by CONTROL_LISTEN and the CONTROL_*
+// variables of httpauth.FromEnv, or nil when CONTROL_LISTEN is unset. The
+// filter routes are served when src holds the BPF maps.
+func FromEnv(src counters.Source, fl Flusher) *API {
+	listen := os.Getenv("CONTROL_LISTEN")
+	if listen == "" {
+		return nil
+	}
+	a := &API{
+		Listen:  listen,
+		Auth:    httpauth.FromEnv("control", "CONTROL"),
+		Flusher: fl,
+	}
+	if h, ok := src.(*bpfgo.Handles); ok {
+		f, err := h.Filters()
+		if err != nil {
+			log.Printf("control: filters unavailable: %v", err)
+		} else {
+			a.Filters = f
+		}
+	}
+	return a
+}
+
+// Handler returns the HTTP routes.
+func (a *API) Handler() http.Handler {
+	admin := func(f http.HandlerFunc) http.Handler { return a.Auth.Require(httpauth.ScopeAdmin, f) }
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/filters", admin(a.handleFilterAdd))
+	mux.Handle("DELETE /v1/filters", admin(a.handleFilterRemove))
+	mux.Handle("POST /v1/flush", admin(a.handleFlush))
+	return mux
+}
+
+// Run serves the API until ctx is done. A nil API does nothing.
+func (a *API) Run(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	if !a.Auth.Enabled() {
+		log.Printf("control: every route needs admin scope; set CONTROL_ADMIN_TOKENS or CONTROL_ADMIN_CLIENTS")
+	}
+	log.Printf("control: listening on %s (tls=%v)", a.Listen, a.Auth.TLS())
+	if err := a.Auth.ListenAndServe(ctx, a.Listen, a.Handler()); err != nil {
+		log.Printf("control: %v", err)
+	}
+}
+
+func (a *API) handleFlush(w http.ResponseWriter, r *http.Request) {
+	a.Flusher.FlushOnce()
+	writeJSON(w, map[string]bool{"flushed": true})
+}
+
+// filterEntry is the JSON form of a filter list entry.
+type filterEntry struct {
+	List   string `json:"list"`
+	Prefix string `json:"prefix"`
+}
+
+// handleFilterAdd takes {"list": "allow|deny|block", "prefix": "CIDR or address"}.
+func (a *API) handleFilterAdd(w http.ResponseWriter, r *http.Request) {
+	if !a.haveFilters(w) {
+		return
+	}
+	var e filterEntry
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&e); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.editFilter(w, e, a.Filters.Add)
+}
+
+// handleFilterRemove takes ?list=&prefix=.
+func (a *API) handleFilterRemove(w http.ResponseWriter, r *http.Request) {
+	if !a.haveFilters(w) {
+		return
+	}
+	q := r.URL.Query()
+	a.editFilter(w, filterEntry{List: q.Get("list"), Prefix: q.Get("prefix")}, a.Filters.Remove)
+}
+
+func (a *API) editFilter(w http.ResponseWriter, e filterEntry, edit func(string, netip.Prefix) error) {
+	switch e.List {
+	case bpfgo.FilterAllow, bpfgo.FilterDeny, bpfgo.FilterBlock:
+	default:
+		http.Error(w, fmt.Sprintf("unknown list %q", e.List), http.StatusBadRequest)
+		return
+	}
+	p, err := bpfgo.ParsePrefix(e.Prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := edit(e.List, p); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, bpfgo.ErrNotInList) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Printf("control: %s %s updated", e.List, p)
+	writeJSON(w, filterEntry{List: e.List, Prefix: p.String()})
+}
+
+func (a *API) haveFilters(w http.ResponseWriter) bool {
+	if a.Filters == nil {
+		http.Error(w, "filters need the BPF maps (not available in collector report)", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("control: write response: %v", err)
+	}
+}
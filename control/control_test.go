@@ -0,0 +1,129 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/httpauth"
+)
+
+// fakeFilters keeps the filter lists in memory.
+type fakeFilters map[string]bool // "list prefix"
+
+func (f fakeFilters) Add(list string, p netip.Prefix) error {
+	f[list+" "+p.String()] = true
+	return nil
+}
+
+func (f fakeFilters) Remove(list string, p netip.Prefix) error {
+	if !f[list+" "+p.String()] {
+		return fmt.Errorf("%s %s: %w", list, p, bpfgo.ErrNotInList)
+	}
+	delete(f, list+" "+p.String())
+	return nil
+}
+
+type fakeFlusher int
+
+func (f *fakeFlusher) FlushOnce() { *f++ }
+
+func newTestAPI(t *testing.T, filters Filters) (*httptest.Server, *fakeFlusher) {
+	t.Helper()
+	auth := &httpauth.Config{Name: "control"}
+	auth.AddTokens(httpauth.ScopeRead, "grafana:r-token")
+	auth.AddTokens(httpauth.ScopeAdmin, "ops:a-token")
+	fl := new(fakeFlusher)
+	srv := httptest.NewServer((&API{Auth: auth, Flusher: fl, Filters: filters}).Handler())
+	t.Cleanup(srv.Close)
+	return srv, fl
+}
+
+func do(t *testing.T, method, url, token, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoutesNeedAdmin(t *testing.T) {
+	filters := fakeFilters{}
+	srv, fl := newTestAPI(t, filters)
+	add := `{"list":"block","prefix":"203.0.113.0/24"}`
+
+	for _, tc := range []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/v1/flush", ""},
+		{http.MethodPost, "/v1/filters", add},
+		{http.MethodDelete, "/v1/filters?list=block&prefix=203.0.113.0/24", ""},
+	} {
+		if got := do(t, tc.method, srv.URL+tc.path, "", tc.body); got != http.StatusUnauthorized {
+			t.Errorf("anonymous %s %s: status %d, want 401", tc.method, tc.path, got)
+		}
+		if got := do(t, tc.method, srv.URL+tc.path, "r-token", tc.body); got != http.StatusForbidden {
+			t.Errorf("read token %s %s: status %d, want 403", tc.method, tc.path, got)
+		}
+	}
+	if *fl != 0 || len(filters) != 0 {
+		t.Fatalf("rejected requests acted: %d flushes, filters %v", *fl, filters)
+	}
+
+	if got := do(t, http.MethodPost, srv.URL+"/v1/flush", "a-token", ""); got != http.StatusOK || *fl != 1 {
+		t.Fatalf("admin flush: status %d, %d flushes", got, *fl)
+	}
+	if got := do(t, http.MethodPost, srv.URL+"/v1/filters", "a-token", add); got != http.StatusOK || !filters["block 203.0.113.0/24"] {
+		t.Fatalf("admin add: status %d, filters %v", got, filters)
+	}
+	if got := do(t, http.MethodDelete, srv.URL+"/v1/filters?list=block&prefix=203.0.113.0/24", "a-token", ""); got != http.StatusOK || len(filters) != 0 {
+		t.Fatalf("admin remove: status %d, filters %v", got, filters)
+	}
+}
+
+func TestOpenConfigRefusesAdmin(t *testing.T) {
+	fl := new(fakeFlusher)
+	srv := httptest.NewServer((&API{Auth: &httpauth.Config{Name: "control"}, Flusher: fl}).Handler())
+	defer srv.Close()
+
+	if got := do(t, http.MethodPost, srv.URL+"/v1/flush", "", ""); got != http.StatusForbidden || *fl != 0 {
+		t.Fatalf("flush without credentials: status %d, %d flushes; want 403", got, *fl)
+	}
+}
+
+func TestFilterRequests(t *testing.T) {
+	srv, _ := newTestAPI(t, fakeFilters{})
+	for _, tc := range []struct {
+		name, method, path, body string
+		want                     int
+	}{
+		{"unknown list", http.MethodPost, "/v1/filters", `{"list":"drop","prefix":"203.0.113.1"}`, http.StatusBadRequest},
+		{"bad prefix", http.MethodPost, "/v1/filters", `{"list":"deny","prefix":"nope"}`, http.StatusBadRequest},
+		{"bad json", http.MethodPost, "/v1/filters", `{`, http.StatusBadRequest},
+		{"address", http.MethodPost, "/v1/filters", `{"list":"deny","prefix":"2001:db8::1"}`, http.StatusOK},
+		{"missing entry", http.MethodDelete, "/v1/filters?list=allow&prefix=192.0.2.0/24", "", http.StatusNotFound},
+	} {
+		if got := do(t, tc.method, srv.URL+tc.path, "a-token", tc.body); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// collector report has no BPF maps
+	noMaps, _ := newTestAPI(t, nil)
+	if got := do(t, http.MethodPost, noMaps.URL+"/v1/filters", "a-token", `{"list":"block","prefix":"203.0.113.1"}`); got != http.StatusNotImplemented {
+		t.Errorf("without filters: status %d, want 501", got)
+	}
+}
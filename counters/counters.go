@@ -0,0 +1,87 @@
+package counters
+
+import (
+	"sync"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/model"
+)
+
+// Source is where the live per-peer counters come from: the BPF maps of a
+// running collector, or Memory for replays and tests.
+type Source interface {
+	// Snapshot returns the counters of every peer with non-zero traffic.
+	Snapshot() (map[model.Peer]bpfgo.SiaIPStats, error)
+	// Reset zeroes all counters but keeps the peers.
+	Reset() error
+	// Cleanup forgets peers whose counters are all zero.
+	Cleanup() error
+}
+
+var (
+	_ Source = (*bpfgo.Handles)(nil)
+	_ Source = (*Memory)(nil)
+)
+
+// Memory is an in-memory Source.
+type Memory struct {
+	mu    sync.Mutex
+	peers map[model.Peer]bpfgo.SiaIPStats
+}
+
+// NewMemory returns an empty Memory source.
+func NewMemory() *Memory {
+	return &Memory{peers: make(map[model.Peer]bpfgo.SiaIPStats)}
+}
+
+// Add adds st to the counters of p.
+func (m *Memory) Add(p model.Peer, st bpfgo.SiaIPStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cur := m.peers[p]
+	cur.Add(st)
+	m.peers[p] = cur
+}
+
+func (m *Memory) Snapshot() (map[model.Peer]bpfgo.SiaIPStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[model.Peer]bpfgo.SiaIPStats, len(m.peers))
+	for p, st := range m.peers {
+		if !st.IsZero() {
+			out[p] = st
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := range m.peers {
+		m.peers[p] = bpfgo.SiaIPStats{}
+	}
+	return nil
+}
+
+func (m *Memory) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p, st := range m.peers {
+		if st.IsZero() {
+			delete(m.peers, p)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of peers, including zeroed ones.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.peers)
+}
@@ -1,45 +1,320 @@
 package dns
 
-
 import (
-    "net"
-    "sync"
-    "time"
+	"container/list"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 )
 
-type entry struct {
-    name string
-    exp  time.Time
-}
+const (
+	defaultCacheSize = 10000
+	defaultTTL       = 10 * time.Minute
+	defaultNegTTL    = 2 * time.Minute
+	minTTL           = 30 * time.Second
+)
+
+// Verification is the forward-confirmation state of a PTR name.
+type Verification int
 
-var (
-    mu    sync.Mutex
-    cache = make(map[string]entry)
-    ttl   = 10 * time.Minute
+const (
+	Unverified Verification = 0  // not checked (DNS_VERIFY off, or no name)
+	Verified   Verification = 1  // PTR -> A/AAAA contains the peer address
+	Mismatch   Verification = -1 // forward lookup does not point back
 )
 
+// Verify modes selected with DNS_VERIFY.
+const (
+	VerifyOff    = ""       // trust the PTR name
+	VerifyRecord = "1"      // check and record the result
+	VerifyStrict = "strict" // check and drop names that fail
+)
+
+// Entry is one cached PTR result. An empty Name is a cached miss.
+type Entry struct {
+	IP       string
+	Name     string
+	Verified Verification
+	Expires  time.Time
+}
+
+// Stats reports cache effectiveness.
+type Stats struct {
+	Size      int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// Store persists cache entries across restarts.
+type Store interface {
+	LoadDNSCache() ([]Entry, error)
+	SaveDNSCache([]Entry) error
+}
+
+// Options configures a Cache. Zero values select the defaults.
+type Options struct {
+	Size   int           // max entries, least recently used are evicted
+	TTL    time.Duration // max lifetime of a name; shorter record TTLs win
+	NegTTL time.Duration // lifetime of a failed or empty lookup
+	Server string        // resolver host:port, "" for the system resolver
+	Verify string        // VerifyOff, VerifyRecord or VerifyStrict
+}
+
+// Cache is an LRU-bounded reverse DNS cache with separate positive and
+// negative TTLs.
+type Cache struct {
+	mu       sync.Mutex
+	opts     Options
+	ll       *list.List // front = most recently used, values are *Entry
+	items    map[string]*list.Element
+	stats    Stats
+	resolver Resolver
+}
+
+// Default is the cache used by the package level functions.
+var Default = NewCache(optionsFromEnv())
+
+// NewCache returns an empty cache.
+func NewCache(opts Options) *Cache {
+	if opts.Size <= 0 {
+		opts.Size = defaultCacheSize
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.NegTTL <= 0 {
+		opts.NegTTL = defaultNegTTL
+	}
+	return &Cache{
+		opts:     opts,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		resolver: Resolver{Server: opts.Server},
+	}
+}
+
+// Resolve returns the PTR name for ip, blocking on a lookup when it is not
+// cached. Use Lookup on hot paths.
 func Resolve(ip net.IP) string {
-    s := ip.String()
-
-    mu.Lock()
-    if e, ok := cache[s]; ok && time.Now().Before(e.exp) {
-        name := e.name
-        mu.Unlock()
-        return name
-    }
-    mu.Unlock()
-
-    names, err := net.LookupAddr(s)
-    if err != nil || len(names) == 0 {
-        mu.Lock()
-        cache[s] = entry{"", time.Now().Add(ttl)}
-        mu.Unlock()
-        return ""
-    }
-
-    name := names[0]
-    mu.Lock()
-    cache[s] = entry{name, time.Now().Add(ttl)}
-    mu.Unlock()
-    return name
+	return Default.Resolve(ip)
+}
+
+// Get returns the cached entry for ip. ok is false when there is no
+// unexpired entry.
+func (c *Cache) Get(ip net.IP) (e Entry, ok bool) {
+	s := ip.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[s]
+	if !found {
+		c.stats.Misses++
+		return Entry{}, false
+	}
+	cur := el.Value.(*Entry)
+	if time.Now().After(cur.Expires) {
+		c.removeElement(el)
+		c.stats.Misses++
+		return Entry{}, false
+	}
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return *cur, true
+}
+
+// Peek is Get without touching the LRU order or the hit/miss counters.
+func (c *Cache) Peek(ip net.IP) (e Entry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[ip.String()]
+	if !found {
+		return Entry{}, false
+	}
+	cur := el.Value.(*Entry)
+	if time.Now().After(cur.Expires) {
+		return Entry{}, false
+	}
+	return *cur, true
+}
+
+// Resolve returns the cached name for ip or looks it up.
+func (c *Cache) Resolve(ip net.IP) string {
+	return c.ResolveEntry(ip).Name
+}
+
+// ResolveEntry is Resolve returning the verification state as well.
+func (c *Cache) ResolveEntry(ip net.IP) Entry {
+	if e, ok := c.Get(ip); ok {
+		return e
+	}
+
+	s := ip.String()
+	name, ttl, err := c.resolver.LookupPTR(s)
+	if err != nil || name == "" {
+		return c.set(Entry{IP: s}, c.opts.NegTTL)
+	}
+
+	e := Entry{IP: s, Name: name}
+	if c.opts.Verify != VerifyOff {
+		e.Verified = c.confirm(name, ip)
+		if e.Verified != Verified && c.opts.Verify == VerifyStrict {
+			e.Name = ""
+			return c.set(e, c.opts.NegTTL)
+		}
+	}
+
+	// honour the record TTL when the resolver reported one
+	if ttl <= 0 || ttl > c.opts.TTL {
+		ttl = c.opts.TTL
+	}
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	return c.set(e, ttl)
+}
+
+// confirm checks that name resolves back to ip (forward-confirmed reverse
+// DNS). Anyone controlling a reverse zone can claim any name; only the
+// owner of the forward zone can make it point back.
+func (c *Cache) confirm(name string, ip net.IP) Verification {
+	addrs, err := c.resolver.LookupIP(name, ip)
+	if err != nil {
+		return Mismatch
+	}
+	for _, a := range addrs {
+		if a.Equal(ip) {
+			return Verified
+		}
+	}
+	return Mismatch
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Size = c.ll.Len()
+	return st
+}
+
+// Load fills the cache from st, skipping expired entries.
+func (c *Cache) Load(st Store) error {
+	entries, err := st.LoadDNSCache()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if now.Before(e.Expires) {
+			c.setEntry(e)
+		}
+	}
+	return nil
+}
+
+// Save writes all unexpired entries to st.
+func (c *Cache) Save(st Store) error {
+	c.mu.Lock()
+	now := time.Now()
+	entries := make([]Entry, 0, c.ll.Len())
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*Entry)
+		if now.Before(e.Expires) {
+			entries = append(entries, *e)
+		}
+	}
+	c.mu.Unlock()
+
+	return st.SaveDNSCache(entries)
+}
+
+func (c *Cache) set(e Entry, ttl time.Duration) Entry {
+	e.Expires = time.Now().Add(ttl)
+	c.setEntry(e)
+	return e
+}
+
+func (c *Cache) setEntry(e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[e.IP]; ok {
+		*el.Value.(*Entry) = e
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[e.IP] = c.ll.PushFront(&e)
+	for c.ll.Len() > c.opts.Size {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*Entry).IP)
+}
+
+var store Store
+
+// Persist loads the Default cache from st and makes Save write back to it.
+func Persist(st Store) error {
+	store = st
+	return Default.Load(st)
+}
+
+// Save writes the Default cache to the store set with Persist, if any.
+func Save() {
+	if store == nil {
+		return
+	}
+	if err := Default.Save(store); err != nil {
+		log.Printf("dns: save cache: %v", err)
+	}
+}
+
+// LogStats logs the Default cache counters.
+func LogStats() {
+	st := Default.Stats()
+	log.Printf("dns: cache size=%d hits=%d misses=%d evictions=%d",
+		st.Size, st.Hits, st.Misses, st.Evictions)
+}
+
+// optionsFromEnv reads DNS_CACHE_SIZE, DNS_TTL, DNS_NEG_TTL, DNS_RESOLVER
+// and DNS_VERIFY.
+func optionsFromEnv() Options {
+	o := Options{
+		Server: os.Getenv("DNS_RESOLVER"),
+		Verify: os.Getenv("DNS_VERIFY"),
+	}
+	switch o.Verify {
+	case VerifyOff, VerifyRecord, VerifyStrict:
+	default:
+		log.Printf("dns: unknown DNS_VERIFY %q, verification disabled", o.Verify)
+		o.Verify = VerifyOff
+	}
+	if v := os.Getenv("DNS_CACHE_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			o.Size = n
+		}
+	}
+	if v := os.Getenv("DNS_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			o.TTL = d
+		}
+	}
+	if v := os.Getenv("DNS_NEG_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			o.NegTTL = d
+		}
+	}
+	return o
 }
@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store.
+type memStore struct {
+	entries []Entry
+}
+
+func (m *memStore) LoadDNSCache() ([]Entry, error) { return m.entries, nil }
+
+func (m *memStore) SaveDNSCache(entries []Entry) error {
+	m.entries = entries
+	return nil
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(Options{Size: 2})
+	a, b, d := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+
+	c.set(Entry{IP: a.String(), Name: "a.example."}, time.Minute)
+	c.set(Entry{IP: b.String(), Name: "b.example."}, time.Minute)
+	if _, ok := c.Get(a); !ok { // a is now the most recently used
+		t.Fatal("a missing before eviction")
+	}
+	c.set(Entry{IP: d.String(), Name: "d.example."}, time.Minute)
+
+	if _, ok := c.Peek(b); ok {
+		t.Error("b survived; it was the least recently used")
+	}
+	for _, ip := range []net.IP{a, d} {
+		if _, ok := c.Peek(ip); !ok {
+			t.Errorf("%s evicted", ip)
+		}
+	}
+	st := c.Stats()
+	if st.Size != 2 || st.Evictions != 1 || st.Hits != 1 {
+		t.Fatalf("stats = %+v, want size 2, 1 eviction, 1 hit", st)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	s := newStubServer(t)
+	c := NewCache(Options{Server: s.addr(), NegTTL: 50 * time.Millisecond})
+	ip := net.ParseIP("192.0.2.99")
+
+	start := time.Now()
+	e := c.ResolveEntry(ip)
+	if e.Name != "" {
+		t.Fatalf("missing record resolved to %q", e.Name)
+	}
+	if d := e.Expires.Sub(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("negative entry lives %v, want NegTTL", d)
+	}
+	if _, ok := c.Get(ip); !ok {
+		t.Fatal("negative entry not cached")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.Get(ip); ok {
+		t.Fatal("negative entry outlived NegTTL")
+	}
+	// misses: the first ResolveEntry and the expired Get
+	if st := c.Stats(); st.Size != 0 || st.Hits != 1 || st.Misses != 2 {
+		t.Fatalf("stats = %+v, want the expired entry dropped and counted as a miss", st)
+	}
+}
+
+func TestCacheClampsRecordTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		record uint32 // seconds
+		ttl    time.Duration
+		want   time.Duration
+	}{
+		{"record shorter than TTL", 120, 10 * time.Minute, 2 * time.Minute},
+		{"record longer than TTL", 3600, 10 * time.Minute, 10 * time.Minute},
+		{"record below minTTL", 5, 10 * time.Minute, minTTL},
+		{"TTL below minTTL", 300, time.Second, minTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStubServer(t)
+			s.ttl = tt.record
+			s.ptr["1.2.0.192.in-addr.arpa."] = "host.example."
+			c := NewCache(Options{Server: s.addr(), TTL: tt.ttl})
+
+			start := time.Now()
+			e := c.ResolveEntry(net.ParseIP("192.0.2.1"))
+			if e.Name != "host.example." {
+				t.Fatalf("name = %q", e.Name)
+			}
+			if d := e.Expires.Sub(start); d < tt.want || d > tt.want+time.Second {
+				t.Fatalf("entry lives %v, want %v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	c := NewCache(Options{})
+	c.set(Entry{IP: "192.0.2.1", Name: "a.example.", Verified: Verified}, time.Minute)
+	c.set(Entry{IP: "192.0.2.2"}, time.Minute)
+	c.setEntry(Entry{IP: "192.0.2.3", Name: "old.example.", Expires: time.Now().Add(-time.Second)})
+
+	st := &memStore{}
+	if err := c.Save(st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.entries) != 2 {
+		t.Fatalf("saved %d entries, want the 2 unexpired ones", len(st.entries))
+	}
+
+	// an entry that expired while stored is skipped on load
+	st.entries = append(st.entries, Entry{IP: "192.0.2.4", Name: "gone.example.", Expires: time.Now().Add(-time.Second)})
+
+	loaded := NewCache(Options{})
+	if err := loaded.Load(st); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := loaded.Peek(net.ParseIP("192.0.2.1")); !ok || e.Name != "a.example." || e.Verified != Verified {
+		t.Fatalf("192.0.2.1 after load = %+v, %v", e, ok)
+	}
+	if e, ok := loaded.Peek(net.ParseIP("192.0.2.2")); !ok || e.Name != "" {
+		t.Fatalf("negative entry after load = %+v, %v", e, ok)
+	}
+	for _, ip := range []string{"192.0.2.3", "192.0.2.4"} {
+		if _, ok := loaded.Peek(net.ParseIP(ip)); ok {
+			t.Errorf("expired %s loaded", ip)
+		}
+	}
+	if n := loaded.Stats().Size; n != 2 {
+		t.Fatalf("loaded size = %d, want 2", n)
+	}
+}
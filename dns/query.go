@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	resolvConf   = "/etc/resolv.conf"
+	queryTimeout = 3 * time.Second
+)
+
+// Resolver performs the PTR and forward queries. With Server empty it
+// queries the first nameserver from resolv.conf directly, so record TTLs are
+// known, and falls back to the system resolver (TTL reported as 0). With
+// Server set (DNS_RESOLVER, host:port) only that server is used, which also
+// lets tests point the cache at a local stub.
+type Resolver struct {
+	Server string
+}
+
+var errNoRecord = errors.New("no record")
+
+// LookupPTR resolves ip to its first PTR name.
+func (r Resolver) LookupPTR(ip string) (string, time.Duration, error) {
+	server := r.Server
+	if server == "" {
+		server = systemNameserver()
+	}
+	if server != "" {
+		name, ttl, err := queryPTR(server, ip)
+		if err == nil || errors.Is(err, errNoRecord) || r.Server != "" {
+			return name, ttl, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "", 0, err
+	}
+	return names[0], 0, nil
+}
+
+// LookupIP returns the addresses name resolves to in the family of want
+// (A for IPv4, AAAA for IPv6).
+func (r Resolver) LookupIP(name string, want net.IP) ([]net.IP, error) {
+	qtype := dnsmessage.TypeAAAA
+	if want.To4() != nil {
+		qtype = dnsmessage.TypeA
+	}
+
+	server := r.Server
+	if server == "" {
+		server = systemNameserver()
+	}
+	if server != "" {
+		ips, err := queryIP(server, name, qtype)
+		if err == nil || errors.Is(err, errNoRecord) || r.Server != "" {
+			return ips, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	network := "ip6"
+	if qtype == dnsmessage.TypeA {
+		network = "ip4"
+	}
+	return net.DefaultResolver.LookupIP(ctx, network, name)
+}
+
+// queryPTR sends a single PTR query for ip to server (host:port) over UDP.
+func queryPTR(server, ip string) (string, time.Duration, error) {
+	arpa, err := reverseName(ip)
+	if err != nil {
+		return "", 0, err
+	}
+
+	msg, err := exchange(server, arpa, dnsmessage.TypePTR)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, a := range msg.Answers {
+		if ptr, ok := a.Body.(*dnsmessage.PTRResource); ok && strings.EqualFold(a.Header.Name.String(), arpa) {
+			return ptr.PTR.String(), time.Duration(a.Header.TTL) * time.Second, nil
+		}
+	}
+	return "", 0, errNoRecord
+}
+
+// queryIP collects every A or AAAA record in the answer for name, including
+// those reached through a CNAME chain.
+func queryIP(server, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	msg, err := exchange(server, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []net.IP
+	for _, a := range msg.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			out = append(out, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			out = append(out, net.IP(b.AAAA[:]))
+		}
+	}
+	if len(out) == 0 {
+		return nil, errNoRecord
+	}
+	return out, nil
+}
+
+// exchange sends one question to server and returns the parsed response.
+// Responses that do not echo the random ID and the question are ignored.
+func exchange(server, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	q := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(queryTimeout))
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil {
+			continue // stray packet
+		}
+		if resp.Header.ID != id || !resp.Header.Response || !sameQuestion(resp.Questions, q) {
+			continue // stray or spoofed packet
+		}
+		switch resp.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+			return &resp, nil
+		case dnsmessage.RCodeNameError:
+			return &resp, errNoRecord
+		default:
+			return nil, fmt.Errorf("dns: %s for %s", resp.Header.RCode, name)
+		}
+	}
+}
+
+// sameQuestion reports whether qs is exactly q, ignoring the case of the
+// name.
+func sameQuestion(qs []dnsmessage.Question, q dnsmessage.Question) bool {
+	return len(qs) == 1 && qs[0].Type == q.Type && qs[0].Class == q.Class &&
+		strings.EqualFold(qs[0].Name.String(), q.Name.String())
+}
+
+// reverseName returns the in-addr.arpa / ip6.arpa name for ip.
+func reverseName(ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("invalid ip %q", ip)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0]), nil
+	}
+
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(addr) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[addr[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[addr[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String(), nil
+}
+
+// systemNameserver returns the first nameserver in resolv.conf as host:53.
+func systemNameserver() string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer answers PTR, A and AAAA questions from records over UDP on a
+// local port. When spoof is set every answer is preceded by one carrying
+// the same ID but a different question.
+type stubServer struct {
+	conn    *net.UDPConn
+	ptr     map[string]string   // arpa name -> PTR name
+	forward map[string][]net.IP // name -> addresses
+	ttl     uint32              // record TTL in seconds, 0 for 300
+	spoof   bool
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{conn: conn, ptr: map[string]string{}, forward: map[string][]net.IP{}}
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+// addr starts serving and returns the server address. Set the records
+// before calling it.
+func (s *stubServer) addr() string {
+	go s.serve()
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		if s.spoof {
+			s.spoofReply(from, req)
+		}
+		s.reply(from, req)
+	}
+}
+
+func (s *stubServer) reply(to *net.UDPAddr, req dnsmessage.Message) {
+	q := req.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.Header.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: req.Questions,
+	}
+	name := strings.ToLower(q.Name.String())
+	ttl := s.ttl
+	if ttl == 0 {
+		ttl = 300
+	}
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		if ptr, ok := s.ptr[name]; ok {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr,
+				Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(ptr)}})
+		}
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		for _, ip := range s.forward[name] {
+			if v4 := ip.To4(); v4 != nil && q.Type == dnsmessage.TypeA {
+				var a [4]byte
+				copy(a[:], v4)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: a}})
+			} else if v4 == nil && q.Type == dnsmessage.TypeAAAA {
+				var a [16]byte
+				copy(a[:], ip)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: a}})
+			}
+		}
+	}
+	if len(resp.Answers) > 0 || s.known(name) {
+		resp.Header.RCode = dnsmessage.RCodeSuccess
+	}
+	s.send(to, resp)
+}
+
+// spoofReply answers with the request ID for a different question.
+func (s *stubServer) spoofReply(to *net.UDPAddr, req dnsmessage.Message) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("spoofed.example."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	s.send(to, dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.Header.ID, Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: req.Questions[0].Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("evil.example.")},
+		}},
+	})
+}
+
+func (s *stubServer) send(to *net.UDPAddr, m dnsmessage.Message) {
+	if b, err := m.Pack(); err == nil {
+		s.conn.WriteToUDP(b, to)
+	}
+}
+
+func (s *stubServer) known(name string) bool {
+	_, ok := s.forward[name]
+	return ok
+}
+
+func TestResolverAgainstStub(t *testing.T) {
+	s := newStubServer(t)
+	s.ptr["1.2.0.192.in-addr.arpa."] = "host.example."
+	s.ptr["1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."] = "v6.example."
+	s.forward["host.example."] = []net.IP{net.ParseIP("192.0.2.1")}
+	r := Resolver{Server: s.addr()}
+
+	name, ttl, err := r.LookupPTR("192.0.2.1")
+	if err != nil || name != "host.example." || ttl != 300*time.Second {
+		t.Fatalf("LookupPTR(192.0.2.1) = %q, %v, %v", name, ttl, err)
+	}
+	if name, _, err := r.LookupPTR("2001:db8::1"); err != nil || name != "v6.example." {
+		t.Fatalf("LookupPTR(2001:db8::1) = %q, %v", name, err)
+	}
+	if _, _, err := r.LookupPTR("192.0.2.99"); !errors.Is(err, errNoRecord) {
+		t.Fatalf("LookupPTR of a missing record: err = %v, want errNoRecord", err)
+	}
+
+	ips, err := r.LookupIP("host.example", net.ParseIP("192.0.2.1"))
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("LookupIP(host.example) = %v, %v", ips, err)
+	}
+}
+
+func TestExchangeIgnoresMismatchedQuestion(t *testing.T) {
+	s := newStubServer(t)
+	s.spoof = true
+	s.ptr["1.2.0.192.in-addr.arpa."] = "host.example."
+
+	name, _, err := Resolver{Server: s.addr()}.LookupPTR("192.0.2.1")
+	if err != nil || name != "host.example." {
+		t.Fatalf("LookupPTR = %q, %v; want the answer to the question asked", name, err)
+	}
+}
+
+func TestCacheVerifyStrict(t *testing.T) {
+	s := newStubServer(t)
+	s.ptr["1.2.0.192.in-addr.arpa."] = "host.example."
+	s.ptr["2.2.0.192.in-addr.arpa."] = "liar.example."
+	s.forward["host.example."] = []net.IP{net.ParseIP("192.0.2.1")}
+	s.forward["liar.example."] = []net.IP{net.ParseIP("198.51.100.1")}
+
+	c := NewCache(Options{Server: s.addr(), Verify: VerifyStrict})
+	if e := c.ResolveEntry(net.ParseIP("192.0.2.1")); e.Name != "host.example." || e.Verified != Verified {
+		t.Fatalf("confirmed name: got %+v", e)
+	}
+	if e := c.ResolveEntry(net.ParseIP("192.0.2.2")); e.Name != "" {
+		t.Fatalf("unconfirmed name kept in strict mode: %+v", e)
+	}
+	if st := c.Stats(); st.Size != 2 {
+		t.Fatalf("cache size = %d, want 2", st.Size)
+	}
+}
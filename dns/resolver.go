@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 1024
+)
+
+// Background resolution: Lookup never blocks on the network. Misses are
+// queued to a small worker pool that fills the cache via Resolve, and the
+// aggregator backfills stored rows once the names arrive.
+var (
+	startOnce sync.Once
+	queue     chan string
+
+	pendingMu sync.Mutex
+	pending   = make(map[string]struct{})
+)
+
+// Start launches the resolver pool. Later calls are no-ops.
+func Start(workers, queueSize int) {
+	startOnce.Do(func() {
+		if workers <= 0 {
+			workers = defaultWorkers
+		}
+		if queueSize <= 0 {
+			queueSize = defaultQueueSize
+		}
+		queue = make(chan string, queueSize)
+		for i := 0; i < workers; i++ {
+			go worker()
+		}
+	})
+}
+
+// StartFromEnv starts the pool sized by DNS_WORKERS and DNS_QUEUE.
+func StartFromEnv() {
+	Start(envInt("DNS_WORKERS"), envInt("DNS_QUEUE"))
+}
+
+// Cached returns the cached entry for ip. ok is false when there is no
+// unexpired entry. It does not count towards the cache statistics.
+func Cached(ip net.IP) (e Entry, ok bool) {
+	return Default.Peek(ip)
+}
+
+// Lookup returns the cached entry for ip, possibly empty, and queues a
+// background lookup on a miss.
+func Lookup(ip net.IP) Entry {
+	if e, ok := Default.Get(ip); ok {
+		return e
+	}
+	Enqueue(ip)
+	return Entry{IP: ip.String()}
+}
+
+// Enqueue schedules ip for resolution. It returns false if the queue is
+// full; the address is retried on its next Lookup.
+func Enqueue(ip net.IP) bool {
+	StartFromEnv()
+
+	s := ip.String()
+	pendingMu.Lock()
+	if _, ok := pending[s]; ok {
+		pendingMu.Unlock()
+		return true
+	}
+	pending[s] = struct{}{}
+	pendingMu.Unlock()
+
+	select {
+	case queue <- s:
+		return true
+	default:
+		pendingMu.Lock()
+		delete(pending, s)
+		pendingMu.Unlock()
+		return false
+	}
+}
+
+func worker() {
+	for s := range queue {
+		ip := net.ParseIP(s)
+		if ip != nil {
+			Resolve(ip)
+		}
+		pendingMu.Lock()
+		delete(pending, s)
+		pendingMu.Unlock()
+	}
+}
+
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("dns: invalid value for %s: %v", name, err)
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package geo
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is the enrichment stored next to dns in traffic rows.
+type Info struct {
+	Country string // ISO 3166-1 alpha-2 code
+	ASN     uint
+	ASOrg   string
+}
+
+// DB looks up peers in locally provisioned MaxMind-format databases
+// (GeoLite2/GeoIP2 Country or City, GeoLite2 ASN, or compatible).
+// A nil *DB is valid and returns empty Info.
+type DB struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Open opens the country and ASN databases. Either path may be empty.
+func Open(countryPath, asnPath string) (*DB, error) {
+	d := &DB{}
+	if countryPath != "" {
+		r, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return nil, fmt.Errorf("open country db: %w", err)
+		}
+		d.country = r
+	}
+	if asnPath != "" {
+		r, err := maxminddb.Open(asnPath)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("open asn db: %w", err)
+		}
+		d.asn = r
+	}
+	return d, nil
+}
+
+// OpenFromEnv opens GEOIP_COUNTRY_DB and GEOIP_ASN_DB. It returns nil when
+// neither is set or the files cannot be opened, which disables enrichment.
+func OpenFromEnv() *DB {
+	countryPath := os.Getenv("GEOIP_COUNTRY_DB")
+	asnPath := os.Getenv("GEOIP_ASN_DB")
+	if countryPath == "" && asnPath == "" {
+		return nil
+	}
+
+	d, err := Open(countryPath, asnPath)
+	if err != nil {
+		log.Printf("geo: %v, enrichment disabled", err)
+		return nil
+	}
+	log.Printf("geo: loaded country=%q asn=%q", countryPath, asnPath)
+	return d
+}
+
+// Lookup returns whatever the configured databases know about ip.
+func (d *DB) Lookup(ip net.IP) Info {
+	var info Info
+	if d == nil {
+		return info
+	}
+
+	if d.country != nil {
+		var rec countryRecord
+		if err := d.country.Lookup(ip, &rec); err == nil {
+			info.Country = rec.Country.ISOCode
+		}
+	}
+	if d.asn != nil {
+		var rec asnRecord
+		if err := d.asn.Lookup(ip, &rec); err == nil {
+			info.ASN = rec.ASN
+			info.ASOrg = rec.ASOrg
+		}
+	}
+	return info
+}
+
+// Close releases the memory-mapped database files.
+func (d *DB) Close() {
+	if d == nil {
+		return
+	}
+	if d.country != nil {
+		d.country.Close()
+	}
+	if d.asn != nil {
+		d.asn.Close()
+	}
+}
@@ -8,6 +8,8 @@ require (
 	github.com/appwrite/sdk-for-go v0.16.0
 	github.com/cilium/ebpf v0.20.0
 	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/net v0.46.0
 )
 
 require golang.org/x/sys v0.37.0 // indirect
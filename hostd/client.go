@@ -0,0 +1,159 @@
+package hostd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSessionsPath = "/sessions"
+	contractsPageSize   = 500
+	httpTimeout         = 15 * time.Second
+)
+
+// Client reads the hostd HTTP API. URL is the API base including /api,
+// e.g. http://127.0.0.1:9980/api.
+type Client struct {
+	URL          string
+	Password     string // HTTP basic auth password, the user is empty
+	SessionsPath string // relative to URL, see Session
+
+	http *http.Client
+}
+
+// NewClient returns a client for the API at url.
+func NewClient(url, password string) *Client {
+	return &Client{
+		URL:          strings.TrimRight(url, "/"),
+		Password:     password,
+		SessionsPath: defaultSessionsPath,
+		http:         &http.Client{Timeout: httpTimeout},
+	}
+}
+
+// ClientFromEnv reads HOSTD_API_URL, HOSTD_API_PASSWORD and
+// HOSTD_SESSIONS_PATH. It returns nil when HOSTD_API_URL is unset.
+func ClientFromEnv() *Client {
+	url := os.Getenv("HOSTD_API_URL")
+	if url == "" {
+		return nil
+	}
+	c := NewClient(url, os.Getenv("HOSTD_API_PASSWORD"))
+	if p := os.Getenv("HOSTD_SESSIONS_PATH"); p != "" {
+		c.SessionsPath = p
+	}
+	return c
+}
+
+// Contract is the part of a hostd v2 contract the collector uses.
+type Contract struct {
+	ID              string `json:"id"`
+	Status          string `json:"status"`
+	RenterPublicKey string `json:"renterPublicKey"`
+	Usage           Usage  `json:"usage"`
+}
+
+// Usage is the revenue a contract has earned so far.
+type Usage struct {
+	Ingress Currency `json:"ingress"`
+	Egress  Currency `json:"egress"`
+}
+
+// Settings holds the host's bandwidth prices, in hastings per byte.
+type Settings struct {
+	IngressPrice Currency `json:"ingressPrice"`
+	EgressPrice  Currency `json:"egressPrice"`
+}
+
+// Session is one connected renter. hostd reports the peer as "ip:port" and
+// at least one of the renter key and the contract the session uses.
+type Session struct {
+	PeerAddress     string `json:"peerAddress"`
+	RenterPublicKey string `json:"renterPublicKey"`
+	ContractID      string `json:"contractID"`
+}
+
+type contractsRequest struct {
+	Statuses []string `json:"statuses"`
+	Limit    int      `json:"limit"`
+	Offset   int      `json:"offset"`
+}
+
+type contractsResponse struct {
+	Contracts []Contract `json:"contracts"`
+	Count     int        `json:"count"`
+}
+
+// ActiveContracts returns every active v2 contract, paging through
+// POST /v2/contracts.
+func (c *Client) ActiveContracts(ctx context.Context) ([]Contract, error) {
+	var out []Contract
+	for {
+		var page contractsResponse
+		req := contractsRequest{Statuses: []string{"active"}, Limit: contractsPageSize, Offset: len(out)}
+		if err := c.do(ctx, http.MethodPost, "/v2/contracts", req, &page); err != nil {
+			return nil, fmt.Errorf("contracts: %w", err)
+		}
+		out = append(out, page.Contracts...)
+		if len(page.Contracts) < contractsPageSize || len(out) >= page.Count {
+			return out, nil
+		}
+	}
+}
+
+// Settings returns the host settings from GET /settings.
+func (c *Client) Settings(ctx context.Context) (Settings, error) {
+	var out Settings
+	if err := c.do(ctx, http.MethodGet, "/settings", nil, &out); err != nil {
+		return Settings{}, fmt.Errorf("settings: %w", err)
+	}
+	return out, nil
+}
+
+// Sessions returns the connected renters from SessionsPath.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var out []Session
+	if err := c.do(ctx, http.MethodGet, c.SessionsPath, nil, &out); err != nil {
+		return nil, fmt.Errorf("sessions: %w", err)
+	}
+	return out, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth("", c.Password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
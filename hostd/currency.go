@@ -0,0 +1,61 @@
+package hostd
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// hastingsPerSC is 10^24.
+var hastingsPerSC = new(big.Int).Exp(big.NewInt(10), big.NewInt(24), nil)
+
+// Currency is an amount in hastings, encoded by hostd as a decimal string.
+type Currency struct {
+	big.Int
+}
+
+// NewCurrency returns h hastings.
+func NewCurrency(h *big.Int) Currency {
+	var c Currency
+	c.Set(h)
+	return c
+}
+
+func (c *Currency) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" || s == "" {
+		c.SetInt64(0)
+		return nil
+	}
+	if _, ok := c.SetString(s, 10); !ok {
+		return fmt.Errorf("invalid currency %q", s)
+	}
+	return nil
+}
+
+func (c Currency) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + c.Int.String() + `"`), nil
+}
+
+// SC formats c in siacoins with 6 decimals.
+func (c Currency) SC() string {
+	return new(big.Rat).SetFrac(&c.Int, hastingsPerSC).FloatString(6)
+}
+
+// PerTB formats a per byte price in SC/TB.
+func (c Currency) PerTB() string {
+	tb := new(big.Int).Mul(&c.Int, big.NewInt(1e12))
+	return NewCurrency(tb).SC()
+}
+
+// ParsePerTB parses a price in SC/TB, e.g. "250" or "0.5", into hastings
+// per byte.
+func ParsePerTB(s string) (Currency, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || r.Sign() < 0 {
+		return Currency{}, fmt.Errorf("invalid price %q", s)
+	}
+	// SC/TB * 10^24 H/SC / 10^12 B/TB
+	r.Mul(r, new(big.Rat).SetInt64(1e12))
+	return NewCurrency(new(big.Int).Quo(r.Num(), r.Denom())), nil
+}
@@ -0,0 +1,158 @@
+package hostd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// newStubServer serves stub and counts the contract pages requested.
+func newStubServer(t *testing.T, stub *Stub) (*Client, *atomic.Int32) {
+	t.Helper()
+	var pages atomic.Int32
+	h := stub.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/contracts" {
+			pages.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL+"/api/", stub.Password), &pages
+}
+
+// contracts returns n contracts with status, renter r0..r9 in turn.
+func contracts(n int, status string) []Contract {
+	out := make([]Contract, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, Contract{
+			ID:              fmt.Sprintf("%s-%04d", status, i),
+			Status:          status,
+			RenterPublicKey: fmt.Sprintf("ed25519:r%d", i%10),
+		})
+	}
+	return out
+}
+
+func TestActiveContractsPages(t *testing.T) {
+	stub := &Stub{Password: "secret"}
+	stub.Contracts = append(contracts(2*contractsPageSize+1, "active"), contracts(3, "expired")...)
+	c, pages := newStubServer(t, stub)
+
+	got, err := c.ActiveContracts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2*contractsPageSize+1 {
+		t.Fatalf("%d contracts, want %d", len(got), 2*contractsPageSize+1)
+	}
+	seen := make(map[string]bool)
+	for _, ct := range got {
+		if ct.Status != "active" || seen[ct.ID] {
+			t.Fatalf("contract %s (%s) returned twice or not active", ct.ID, ct.Status)
+		}
+		seen[ct.ID] = true
+	}
+	if n := pages.Load(); n != 3 {
+		t.Fatalf("%d pages requested, want 3", n)
+	}
+
+	// an exact multiple of the page size stops on the count
+	stub.Contracts = contracts(contractsPageSize, "active")
+	pages.Store(0)
+	if got, err := c.ActiveContracts(context.Background()); err != nil || len(got) != contractsPageSize || pages.Load() != 1 {
+		t.Fatalf("one full page: %d contracts in %d requests, %v", len(got), pages.Load(), err)
+	}
+}
+
+func TestClientWrongPassword(t *testing.T) {
+	c, _ := newStubServer(t, &Stub{Password: "secret"})
+	c.Password = "wrong"
+	if _, err := c.ActiveContracts(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("wrong password: err = %v, want 401", err)
+	}
+}
+
+func TestMapperRefresh(t *testing.T) {
+	stub := &Stub{
+		Password: "secret",
+		Contracts: []Contract{
+			{ID: "c-single", Status: "active", RenterPublicKey: "ed25519:single"},
+			{ID: "c-multi-1", Status: "active", RenterPublicKey: "ed25519:multi"},
+			{ID: "c-multi-2", Status: "active", RenterPublicKey: "ed25519:multi"},
+		},
+		Sessions: []Session{
+			{PeerAddress: "192.0.2.1:50123", ContractID: "c-multi-1"},             // renter from the contract
+			{PeerAddress: "[2001:db8::1]:443", RenterPublicKey: "ed25519:single"}, // the renter's only contract
+			{PeerAddress: "198.51.100.1", RenterPublicKey: "ed25519:multi"},       // ambiguous contract
+			{PeerAddress: "203.0.113.1:1"},                                        // nothing known
+			{PeerAddress: "not-an-address", ContractID: "c-single"},
+		},
+	}
+	// more contracts than one page, so the mapping needs every page
+	stub.Contracts = append(stub.Contracts, contracts(contractsPageSize, "active")...)
+	stub.Contracts = append(stub.Contracts, Contract{ID: "c-last", Status: "active", RenterPublicKey: "ed25519:last"})
+	stub.Sessions = append(stub.Sessions, Session{PeerAddress: "192.0.2.99:1", ContractID: "c-last"})
+
+	c, _ := newStubServer(t, stub)
+	m := NewMapper(c, 0)
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		peer string
+		want Annotation
+		ok   bool
+	}{
+		{"192.0.2.1", Annotation{RenterKey: "ed25519:multi", ContractID: "c-multi-1"}, true},
+		{"2001:db8::1", Annotation{RenterKey: "ed25519:single", ContractID: "c-single"}, true},
+		{"198.51.100.1", Annotation{RenterKey: "ed25519:multi"}, true},
+		{"192.0.2.99", Annotation{RenterKey: "ed25519:last", ContractID: "c-last"}, true},
+		{"203.0.113.1", Annotation{}, false},
+	} {
+		p, _ := model.ParsePeer(tc.peer)
+		got, ok := m.Lookup(p)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("Lookup(%s) = %+v, %v; want %+v, %v", tc.peer, got, ok, tc.want, tc.ok)
+		}
+	}
+	if n := len(m.Peers()); n != 4 {
+		t.Fatalf("%d peers mapped, want 4", n)
+	}
+}
+
+// usageRecorder is a UsageStore keeping the last snapshot.
+type usageRecorder struct {
+	day       string
+	contracts []Contract
+}
+
+func (u *usageRecorder) SaveUsage(day string, contracts []Contract) error {
+	u.day, u.contracts = day, contracts
+	return nil
+}
+
+func TestMapperRecordsUsage(t *testing.T) {
+	stub := &Stub{Password: "secret", Contracts: contracts(contractsPageSize+1, "active")}
+	c, _ := newStubServer(t, stub)
+	m := NewMapper(c, 0)
+	var rec usageRecorder
+	m.RecordUsage(&rec)
+
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec.day != time.Now().UTC().Format("2006-01-02") || len(rec.contracts) != contractsPageSize+1 {
+		t.Fatalf("snapshot of %s with %d contracts, want today with %d", rec.day, len(rec.contracts), contractsPageSize+1)
+	}
+	var nilMapper *Mapper
+	nilMapper.RecordUsage(&rec) // must not panic
+}
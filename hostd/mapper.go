@@ -0,0 +1,197 @@
+package hostd
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	defaultRefresh = time.Minute
+
+	// peers keep their renter this long after their last session, so
+	// traffic of a renter between sessions is still attributed
+	peerTTL = time.Hour
+)
+
+// Annotation is what a peer is known to be to hostd.
+type Annotation struct {
+	RenterKey  string
+	ContractID string
+}
+
+type entry struct {
+	Annotation
+	seen time.Time
+}
+
+// UsageSnapshot is the usage of a contract as first seen on Day (UTC,
+// YYYY-MM-DD).
+type UsageSnapshot struct {
+	Day   string
+	Usage Usage
+}
+
+// UsageStore keeps daily usage snapshots, so revenue can be counted over a
+// window instead of the contract lifetime.
+type UsageStore interface {
+	SaveUsage(day string, contracts []Contract) error
+}
+
+// Mapper periodically maps peer addresses to renters and contracts. Lookups
+// never wait for hostd.
+type Mapper struct {
+	client   *Client
+	interval time.Duration
+	usage    UsageStore // nil: no snapshots
+
+	mu    sync.RWMutex
+	peers map[model.Peer]entry
+}
+
+// NewMapper returns a mapper refreshing from c every interval.
+func NewMapper(c *Client, interval time.Duration) *Mapper {
+	if interval <= 0 {
+		interval = defaultRefresh
+	}
+	return &Mapper{client: c, interval: interval, peers: make(map[model.Peer]entry)}
+}
+
+// MapperFromEnv returns a mapper for ClientFromEnv refreshing every
+// HOSTD_REFRESH, or nil when HOSTD_API_URL is unset.
+func MapperFromEnv() *Mapper {
+	c := ClientFromEnv()
+	if c == nil {
+		return nil
+	}
+	interval := defaultRefresh
+	if v := os.Getenv("HOSTD_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("hostd: invalid HOSTD_REFRESH %q, using %s", v, defaultRefresh)
+		} else {
+			interval = d
+		}
+	}
+	log.Printf("hostd: mapping peers to renters from %s every %s", c.URL, interval)
+	return NewMapper(c, interval)
+}
+
+// RecordUsage makes every refresh save a usage snapshot of the active
+// contracts to st. A nil mapper ignores it.
+func (m *Mapper) RecordUsage(st UsageStore) {
+	if m != nil {
+		m.usage = st
+	}
+}
+
+// Run refreshes until ctx is done. A nil mapper does nothing.
+func (m *Mapper) Run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		if err := m.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("hostd: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Refresh pulls the active contracts and sessions once.
+func (m *Mapper) Refresh(ctx context.Context) error {
+	contracts, err := m.client.ActiveContracts(ctx)
+	if err != nil {
+		return err
+	}
+	sessions, err := m.client.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if m.usage != nil {
+		if err := m.usage.SaveUsage(now.UTC().Format("2006-01-02"), contracts); err != nil {
+			log.Printf("hostd: save contract usage: %v", err)
+		}
+	}
+
+	renterOf := make(map[string]string, len(contracts))
+	byRenter := make(map[string][]string)
+	for _, c := range contracts {
+		renterOf[c.ID] = c.RenterPublicKey
+		byRenter[c.RenterPublicKey] = append(byRenter[c.RenterPublicKey], c.ID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range sessions {
+		p, ok := parsePeer(s.PeerAddress)
+		if !ok {
+			continue
+		}
+		a := Annotation{RenterKey: s.RenterPublicKey, ContractID: s.ContractID}
+		if a.RenterKey == "" {
+			a.RenterKey = renterOf[a.ContractID]
+		}
+		// a renter with a single active contract is unambiguous
+		if ids := byRenter[a.RenterKey]; a.ContractID == "" && len(ids) == 1 {
+			a.ContractID = ids[0]
+		}
+		if a.RenterKey == "" && a.ContractID == "" {
+			continue
+		}
+		m.peers[p] = entry{Annotation: a, seen: now}
+	}
+	for p, e := range m.peers {
+		if now.Sub(e.seen) > peerTTL {
+			delete(m.peers, p)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the renter last seen at p.
+func (m *Mapper) Lookup(p model.Peer) (Annotation, bool) {
+	if m == nil {
+		return Annotation{}, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.peers[p]
+	return e.Annotation, ok
+}
+
+// Peers returns a copy of the current mapping.
+func (m *Mapper) Peers() map[model.Peer]Annotation {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[model.Peer]Annotation, len(m.peers))
+	for p, e := range m.peers {
+		out[p] = e.Annotation
+	}
+	return out
+}
+
+// parsePeer accepts "ip:port", "[ip6]:port" and a bare address.
+func parsePeer(s string) (model.Peer, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return model.PeerFrom(ap.Addr()), true
+	}
+	p, err := model.ParsePeer(s)
+	return p, err == nil
+}
@@ -0,0 +1,83 @@
+package hostd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Stub serves the endpoints Client uses from fixed data, to try the
+// integration without a running hostd. It is loaded from a JSON file
+// holding the fields below.
+type Stub struct {
+	Password  string     `json:"password"`
+	Contracts []Contract `json:"contracts"`
+	Sessions  []Session  `json:"sessions"`
+	Settings  Settings   `json:"settings"`
+}
+
+// LoadStub reads a Stub from path.
+func LoadStub(path string) (*Stub, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Stub
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Handler serves the stub under /api, like hostd.
+func (s *Stub) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/contracts", s.handleContracts)
+	mux.HandleFunc("GET /api/settings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Settings)
+	})
+	mux.HandleFunc("GET /api"+defaultSessionsPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Sessions)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, _ := r.BasicAuth(); pass != s.Password {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Stub) handleContracts(w http.ResponseWriter, r *http.Request) {
+	var req contractsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	want := make(map[string]bool, len(req.Statuses))
+	for _, st := range req.Statuses {
+		want[st] = true
+	}
+
+	var match []Contract
+	for _, c := range s.Contracts {
+		if len(want) == 0 || want[c.Status] {
+			match = append(match, c)
+		}
+	}
+	resp := contractsResponse{Contracts: []Contract{}, Count: len(match)}
+	if req.Offset < len(match) {
+		end := len(match)
+		if req.Limit > 0 && req.Offset+req.Limit < end {
+			end = req.Offset + req.Limit
+		}
+		resp.Contracts = match[req.Offset:end]
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,255 @@
+package httpauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scope is what a client may do. Admin includes Read.
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopeRead
+	ScopeAdmin
+)
+
+func (s Scope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+type token struct {
+	name  string
+	value []byte
+	scope Scope
+}
+
+// Config protects an HTTP surface with optional TLS, bearer tokens and
+// client certificates. With no tokens and no client CA every request gets
+// read access, which keeps plain local setups working.
+type Config struct {
+	Name     string // log prefix, e.g. "server"
+	CertFile string
+	KeyFile  string
+	ClientCA string // PEM bundle; verified client certs get ScopeRead
+
+	AdminClients map[string]bool // client cert common names with ScopeAdmin
+
+	tokens []token
+}
+
+// FromEnv reads <prefix>_TLS_CERT, <prefix>_TLS_KEY, <prefix>_CLIENT_CA,
+// <prefix>_READ_TOKENS, <prefix>_ADMIN_TOKENS and <prefix>_ADMIN_CLIENTS.
+// Token lists are comma separated; an entry "name:token" names the client
+// in the access log.
+func FromEnv(name, prefix string) *Config {
+	c := &Config{
+		Name:         name,
+		CertFile:     os.Getenv(prefix + "_TLS_CERT"),
+		KeyFile:      os.Getenv(prefix + "_TLS_KEY"),
+		ClientCA:     os.Getenv(prefix + "_CLIENT_CA"),
+		AdminClients: make(map[string]bool),
+	}
+	c.AddTokens(ScopeRead, os.Getenv(prefix+"_READ_TOKENS"))
+	c.AddTokens(ScopeAdmin, os.Getenv(prefix+"_ADMIN_TOKENS"))
+	for _, cn := range strings.Split(os.Getenv(prefix+"_ADMIN_CLIENTS"), ",") {
+		if cn = strings.TrimSpace(cn); cn != "" {
+			c.AdminClients[cn] = true
+		}
+	}
+	return c
+}
+
+// AddTokens adds a comma separated token list with scope.
+func (c *Config) AddTokens(scope Scope, list string) {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(t, ":")
+		if !ok {
+			sum := sha256.Sum256([]byte(t))
+			name, value = "token-"+hex.EncodeToString(sum[:4]), t
+		}
+		c.tokens = append(c.tokens, token{name: name, value: []byte(value), scope: scope})
+	}
+}
+
+// Enabled reports whether requests must authenticate.
+func (c *Config) Enabled() bool {
+	return len(c.tokens) > 0 || c.ClientCA != ""
+}
+
+// TLS reports whether a certificate is configured.
+func (c *Config) TLS() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Identify returns the client name and scope of r. Anonymous requests get
+// ScopeRead when authentication is disabled; admin always needs a
+// credential.
+func (c *Config) Identify(r *http.Request) (string, Scope) {
+	if !c.Enabled() {
+		return "-", ScopeRead
+	}
+
+	best, name := ScopeNone, "-"
+	if cn, ok := ClientCert(r); ok {
+		best, name = ScopeRead, "cert:"+cn
+		if c.AdminClients[cn] {
+			best = ScopeAdmin
+		}
+	}
+	if secret := credential(r); secret != "" {
+		for _, t := range c.tokens {
+			if subtle.ConstantTimeCompare([]byte(secret), t.value) == 1 && t.scope > best {
+				best, name = t.scope, t.name
+			}
+		}
+	}
+	return name, best
+}
+
+// ClientCert returns the common name of a verified client certificate.
+func ClientCert(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// credential returns a bearer token, or the password of HTTP basic auth so
+// browsers can open HTML pages.
+func credential(r *http.Request) string {
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return t
+	}
+	if _, p, ok := r.BasicAuth(); ok {
+		return p
+	}
+	return ""
+}
+
+// Require rejects requests below scope.
+func (c *Config) Require(scope Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, got := c.Identify(r)
+		switch {
+		case got >= scope:
+			h.ServeHTTP(w, r)
+		case got == ScopeNone:
+			w.Header().Set("WWW-Authenticate", `Basic realm="collector"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			http.Error(w, scope.String()+" scope required", http.StatusForbidden)
+		}
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// AccessLog logs one line per request with the client identity.
+func (c *Config) AccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		name, scope := c.Identify(r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		log.Printf("%s: %s %s(%s) %s %s %d %dB %s", c.Name, r.RemoteAddr, name, scope,
+			r.Method, r.URL.Path, sw.status, sw.bytes, time.Since(start).Truncate(time.Millisecond))
+	})
+}
+
+// ListenAndServe serves h on addr with the access log, over TLS when a
+// certificate is configured, until ctx is done.
+func (c *Config) ListenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           c.AccessLog(h),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if c.ClientCA != "" && !c.TLS() {
+		return fmt.Errorf("%s: client CA needs a TLS certificate and key", c.Name)
+	}
+	if !c.Enabled() {
+		log.Printf("%s: no tokens or client CA configured, anyone can read", c.Name)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	})
+	defer stop()
+
+	var err error
+	if c.TLS() {
+		err = c.serveTLS(srv)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Config) serveTLS(srv *http.Server) error {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return fmt.Errorf("%s: read client CA: %w", c.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates in %s", c.Name, c.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		// tokens keep working for clients without a certificate
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	srv.TLSConfig = cfg
+	return srv.ListenAndServeTLS(c.CertFile, c.KeyFile)
+}
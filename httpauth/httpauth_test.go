@@ -0,0 +1,58 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireScopes(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	open := &Config{Name: "test"}
+	locked := &Config{Name: "test"}
+	locked.AddTokens(ScopeRead, "grafana:r-token")
+	locked.AddTokens(ScopeAdmin, "a-token")
+
+	for _, tc := range []struct {
+		name  string
+		c     *Config
+		scope Scope
+		token string
+		want  int
+	}{
+		{"open read", open, ScopeRead, "", http.StatusOK},
+		{"open admin", open, ScopeAdmin, "", http.StatusForbidden},
+		{"anonymous read", locked, ScopeRead, "", http.StatusUnauthorized},
+		{"wrong token", locked, ScopeRead, "nope", http.StatusUnauthorized},
+		{"read token", locked, ScopeRead, "r-token", http.StatusOK},
+		{"read token admin", locked, ScopeAdmin, "r-token", http.StatusForbidden},
+		{"admin token", locked, ScopeAdmin, "a-token", http.StatusOK},
+		{"admin token read", locked, ScopeRead, "a-token", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		tc.c.Require(tc.scope, ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestIdentifyNames(t *testing.T) {
+	c := &Config{}
+	c.AddTokens(ScopeRead, "grafana:r-token,bare")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("anyone", "r-token")
+	if name, scope := c.Identify(req); name != "grafana" || scope != ScopeRead {
+		t.Fatalf("basic auth: %s(%s), want grafana(read)", name, scope)
+	}
+
+	req.Header.Set("Authorization", "Bearer bare")
+	if name, scope := c.Identify(req); name == "bare" || scope != ScopeRead {
+		t.Fatalf("unnamed token: %s(%s), want a hashed name with read", name, scope)
+	}
+}
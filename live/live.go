@@ -1,126 +1,221 @@
 package live
 
 import (
+    "context"
     "fmt"
-    "net"
+    "io"
+    "log"
+    "net/netip"
+    "os"
+    "sort"
+    "strconv"
     "time"
 
     "github.com/back2basic/collector/bpfgo"
+    "github.com/back2basic/collector/counters"
     "github.com/back2basic/collector/model"
+    "github.com/back2basic/collector/privacy"
     "github.com/back2basic/collector/storage"
 )
 
 type Live struct {
-    h *bpfgo.Handles
+    src counters.Source
+    ann Annotator       // nil: only the ip and prefix groups carry a key
+    pol *privacy.Policy // applied before printing, like before storing
+    out io.Writer       // os.Stdout
+
+    group     string          // LIVE_GROUP: any storage grouping (host, ip, prefix, asn, country, renter, contract)
+    prefixLen model.PrefixLen // used when grouping live counters by prefix without an annotator
 }
 
-func New(h *bpfgo.Handles) *Live {
-    return &Live{h: h}
+// Annotator turns live counters into rows the way a flush would, with the
+// geo and hostd fields the non-address groupings key on.
+type Annotator interface {
+    Annotate(snap map[model.Peer]bpfgo.SiaIPStats) []model.TrafficRecord
 }
 
-func (l *Live) Run() {
+// New returns a dashboard for src. pol may be nil.
+func New(src counters.Source, ann Annotator, pol *privacy.Policy) *Live {
+    group := storage.GroupIP
+    if g := os.Getenv("LIVE_GROUP"); storage.ValidGroup(g) {
+        group = g
+    } else if g != "" {
+        log.Printf("live: unknown LIVE_GROUP %q, grouping by %s", g, group)
+    }
+    return &Live{src: src, ann: ann, pol: pol, out: os.Stdout, group: group, prefixLen: model.PrefixLenFromEnv()}
+}
+
+// Run prints the live counters every 30 seconds until ctx is done.
+func (l *Live) Run(ctx context.Context) {
     ticker := time.NewTicker(30 * time.Second)
     defer ticker.Stop()
 
     for {
-        <-ticker.C
-        l.printStats()
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            l.printStats()
+        }
     }
 }
 
 func (l *Live) printStats() {
-    // Live section: current BPF map contents
-    fmt.Println("---- LIVE TRAFFIC (semantic counters) ----")
-
-    // IPv4 live
-    iter := l.h.IP4Stats.Iterate()
-    var ip uint32
-    var st bpfgo.SiaIPStats
-
-    for iter.Next(&ip, &st) {
-        if st.ConsensusDown == 0 &&
-            st.ConsensusUp == 0 &&
-            st.SiamuxDown == 0 &&
-            st.SiamuxUp == 0 &&
-            st.QuicDown == 0 &&
-            st.QuicUp == 0 {
-            continue
-        }
-        addr := net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24))
-        fmt.Printf("IPv4 %s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
-            addr.String(),
-            bytesHuman(st.ConsensusDown), bytesHuman(st.ConsensusUp),
-            bytesHuman(st.SiamuxDown), bytesHuman(st.SiamuxUp),
-            bytesHuman(st.QuicDown),bytesHuman(st.QuicUp),
-        )
-    }
+    // Live section: current counters
+    fmt.Fprintln(l.out, "---- LIVE TRAFFIC (semantic counters) ----")
 
-    // IPv6 live
-    iter6 := l.h.IP6Stats.Iterate()
-    var ip6 net.IP
-    var st6 bpfgo.SiaIPStats
+    snap, err := l.src.Snapshot()
+    if err != nil {
+        fmt.Fprintf(l.out, "WARNING: failed to read live counters: %v\n", err)
+    }
 
-    for iter6.Next(&ip6, &st6) {
-        if st6.ConsensusDown == 0 &&
-            st6.ConsensusUp == 0 &&
-            st6.SiamuxDown == 0 &&
-            st6.SiamuxUp == 0 &&
-            st6.QuicDown == 0 &&
-            st6.QuicUp == 0 {
+    groups := make(map[string]*model.TrafficRecord)
+    for _, r := range l.records(snap) {
+        key := groupKey(l.group, r)
+        if g, ok := groups[key]; ok {
+            g.Add(r)
             continue
         }
-        fmt.Printf("IPv6 %s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
-            ip6.String(),
-            bytesHuman(st6.ConsensusDown), bytesHuman(st6.ConsensusUp),
-            bytesHuman(st6.SiamuxDown), bytesHuman(st6.SiamuxUp),
-            bytesHuman(st6.QuicDown), bytesHuman(st6.QuicUp),
+        r := r
+        groups[key] = &r
+    }
+    for _, key := range sortedKeys(groups) {
+        st := groups[key]
+        fmt.Fprintf(l.out, "%s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
+            label(key),
+            bytesHuman(st.ConsensusDown), bytesHuman(st.ConsensusUp),
+            bytesHuman(st.SiamuxDown), bytesHuman(st.SiamuxUp),
+            bytesHuman(st.QuicDown), bytesHuman(st.QuicUp),
         )
+        l.printOther(st.OtherDown, st.OtherUp)
     }
 
-    fmt.Println("-------------------------------------------")
+    fmt.Fprintln(l.out, "-------------------------------------------")
 
     // Stored / aggregated section: use existing storage.QueryDailyTotals()
-    fmt.Println("---- STORED TRAFFIC (aggregated today) ----")
+    fmt.Fprintln(l.out, "---- STORED TRAFFIC (aggregated today) ----")
 
     aggMap := make(map[string]model.AggregatedRecord)
-    if recs, err := storage.QueryDailyTotals(); err == nil {
+    if recs, err := storage.QueryDailyTotalsBy(l.group); err == nil {
         for _, r := range recs {
             aggMap[r.IP] = r
         }
     } else {
-        fmt.Printf("WARNING: failed to load aggregated totals: %v\n", err)
+        fmt.Fprintf(l.out, "WARNING: failed to load aggregated totals: %v\n", err)
     }
 
     // Print stored entries
-    for ipStr, agg := range aggMap {
-        parsed := net.ParseIP(ipStr)
-        if parsed == nil {
-            fmt.Printf("%s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
-                ipStr,
-                bytesHuman(agg.ConsensusDown), bytesHuman(agg.ConsensusUp),
-                bytesHuman(agg.SiamuxDown), bytesHuman(agg.SiamuxUp),
-                bytesHuman(agg.QuicDown), bytesHuman(agg.QuicUp),
-            )
-            continue
+    for _, key := range sortedKeys(aggMap) {
+        agg := aggMap[key]
+        fmt.Fprintf(l.out, "%s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
+            label(key),
+            bytesHuman(agg.ConsensusDown), bytesHuman(agg.ConsensusUp),
+            bytesHuman(agg.SiamuxDown), bytesHuman(agg.SiamuxUp),
+            bytesHuman(agg.QuicDown), bytesHuman(agg.QuicUp),
+        )
+        l.printOther(agg.OtherDown, agg.OtherUp)
+    }
+
+    fmt.Fprintln(l.out, "-------------------------------------------")
+}
+
+// records turns the snapshot into rows, through the annotator if there is
+// one, with the peers minimised as the privacy policy stores them.
+func (l *Live) records(snap map[model.Peer]bpfgo.SiaIPStats) []model.TrafficRecord {
+    if l.ann != nil {
+        return l.pol.Apply(l.ann.Annotate(snap))
+    }
+    recs := make([]model.TrafficRecord, 0, len(snap))
+    for p, st := range snap {
+        recs = append(recs, model.TrafficRecord{
+            IP:            p.String(),
+            Prefix:        l.prefixLen.Of(p.Addr).String(),
+            ConsensusUp:   st.ConsensusUp,
+            ConsensusDown: st.ConsensusDown,
+            SiamuxUp:      st.SiamuxUp,
+            SiamuxDown:    st.SiamuxDown,
+            QuicUp:        st.QuicUp,
+            QuicDown:      st.QuicDown,
+            OtherUp:       st.OtherUp,
+            OtherDown:     st.OtherDown,
+        })
+    }
+    return l.pol.Apply(recs)
+}
+
+// groupKey returns the key r is summed under, matching the keys
+// storage.QueryDailyTotalsBy returns for group.
+func groupKey(group string, r model.TrafficRecord) string {
+    switch group {
+    case storage.GroupHost:
+        return r.Hostname
+    case storage.GroupPrefix:
+        if r.Prefix != "" {
+            return r.Prefix
         }
-        if parsed.To4() != nil {
-            fmt.Printf("IPv4 %s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
-                ipStr,
-                bytesHuman(agg.ConsensusDown), bytesHuman(agg.ConsensusUp),
-                bytesHuman(agg.SiamuxDown), bytesHuman(agg.SiamuxUp),
-                bytesHuman(agg.QuicDown), bytesHuman(agg.QuicUp),
-            )
-        } else {
-            fmt.Printf("IPv6 %s  consensus(down/up)=%s/%s  siamux(down/up)=%s/%s  quic(down/up)=%s/%s\n",
-                ipStr,
-                bytesHuman(agg.ConsensusDown), bytesHuman(agg.ConsensusUp),
-                bytesHuman(agg.SiamuxDown), bytesHuman(agg.SiamuxUp),
-                bytesHuman(agg.QuicDown), bytesHuman(agg.QuicUp),
-            )
+        return r.IP
+    case storage.GroupASN:
+        return "AS" + strconv.FormatUint(uint64(r.ASN), 10)
+    case storage.GroupCountry:
+        return r.Country
+    case storage.GroupRenter:
+        return r.RenterKey
+    case storage.GroupContract:
+        return r.ContractID
+    }
+    return r.IP
+}
+
+// label prefixes addresses with their family; other keys print as is.
+func label(key string) string {
+    if key == "" {
+        return "(none)"
+    }
+    if p, err := model.ParsePeer(key); err == nil {
+        return p.Family() + " " + key
+    }
+    return key
+}
+
+// sortedKeys returns the keys of m in order, so every tick prints the same
+// layout. Addresses and prefixes sort numerically, everything else as text
+// after them.
+func sortedKeys[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        a, okA := keyAddr(keys[i])
+        b, okB := keyAddr(keys[j])
+        if okA && okB && a != b {
+            return a.Less(b)
         }
+        if okA != okB {
+            return okA
+        }
+        return keys[i] < keys[j]
+    })
+    return keys
+}
+
+// keyAddr returns the address of an ip or prefix group key.
+func keyAddr(key string) (netip.Addr, bool) {
+    if p, err := model.ParsePeer(key); err == nil {
+        return p.Addr, true
+    }
+    if p, err := netip.ParsePrefix(key); err == nil {
+        return p.Addr(), true
     }
+    return netip.Addr{}, false
+}
 
-    fmt.Println("-------------------------------------------")
+// printOther prints the non-Sia counters below a peer line, if any were counted.
+func (l *Live) printOther(down, up uint64) {
+    if down == 0 && up == 0 {
+        return
+    }
+    fmt.Fprintf(l.out, "    other(down/up)=%s/%s\n", bytesHuman(down), bytesHuman(up))
 }
 
 // bytesHuman converts bytes to a human readable string with units (KB/MB/GB/TB).
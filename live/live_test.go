@@ -0,0 +1,128 @@
+package live
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/privacy"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+// fakeAnnotator tags every peer with a country taken from countries.
+type fakeAnnotator map[string]string
+
+func (f fakeAnnotator) Annotate(snap map[model.Peer]bpfgo.SiaIPStats) []model.TrafficRecord {
+	var recs []model.TrafficRecord
+	for p, st := range snap {
+		recs = append(recs, model.TrafficRecord{IP: p.String(), Country: f[p.String()], QuicUp: st.QuicUp})
+	}
+	return recs
+}
+
+func newTestLive(t *testing.T, group string, ann Annotator) (*Live, *counters.Memory, *bytes.Buffer) {
+	t.Helper()
+	storagetest.Open(t)
+	t.Setenv("LIVE_GROUP", group)
+
+	mem := counters.NewMemory()
+	l := New(mem, ann, nil)
+	var out bytes.Buffer
+	l.out = &out
+	return l, mem, &out
+}
+
+func add(t *testing.T, mem *counters.Memory, ip string, st bpfgo.SiaIPStats) {
+	t.Helper()
+	p, err := model.ParsePeer(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.Add(p, st)
+}
+
+// liveLines returns the peer lines of the live section.
+func liveLines(out string) []string {
+	live, _, _ := strings.Cut(out, "-------------------------------------------")
+	var lines []string
+	for _, l := range strings.Split(live, "\n")[1:] {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func TestPrintStatsSortsByAddress(t *testing.T) {
+	l, mem, out := newTestLive(t, storage.GroupIP, nil)
+	add(t, mem, "2001:db8::1", bpfgo.SiaIPStats{QuicUp: 1})
+	add(t, mem, "192.0.2.10", bpfgo.SiaIPStats{QuicUp: 2})
+	add(t, mem, "192.0.2.9", bpfgo.SiaIPStats{QuicUp: 3, OtherDown: 2048})
+
+	l.printStats()
+	got := liveLines(out.String())
+	want := []string{
+		"IPv4 192.0.2.9  consensus(down/up)=0 B/0 B  siamux(down/up)=0 B/0 B  quic(down/up)=0 B/3 B",
+		"    other(down/up)=2.00 KB/0 B",
+		"IPv4 192.0.2.10  consensus(down/up)=0 B/0 B  siamux(down/up)=0 B/0 B  quic(down/up)=0 B/2 B",
+		"IPv6 2001:db8::1  consensus(down/up)=0 B/0 B  siamux(down/up)=0 B/0 B  quic(down/up)=0 B/1 B",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("live section:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPrintStatsGroups(t *testing.T) {
+	ann := fakeAnnotator{"192.0.2.1": "DE", "192.0.2.2": "DE", "198.51.100.1": "AT"}
+	l, mem, out := newTestLive(t, storage.GroupCountry, ann)
+	add(t, mem, "192.0.2.1", bpfgo.SiaIPStats{QuicUp: 1})
+	add(t, mem, "192.0.2.2", bpfgo.SiaIPStats{QuicUp: 2})
+	add(t, mem, "198.51.100.1", bpfgo.SiaIPStats{QuicUp: 4})
+	add(t, mem, "203.0.113.1", bpfgo.SiaIPStats{QuicUp: 8})
+
+	l.printStats()
+	got := liveLines(out.String())
+	if len(got) != 3 ||
+		!strings.HasPrefix(got[0], "(none) ") || !strings.HasSuffix(got[0], "quic(down/up)=0 B/8 B") ||
+		!strings.HasPrefix(got[1], "AT ") || !strings.HasSuffix(got[1], "quic(down/up)=0 B/4 B") ||
+		!strings.HasPrefix(got[2], "DE ") || !strings.HasSuffix(got[2], "quic(down/up)=0 B/3 B") {
+		t.Fatalf("live section grouped by country:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestPrintStatsPrefixWithoutAnnotator(t *testing.T) {
+	l, mem, out := newTestLive(t, storage.GroupPrefix, nil)
+	add(t, mem, "192.0.2.1", bpfgo.SiaIPStats{QuicUp: 1})
+	add(t, mem, "192.0.2.2", bpfgo.SiaIPStats{QuicUp: 2})
+
+	l.printStats()
+	got := liveLines(out.String())
+	if len(got) != 1 || !strings.HasPrefix(got[0], "192.0.2.0/24 ") || !strings.HasSuffix(got[0], "0 B/3 B") {
+		t.Fatalf("live section grouped by prefix:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestPrintStatsAppliesPrivacy(t *testing.T) {
+	t.Setenv("PRIVACY_MODE", "truncate")
+	pol, err := privacy.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, mem, out := newTestLive(t, storage.GroupIP, nil)
+	l.pol = pol
+	add(t, mem, "192.0.2.1", bpfgo.SiaIPStats{QuicUp: 1})
+	add(t, mem, "192.0.2.2", bpfgo.SiaIPStats{QuicUp: 2})
+
+	l.printStats()
+	if strings.Contains(out.String(), "192.0.2.1") || strings.Contains(out.String(), "192.0.2.2") {
+		t.Fatalf("raw address printed:\n%s", out)
+	}
+	got := liveLines(out.String())
+	if len(got) != 1 || !strings.HasPrefix(got[0], "192.0.2.0/24 ") || !strings.HasSuffix(got[0], "0 B/3 B") {
+		t.Fatalf("live section with PRIVACY_MODE=truncate:\n%s", strings.Join(got, "\n"))
+	}
+}
@@ -5,16 +5,49 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/back2basic/collector/agg"
 	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/control"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/dns"
 	"github.com/back2basic/collector/live"
+	"github.com/back2basic/collector/privacy"
+	"github.com/back2basic/collector/privs"
+	"github.com/back2basic/collector/server"
 	"github.com/back2basic/collector/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "filter":
+			os.Exit(runFilter(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "agent":
+			os.Exit(runAgent(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "hostd":
+			os.Exit(runHostd(os.Args[2:]))
+		case "revenue":
+			os.Exit(runRevenue(os.Args[2:]))
+		case "server":
+			// central aggregation mode, no BPF
+			s, err := server.FromEnv()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Fatal(s.ListenAndServe())
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+	}
+
 	iface := os.Getenv("INTERFACE")
 	if iface == "" {
 		log.Fatal("missing INTERFACE in env file.")
@@ -26,44 +59,141 @@ func main() {
 		log.Fatalf("load BPF: %v", err)
 	}
 	// ensure handles and links are closed on exit
-	defer func() {
-		// small delay to allow final operations to complete
-		time.Sleep(100 * time.Millisecond)
+	defer h.Close()
+
+	startDNS()
+
+	// Programs are attached and the map FDs are open, root is no longer
+	// needed
+	dropPrivileges(h, privs.DBFiles(storage.Path)...)
+
+	// The BPF maps are the counter source for the workers below
+	if err := runWorkers(h, iface); err != nil {
 		h.Close()
-	}()
+		log.Fatal(err)
+	}
+}
 
-	// Start aggregator
-	ag := agg.New(h, storage.DB)
-	go ag.Run(1*time.Minute, 5*time.Minute)
+// startDNS restores the reverse DNS cache and starts background workers.
+func startDNS() {
+	if privacy.DropsDNS() {
+		// names identify peers too; none are kept on disk
+		if err := storage.ClearDNSCache(); err != nil {
+			log.Printf("dns: clear stored cache: %v", err)
+		}
+	} else if os.Getenv("DNS_CACHE_PERSIST") == "1" {
+		if err := dns.Persist(storage.DNSCache{}); err != nil {
+			log.Printf("dns: load cache: %v", err)
+		}
+	}
+	dns.StartFromEnv()
+}
 
-	// Start live dashboard
-	lv := live.New(h)
-	go lv.Run()
+// dropPrivileges switches to COLLECTOR_USER, if set, handing over the paths
+// in own, and checks that src is still readable. It logs the resulting
+// capabilities either way.
+func dropPrivileges(src counters.Source, own ...string) {
+	if name := os.Getenv("COLLECTOR_USER"); name != "" {
+		if err := privs.Drop(name, own...); err != nil {
+			log.Fatalf("drop privileges: %v", err)
+		}
+		if _, err := src.Snapshot(); err != nil {
+			log.Fatalf("read BPF maps after dropping privileges: %v (kernels before 6.5 need kernel.unprivileged_bpf_disabled=0)", err)
+		}
+	}
+	privs.LogCaps()
+}
 
-	// Wait for shutdown signal
+// runWorkers runs the aggregator, the live dashboard and the control API on
+// src until a shutdown signal, then flushes, pushes and resets the counters. It fails
+// when the aggregator configuration is invalid.
+func runWorkers(src counters.Source, iface string) error {
+	// Workers stop when a shutdown signal arrives
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	return serve(ctx, stop, src, iface)
+}
+
+// serve is runWorkers until ctx is done. stop is called once shutdown
+// starts, so a second signal kills the process.
+func serve(ctx context.Context, stop func(), src counters.Source, iface string) error {
+	ag, err := agg.New(src, storage.DB, iface)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+
+	// Start aggregator
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ag.Run(ctx, 1*time.Minute, 5*time.Minute)
+	}()
+
+	// Start live dashboard
+	lv := live.New(src, ag, ag.Privacy())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lv.Run(ctx)
+	}()
+
+	// Start the admin API (CONTROL_LISTEN)
+	api := control.FromEnv(src, ag)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		api.Run(ctx)
+	}()
 
 	<-ctx.Done()
-	log.Println("Received shutdown signal, flushing and cleaning up...")
+	stop() // a second signal kills the process
+	timeout := shutdownTimeout()
+	log.Printf("Received shutdown signal, flushing and cleaning up (timeout %s)...", timeout)
+
+	// 1) Let the workers finish their final flush and push, then drain the
+	// sink and alert queues
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		ag.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		// a flush may still be running, so leave the counters alone
+		log.Printf("shutdown: timed out after %s, counters not reset", timeout)
+		return nil
+	}
 
-	// 1) Persist current counters synchronously
-	// Aggregator exposes FlushOnce() (see suggested addition below).
-	ag.FlushOnce()
+	dns.Save()
 
-	// 2) Reset counters (zero values) using handles
-	if err := bpfgo.ResetCountersUsingHandles(h.IP4Stats, h.IP6Stats); err != nil {
+	// 2) Reset counters (zero values)
+	if err := src.Reset(); err != nil {
 		log.Printf("shutdown: reset counters: %v", err)
 	}
 
 	// 3) Cleanup zero entries only if maps are pinned (controlled by env)
 	// Set PINNED_MAPS=1 in env if you pin maps and want cleanup on shutdown.
 	if os.Getenv("PINNED_MAPS") == "1" {
-		if err := bpfgo.CleanupZeroEntriesUsingHandles(h.IP4Stats, h.IP6Stats); err != nil {
+		if err := src.Cleanup(); err != nil {
 			log.Printf("shutdown: cleanup zero entries: %v", err)
 		}
 	}
 
-	// 4) Close handles (deferred above) and exit
 	log.Println("shutdown: complete")
+	return nil
+}
+
+// shutdownTimeout returns SHUTDOWN_TIMEOUT, the time allowed for the final
+// flush and push (default 30s).
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid SHUTDOWN_TIMEOUT %q, using 30s", v)
+	}
+	return 30 * time.Second
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func TestServeFlushesAndResetsOnShutdown(t *testing.T) {
+	storagetest.Open(t)
+	t.Setenv("SIA_HOSTNAME", "host-a")
+	t.Setenv("SHUTDOWN_TIMEOUT", "10s")
+
+	mem := counters.NewMemory()
+	p, _ := model.ParsePeer("192.0.2.1")
+	mem.Add(p, bpfgo.SiaIPStats{SiamuxUp: 512, QuicDown: 64})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	stops := 0
+	go func() {
+		if err := serve(ctx, func() { stops++ }, mem, "lo"); err != nil {
+			t.Error(err)
+		}
+		close(stopped)
+	}()
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(15 * time.Second):
+		t.Fatal("serve did not return after the context was cancelled")
+	}
+
+	if stops != 1 {
+		t.Fatalf("stop called %d times, want once", stops)
+	}
+	recs, err := storage.QueryDailyTotalsBy(storage.GroupIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].SiamuxUp != 512 || recs[0].QuicDown != 64 {
+		t.Fatalf("stored after shutdown: %+v, want the final flush of 192.0.2.1", recs)
+	}
+	if snap, _ := mem.Snapshot(); len(snap) != 0 {
+		t.Fatalf("counters after shutdown: %v, want them reset", snap)
+	}
+	if n := mem.Len(); n != 1 {
+		t.Fatalf("%d peers left, want the zeroed peer kept without PINNED_MAPS", n)
+	}
+}
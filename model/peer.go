@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Peer identifies a remote host in the counters. It is the key of the
+// ip4_stats (4 bytes, network order) and ip6_stats (struct in6_addr) BPF
+// maps and marshals to exactly those encodings.
+type Peer struct {
+	netip.Addr
+}
+
+// PeerFrom returns the peer for addr. IPv4-mapped IPv6 addresses become
+// IPv4 peers and zones are dropped, so equal hosts compare equal.
+func PeerFrom(addr netip.Addr) Peer {
+	return Peer{addr.Unmap().WithZone("")}
+}
+
+// PeerFromIP converts a net.IP, reporting false for invalid input.
+func PeerFromIP(ip net.IP) (Peer, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Peer{}, false
+	}
+	return PeerFrom(addr), true
+}
+
+// ParsePeer parses an IPv4 or IPv6 address as stored in the ip column.
+func ParsePeer(s string) (Peer, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Peer{}, err
+	}
+	return PeerFrom(addr), nil
+}
+
+// IP returns the peer as a net.IP for the dns and geo packages.
+func (p Peer) IP() net.IP {
+	return net.IP(p.AsSlice())
+}
+
+// Family returns "IPv4" or "IPv6".
+func (p Peer) Family() string {
+	if p.Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// Less orders IPv4 peers before IPv6 peers, then by address.
+func (p Peer) Less(o Peer) bool {
+	return p.Addr.Less(o.Addr)
+}
+
+// MarshalBinary encodes p as a BPF map key.
+func (p Peer) MarshalBinary() ([]byte, error) {
+	if !p.IsValid() {
+		return nil, fmt.Errorf("invalid peer")
+	}
+	return p.AsSlice(), nil
+}
+
+// UnmarshalBinary decodes a 4 byte ip4_stats or 16 byte ip6_stats key. A
+// v4-mapped 16 byte key decodes to the IPv4 peer, as in PeerFrom.
+func (p *Peer) UnmarshalBinary(b []byte) error {
+	switch len(b) {
+	case 4:
+		*p = PeerFrom(netip.AddrFrom4([4]byte(b)))
+	case 16:
+		*p = PeerFrom(netip.AddrFrom16([16]byte(b)))
+	default:
+		return fmt.Errorf("peer key: unexpected length %d", len(b))
+	}
+	return nil
+}
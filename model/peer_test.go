@@ -0,0 +1,60 @@
+package model
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestPeerBinary(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		peer Peer
+		key  []byte
+		want string // peer after a round trip
+	}{
+		{"v4", PeerFrom(netip.MustParseAddr("192.0.2.1")),
+			[]byte{192, 0, 2, 1}, "192.0.2.1"},
+		{"v4-mapped v6", PeerFrom(netip.MustParseAddr("::ffff:192.0.2.1")),
+			[]byte{192, 0, 2, 1}, "192.0.2.1"},
+		{"v4-mapped v6 not normalised", Peer{netip.MustParseAddr("::ffff:192.0.2.1")},
+			[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1}, "192.0.2.1"},
+		{"v6", PeerFrom(netip.MustParseAddr("2001:db8::1")),
+			[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "2001:db8::1"},
+		{"v6 with zone", PeerFrom(netip.MustParseAddr("fe80::1%eth0")),
+			[]byte{0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "fe80::1"},
+		{"v6 with zone not normalised", Peer{netip.MustParseAddr("fe80::1%eth0")},
+			[]byte{0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "fe80::1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := tc.peer.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key, tc.key) {
+				t.Fatalf("MarshalBinary = %v, want %v", key, tc.key)
+			}
+
+			var got Peer
+			if err := got.UnmarshalBinary(key); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := ParsePeer(tc.want)
+			if got != want {
+				t.Fatalf("UnmarshalBinary = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPeerBinaryErrors(t *testing.T) {
+	if _, err := (Peer{}).MarshalBinary(); err == nil {
+		t.Error("zero peer marshalled")
+	}
+	for _, n := range []int{0, 3, 5, 15, 17} {
+		var p Peer
+		if err := p.UnmarshalBinary(make([]byte, n)); err == nil {
+			t.Errorf("%d byte key decoded to %v", n, p)
+		}
+	}
+}
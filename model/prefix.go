@@ -0,0 +1,67 @@
+package model
+
+import (
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+)
+
+// Default prefix lengths used when peers are rolled up per subnet.
+const (
+	DefaultPrefixV4 = 24
+	DefaultPrefixV6 = 48
+)
+
+// PrefixLen holds the IPv4 and IPv6 prefix lengths peers are grouped by.
+type PrefixLen struct {
+	V4 int
+	V6 int
+}
+
+// PrefixLenFromEnv reads AGG_PREFIX_V4 and AGG_PREFIX_V6, falling back to
+// /24 and /48 for missing or out of range values.
+func PrefixLenFromEnv() PrefixLen {
+	return PrefixLen{
+		V4: EnvBits("AGG_PREFIX_V4", DefaultPrefixV4, 32),
+		V6: EnvBits("AGG_PREFIX_V6", DefaultPrefixV6, 128),
+	}
+}
+
+// Of returns the masked prefix containing addr.
+func (l PrefixLen) Of(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := l.V6
+	if addr.Is4() {
+		bits = l.V4
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return p
+}
+
+// OfString is Of for a textual address. It returns "" if ip does not parse.
+func (l PrefixLen) OfString(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return l.Of(addr).String()
+}
+
+// EnvBits reads a prefix length of at most max bits from the environment
+// variable name, falling back to def for missing or out of range values.
+func EnvBits(name string, def, max int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > max {
+		log.Printf("invalid %s %q, using /%d", name, v, def)
+		return def
+	}
+	return n
+}
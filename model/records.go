@@ -1,38 +1,82 @@
 package model
 
-type TrafficRecord4 struct {
-	Key           uint32
-	IP            string
-	DNS           string
-	ConsensusUp   uint64
-	ConsensusDown uint64
-	SiamuxUp      uint64
-	SiamuxDown    uint64
-	QuicUp        uint64
-	QuicDown      uint64
-	Timestamp     int64
+// TrafficRecord is one row of the traffic table: the bytes counted for a
+// peer (or a whole prefix when AGG_MODE=prefix) during one flush interval.
+type TrafficRecord struct {
+	Hostname      string `json:"hostname"`  // SIA_HOSTNAME of the collector
+	Interface     string `json:"interface"` // interface the peer was seen on
+	IP            string `json:"ip"`
+	Prefix        string `json:"prefix"`
+	DNS           string `json:"dns"`
+	DNSVerified   int    `json:"dns_verified"` // dns.Verification of DNS
+	Country       string `json:"country"`
+	ASN           uint   `json:"asn"`
+	ASOrg         string `json:"as_org"`
+	RenterKey     string `json:"renter_key,omitempty"`  // from hostd, see HOSTD_API_URL
+	ContractID    string `json:"contract_id,omitempty"` // from hostd
+	ConsensusUp   uint64 `json:"consensus_up"`
+	ConsensusDown uint64 `json:"consensus_down"`
+	SiamuxUp      uint64 `json:"siamux_up"`
+	SiamuxDown    uint64 `json:"siamux_down"`
+	QuicUp        uint64 `json:"quic_up"`
+	QuicDown      uint64 `json:"quic_down"`
+	OtherUp       uint64 `json:"other_up"`
+	OtherDown     uint64 `json:"other_down"`
+	Timestamp     int64  `json:"timestamp"`
 }
 
-type TrafficRecord6 struct {
-	Key           [16]byte
-	IP            string
-	DNS           string
-	ConsensusUp   uint64
-	ConsensusDown uint64
-	SiamuxUp      uint64
-	SiamuxDown    uint64
-	QuicUp        uint64
-	QuicDown      uint64
-	Timestamp     int64
+// Add accumulates the counters of o into r. A renter or contract the two
+// records do not share is dropped.
+func (r *TrafficRecord) Add(o TrafficRecord) {
+	if r.RenterKey != o.RenterKey {
+		r.RenterKey = ""
+	}
+	if r.ContractID != o.ContractID {
+		r.ContractID = ""
+	}
+	r.ConsensusUp += o.ConsensusUp
+	r.ConsensusDown += o.ConsensusDown
+	r.SiamuxUp += o.SiamuxUp
+	r.SiamuxDown += o.SiamuxDown
+	r.QuicUp += o.QuicUp
+	r.QuicDown += o.QuicDown
+	r.OtherUp += o.OtherUp
+	r.OtherDown += o.OtherDown
 }
 
+// AggregatedRecord holds summed counters for one group. IP is the grouping
+// key: an address, a CIDR prefix when grouped by prefix, or the ASN,
+// country, renter key or contract ID of the other groupings.
 type AggregatedRecord struct {
-	IP            string
-	DNS           string
-	ConsensusUp   uint64
-	ConsensusDown uint64
-	SiamuxUp      uint64
-	SiamuxDown    uint64
-	QuicUp        uint64
-	QuicDown      uint64
+	IP            string `json:"ip"`
+	DNS           string `json:"dns"`
+	DNSVerified   int    `json:"dns_verified"`
+	Country       string `json:"country"`
+	ASN           uint   `json:"asn"`
+	ASOrg         string `json:"as_org"`
+	RenterKey     string `json:"renter_key,omitempty"`
+	ContractID    string `json:"contract_id,omitempty"`
+	ConsensusUp   uint64 `json:"consensus_up"`
+	ConsensusDown uint64 `json:"consensus_down"`
+	SiamuxUp      uint64 `json:"siamux_up"`
+	SiamuxDown    uint64 `json:"siamux_down"`
+	QuicUp        uint64 `json:"quic_up"`
+	QuicDown      uint64 `json:"quic_down"`
+	OtherUp       uint64 `json:"other_up"`
+	OtherDown     uint64 `json:"other_down"`
+}
+
+// PeerDay is the AggregatedRecord of one peer on one UTC day.
+type PeerDay struct {
+	Day string `json:"day"` // YYYY-MM-DD
+	AggregatedRecord
+}
+
+// HostSummary describes one collector reporting to a central server.
+type HostSummary struct {
+	Hostname  string `json:"hostname"`
+	LastSeen  int64  `json:"last_seen"` // unix time of the newest minute record
+	Peers     int    `json:"peers"`     // distinct peers today
+	TotalUp   uint64 `json:"total_up"`
+	TotalDown uint64 `json:"total_down"`
 }
@@ -0,0 +1,245 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+)
+
+// Modes selected with PRIVACY_MODE.
+const (
+	ModeOff      = ""
+	ModeHMAC     = "hmac"     // replace addresses with keyed pseudonyms
+	ModeTruncate = "truncate" // keep only the network of each address
+	ModeNoDNS    = "nodns"    // keep addresses, drop PTR names
+
+	// pseudonyms are prefixed so they are never mistaken for addresses
+	pseudonymPrefix = "anon-"
+
+	purgeEvery = time.Hour
+)
+
+// Policy rewrites peer identities before they leave the aggregator, so
+// SQLite, Appwrite and every sink see the same minimised values. A nil
+// *Policy leaves records untouched.
+type Policy struct {
+	Mode      string
+	Truncate  model.PrefixLen // PRIVACY_PREFIX_V4 / PRIVACY_PREFIX_V6
+	Retention time.Duration   // RAW_IP_RETENTION_DAYS, 0 keeps raw rows
+
+	key       []byte
+	lastPurge time.Time
+}
+
+// FromEnv reads PRIVACY_MODE, PRIVACY_KEY, PRIVACY_PREFIX_V4/V6 and
+// RAW_IP_RETENTION_DAYS. It returns nil when none is set.
+func FromEnv() (*Policy, error) {
+	p := &Policy{
+		Mode: os.Getenv("PRIVACY_MODE"),
+		key:  []byte(os.Getenv("PRIVACY_KEY")),
+		Truncate: model.PrefixLen{
+			V4: model.EnvBits("PRIVACY_PREFIX_V4", model.DefaultPrefixV4, 32),
+			V6: model.EnvBits("PRIVACY_PREFIX_V6", model.DefaultPrefixV6, 128),
+		},
+	}
+	if v := os.Getenv("RAW_IP_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid RAW_IP_RETENTION_DAYS %q", v)
+		}
+		p.Retention = time.Duration(n) * 24 * time.Hour
+	}
+
+	switch p.Mode {
+	case ModeOff:
+		if p.Retention == 0 {
+			return nil, nil
+		}
+	case ModeHMAC:
+		if len(p.key) < 16 {
+			return nil, fmt.Errorf("PRIVACY_MODE=hmac needs a PRIVACY_KEY of at least 16 bytes")
+		}
+	case ModeTruncate, ModeNoDNS:
+	default:
+		return nil, fmt.Errorf("unknown PRIVACY_MODE %q (want hmac, truncate or nodns)", p.Mode)
+	}
+	log.Printf("privacy: mode=%q retention=%s", p.Mode, p.Retention)
+	return p, nil
+}
+
+// DropsDNS reports whether PRIVACY_MODE asks for PTR names to be dropped,
+// for callers that run before the policy is loaded.
+func DropsDNS() bool {
+	return os.Getenv("PRIVACY_MODE") != ModeOff
+}
+
+// DropDNS reports whether PTR names must not be looked up or stored. Names
+// identify hosts as well as addresses do, so every mode drops them.
+func (p *Policy) DropDNS() bool {
+	return p != nil && p.Mode != ModeOff
+}
+
+// Apply rewrites the IP, Prefix and DNS of recs. Records that end up with
+// the same IP (truncation) are merged.
+func (p *Policy) Apply(recs []model.TrafficRecord) []model.TrafficRecord {
+	if p == nil || p.Mode == ModeOff {
+		return recs
+	}
+
+	out := make([]model.TrafficRecord, 0, len(recs))
+	index := make(map[string]int, len(recs))
+	for _, r := range recs {
+		r.IP, r.Prefix = p.rewrite(r.IP, r.Prefix)
+		r.DNS, r.DNSVerified = "", 0
+
+		if i, ok := index[r.IP]; ok {
+			out[i].Add(r)
+			continue
+		}
+		index[r.IP] = len(out)
+		out = append(out, r)
+	}
+	return out
+}
+
+// Label returns how peer is shown outside of storage.
+func (p *Policy) Label(peer model.Peer) string {
+	if p == nil {
+		return peer.String()
+	}
+	ip, _ := p.rewrite(peer.String(), "")
+	return ip
+}
+
+// rewrite maps an ip column value (an address or, with AGG_MODE=prefix, a
+// CIDR) and its prefix column.
+func (p *Policy) rewrite(ip, prefix string) (string, string) {
+	switch p.Mode {
+	case ModeHMAC:
+		return p.pseudonym(ip), p.pseudonym(prefix)
+	case ModeTruncate:
+		return p.truncate(ip), p.truncate(prefix)
+	}
+	return ip, prefix
+}
+
+func (p *Policy) pseudonym(s string) string {
+	if s == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(s))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// truncate masks an address or a longer prefix to the configured length.
+func (p *Policy) truncate(s string) string {
+	if s == "" {
+		return ""
+	}
+	var pfx netip.Prefix
+	if a, err := netip.ParseAddr(s); err == nil {
+		pfx = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+	} else if pfx, err = netip.ParsePrefix(s); err != nil {
+		// already rewritten, or not an address at all
+		return s
+	}
+	bits := p.Truncate.V6
+	if pfx.Addr().Is4() {
+		bits = p.Truncate.V4
+	}
+	if pfx.Bits() <= bits {
+		return pfx.Masked().String()
+	}
+	return netip.PrefixFrom(pfx.Addr(), bits).Masked().String()
+}
+
+// Purge rewrites stored rows older than the retention period that still
+// hold raw addresses, at most once an hour: traffic rows and queued
+// Appwrite rows. Without a mode that rewrites addresses they are
+// truncated. Expired reverse DNS cache rows are deleted, and every name
+// once a mode drops them.
+func (p *Policy) Purge(now time.Time) {
+	q, before, ok := p.purge(now)
+	if !ok {
+		return
+	}
+
+	n, err := storage.RewriteTrafficIPs(before.Unix(), q.rewrite)
+	if err != nil {
+		log.Printf("privacy: purge raw addresses: %v", err)
+	} else if n > 0 {
+		log.Printf("privacy: rewrote %d rows older than %s", n, p.Retention)
+	}
+
+	// outbox rows hold a whole day, so only days that ended before the cutoff
+	n, err = storage.RewriteOutboxIPs(before.Format("2006-01-02"), q.rewrite)
+	if err != nil {
+		log.Printf("privacy: purge Appwrite outbox: %v", err)
+	} else if n > 0 {
+		log.Printf("privacy: rewrote %d queued Appwrite rows older than %s", n, p.Retention)
+	}
+
+	if p.DropDNS() {
+		err = storage.ClearDNSCache()
+	} else {
+		_, err = storage.PurgeDNSCache(now.Unix())
+	}
+	if err != nil {
+		log.Printf("privacy: purge dns cache: %v", err)
+	}
+}
+
+// PurgeFleet is Purge for the fleet server: fleet_minute rows and the
+// record IDs derived from their addresses.
+func (p *Policy) PurgeFleet(now time.Time) {
+	q, before, ok := p.purge(now)
+	if !ok {
+		return
+	}
+	n, err := storage.RewriteFleetIPs(before.Unix(), q.rewrite)
+	if err != nil {
+		log.Printf("privacy: purge fleet rows: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("privacy: rewrote %d fleet rows older than %s", n, p.Retention)
+	}
+}
+
+// purge returns the policy used to rewrite old rows and the cutoff, and
+// false when no purge is due.
+func (p *Policy) purge(now time.Time) (*Policy, time.Time, bool) {
+	if p == nil || p.Retention == 0 || now.Sub(p.lastPurge) < purgeEvery {
+		return nil, time.Time{}, false
+	}
+	p.lastPurge = now
+
+	q := *p
+	if q.Mode != ModeHMAC {
+		q.Mode = ModeTruncate
+	}
+	return &q, now.Add(-p.Retention), true
+}
+
+// Minimises reports whether stored rows younger than d may hold rewritten
+// addresses instead of the peers' own, e.g. for quota blocks that act on
+// the stored totals of a period.
+func (p *Policy) Minimises(d time.Duration) bool {
+	if p == nil {
+		return false
+	}
+	if p.Mode == ModeHMAC || p.Mode == ModeTruncate {
+		return true
+	}
+	return p.Retention > 0 && p.Retention < d
+}
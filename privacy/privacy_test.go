@@ -0,0 +1,162 @@
+package privacy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func retentionPolicy(t *testing.T, env map[string]string) *Policy {
+	t.Helper()
+	t.Setenv("RAW_IP_RETENTION_DAYS", "1")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	p, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func column(t *testing.T, query string, args ...any) []string {
+	t.Helper()
+	rows, err := storage.DB.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestPurgeRewritesOldRows(t *testing.T) {
+	storagetest.Open(t)
+	p := retentionPolicy(t, nil)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour).Unix()
+
+	if err := storage.InsertTraffic(storage.DB, []model.TrafficRecord{
+		{IP: "192.0.2.1", DNS: "a.example.", QuicUp: 1, Timestamp: old},
+		{IP: "192.0.2.2", QuicUp: 2, Timestamp: old},
+		{IP: "192.0.2.3", QuicUp: 4, Timestamp: now.Unix()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for id, ip := range map[string]string{"old-1": "192.0.2.1", "old-2": "192.0.2.2"} {
+		payload, _ := json.Marshal(map[string]any{"hostname": "host-a", "ip": ip, "dns": "a.example.", "day": "2020-01-02", "up_9984_udp": 5})
+		if _, err := storage.DB.Exec(`INSERT INTO appwrite_outbox (row_id, payload) VALUES (?, ?)`, id, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload, _ := json.Marshal(map[string]any{"hostname": "host-a", "ip": "192.0.2.3", "day": now.Format("2006-01-02")})
+	storage.DB.Exec(`INSERT INTO appwrite_outbox (row_id, payload) VALUES ('today', ?)`, payload)
+	storage.DB.Exec(`INSERT INTO dns_cache (ip, name, expires) VALUES ('192.0.2.1', 'a.example.', ?), ('192.0.2.3', 'c.example.', ?)`,
+		old, now.Add(time.Hour).Unix())
+
+	p.Purge(now)
+
+	if ips := column(t, `SELECT DISTINCT ip FROM traffic ORDER BY ip`); len(ips) != 2 || ips[0] != "192.0.2.0/24" || ips[1] != "192.0.2.3" {
+		t.Fatalf("traffic ips = %v, want the old rows truncated", ips)
+	}
+	if dns := column(t, `SELECT COALESCE(dns, '') FROM traffic WHERE ip = '192.0.2.0/24' AND dns != ''`); len(dns) != 0 {
+		t.Fatalf("names kept on purged rows: %v", dns)
+	}
+
+	payloads := column(t, `SELECT payload FROM appwrite_outbox ORDER BY row_id = 'today'`)
+	if len(payloads) != 2 {
+		t.Fatalf("outbox = %v, want the old rows merged and today's kept", payloads)
+	}
+	var merged map[string]any
+	json.Unmarshal([]byte(payloads[0]), &merged)
+	if merged["ip"] != "192.0.2.0/24" || merged["dns"] != "" || merged["up_9984_udp"] != float64(10) {
+		t.Fatalf("merged outbox row = %v", merged)
+	}
+
+	if ips := column(t, `SELECT ip FROM dns_cache`); len(ips) != 1 || ips[0] != "192.0.2.3" {
+		t.Fatalf("dns cache = %v, want the expired row deleted", ips)
+	}
+}
+
+func TestPurgeDropsNamesWithMode(t *testing.T) {
+	storagetest.Open(t)
+	p := retentionPolicy(t, map[string]string{"PRIVACY_MODE": "nodns"})
+	storage.DB.Exec(`INSERT INTO dns_cache (ip, name, expires) VALUES ('192.0.2.3', 'c.example.', ?)`, time.Now().Add(time.Hour).Unix())
+
+	p.Purge(time.Now())
+	if ips := column(t, `SELECT ip FROM dns_cache`); len(ips) != 0 {
+		t.Fatalf("dns cache = %v, want it cleared", ips)
+	}
+}
+
+func TestPurgeFleet(t *testing.T) {
+	storagetest.Open(t)
+	if err := storage.InitFleet(); err != nil {
+		t.Fatal(err)
+	}
+	p := retentionPolicy(t, map[string]string{"PRIVACY_MODE": "hmac", "PRIVACY_KEY": "0123456789abcdef"})
+	now := time.Now()
+	old := now.Add(-48 * time.Hour).Truncate(time.Minute).Unix()
+
+	if err := storage.UpsertFleetMinute("host-a", []storage.FleetRecord{
+		{ID: "r1", TrafficRecord: model.TrafficRecord{IP: "192.0.2.1", Prefix: "192.0.2.0/24", DNS: "a.example.", QuicUp: 1, Timestamp: old}},
+		{ID: "r2", TrafficRecord: model.TrafficRecord{IP: "192.0.2.1", QuicUp: 1, Timestamp: now.Unix()}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// pretend r1 was seen when its row was written
+	storage.DB.Exec(`UPDATE fleet_seen SET timestamp = ? WHERE id = 'r1'`, old)
+
+	p.PurgeFleet(now)
+
+	ips := column(t, `SELECT ip FROM fleet_minute WHERE timestamp = ?`, old)
+	if len(ips) != 1 || ips[0] != p.pseudonym("192.0.2.1") {
+		t.Fatalf("old fleet rows = %v, want the pseudonym", ips)
+	}
+	if ips := column(t, `SELECT ip FROM fleet_minute WHERE timestamp > ?`, old); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("recent fleet rows = %v, want them kept", ips)
+	}
+	if prefixes := column(t, `SELECT prefix || dns FROM fleet_minute WHERE timestamp = ?`, old); prefixes[0] != p.pseudonym("192.0.2.0/24") {
+		t.Fatalf("old prefix and dns = %v", prefixes)
+	}
+	if ids := column(t, `SELECT id FROM fleet_seen`); len(ids) != 1 || ids[0] != "r2" {
+		t.Fatalf("fleet_seen = %v, want r1 forgotten", ids)
+	}
+}
+
+func TestPurgeFleetMergesTruncatedRows(t *testing.T) {
+	storagetest.Open(t)
+	if err := storage.InitFleet(); err != nil {
+		t.Fatal(err)
+	}
+	p := retentionPolicy(t, nil)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour).Truncate(time.Minute).Unix()
+
+	if err := storage.UpsertFleetMinute("host-a", []storage.FleetRecord{
+		{TrafficRecord: model.TrafficRecord{IP: "192.0.2.1", QuicUp: 1, Timestamp: old}},
+		{TrafficRecord: model.TrafficRecord{IP: "192.0.2.2", QuicUp: 2, Timestamp: old}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.PurgeFleet(now)
+	recs, err := storage.QueryFleetTotals(time.Unix(old, 0).UTC().Truncate(24*time.Hour), storage.GroupIP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].IP != "192.0.2.0/24" || recs[0].QuicUp != 3 {
+		t.Fatalf("fleet totals = %+v, want one summed /24", recs)
+	}
+}
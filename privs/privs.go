@@ -0,0 +1,212 @@
+package privs
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNames indexes capability numbers, see capability.h.
+var capNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER",
+	"CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// Caps is a capability bit set as shown in /proc/<pid>/status.
+type Caps uint64
+
+// String lists the capability names, "none" for an empty set.
+func (c Caps) String() string {
+	if c == 0 {
+		return "none"
+	}
+	var names []string
+	for i := 0; i < 64; i++ {
+		if c&(1<<i) == 0 {
+			continue
+		}
+		if i < len(capNames) {
+			names = append(names, capNames[i])
+		} else {
+			names = append(names, "cap_"+strconv.Itoa(i))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Drop switches every thread of the process to name (COLLECTOR_USER) and
+// its primary group, or to COLLECTOR_GROUP when set. Leaving root clears
+// all capabilities; open map, program and link FDs stay usable. Each path
+// in own (e.g. the SQLite database and its directory) that exists is
+// chowned first so the unprivileged process can keep writing it.
+func Drop(name string, own ...string) error {
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: uid %q", name, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: gid %q", name, u.Gid)
+	}
+	if g := os.Getenv("COLLECTOR_GROUP"); g != "" {
+		if gid, err = LookupGroup(g); err != nil {
+			return err
+		}
+	}
+	if uid == 0 {
+		return fmt.Errorf("user %s is root", name)
+	}
+
+	for _, p := range own {
+		if err := os.Chown(p, uid, gid); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("chown %s: %w", p, err)
+		}
+	}
+
+	// Go applies these to all threads; the group calls must come first
+	// because they need CAP_SETGID
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+
+	log.Printf("privs: running as %s (uid=%d gid=%d)", u.Username, uid, gid)
+	return nil
+}
+
+// DBFiles returns the SQLite database at path, its journal and WAL files
+// and its directory, the paths Drop needs to hand over.
+func DBFiles(path string) []string {
+	return []string{
+		filepath.Dir(path),
+		path,
+		path + "-journal",
+		path + "-wal",
+		path + "-shm",
+	}
+}
+
+// Effective returns the effective capabilities of every thread of the
+// process, keyed by thread id.
+func Effective() (map[int]Caps, error) {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]Caps, len(tasks))
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		c, err := readCapEff(filepath.Join("/proc/self/task", t.Name(), "status"))
+		if err != nil {
+			// threads may exit while we read
+			continue
+		}
+		out[tid] = c
+	}
+	return out, nil
+}
+
+// LogCaps logs the uid and effective capability set and warns when
+// threads disagree, which means a capability change did not reach all of
+// them.
+func LogCaps() {
+	per, err := Effective()
+	if err != nil {
+		log.Printf("privs: read capabilities: %v", err)
+		return
+	}
+
+	var all Caps
+	mixed := false
+	first := true
+	for _, c := range per {
+		if !first && c != all {
+			mixed = true
+		}
+		all |= c
+		first = false
+	}
+
+	log.Printf("privs: uid=%d gid=%d CapEff=%016x (%s)", os.Getuid(), os.Getgid(), uint64(all), all)
+	if mixed {
+		log.Printf("WARNING: privs: threads have different capability sets: %v", per)
+	}
+}
+
+func readCapEff(path string) (Caps, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		v, ok := strings.CutPrefix(sc.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse CapEff %q: %w", v, err)
+		}
+		return Caps(n), nil
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in %s", path)
+}
+
+// lookupUser accepts a user name or a numeric uid.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, nerr := strconv.Atoi(name); nerr == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("lookup user %s: %w", name, err)
+}
+
+// LookupGroup accepts a group name or a numeric gid.
+func LookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("lookup group %s: %w", name, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
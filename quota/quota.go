@@ -0,0 +1,458 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/alert"
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+)
+
+// Quota scopes.
+const (
+	ScopeIP     = "ip"
+	ScopePrefix = "prefix"
+	ScopeHost   = "host"
+)
+
+// Quota periods. Both start at UTC midnight, like the daily totals.
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// Actions taken on a breach (QUOTA_ACTIONS).
+const (
+	ActionLog     = "log"
+	ActionWebhook = "webhook"
+	ActionBlock   = "block" // ip and prefix scopes only
+)
+
+// Directions counted against a quota (QUOTA_DIRECTION).
+const (
+	DirUp    = "up" // egress, what hosts pay for
+	DirDown  = "down"
+	DirTotal = "total"
+)
+
+// Rule limits the bytes of every subject in Scope over Period.
+type Rule struct {
+	Scope  string
+	Period string
+	Limit  uint64
+}
+
+func (r Rule) String() string {
+	return r.Period + " " + r.Scope + " quota"
+}
+
+// Config is the set of rules and what to do on a breach.
+type Config struct {
+	Rules     []Rule
+	Direction string
+	Actions   map[string]bool
+	Webhook   string
+}
+
+// Engine checks the stored totals against the rules.
+type Engine struct {
+	cfg      Config
+	hostname string
+	h        *bpfgo.Handles
+	outputs  []alert.Output
+	breached map[string]time.Time // subject key -> period start acted on
+	drops    uint64
+}
+
+// New returns an engine for cfg. It returns nil when there are no rules; a
+// nil *Engine ignores all calls. h may be nil when nothing is blocked.
+func New(cfg Config, hostname string, h *bpfgo.Handles) *Engine {
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+	if cfg.Direction == "" {
+		cfg.Direction = DirUp
+	}
+	e := &Engine{
+		cfg:      cfg,
+		hostname: hostname,
+		h:        h,
+		breached: make(map[string]time.Time),
+	}
+	if cfg.Actions[ActionLog] {
+		e.outputs = append(e.outputs, alert.Log{})
+	}
+	if cfg.Actions[ActionWebhook] {
+		if cfg.Webhook == "" {
+			log.Println("quota: webhook action without QUOTA_WEBHOOK, ignored")
+		} else {
+			e.outputs = append(e.outputs, &alert.Webhook{URL: cfg.Webhook})
+		}
+	}
+	for _, r := range cfg.Rules {
+		log.Printf("quota: %s of %d bytes (%s)", r, r.Limit, cfg.Direction)
+		if r.Scope == ScopeHost && cfg.Actions[ActionBlock] {
+			log.Printf("quota: %s cannot block, only ip and prefix quotas can", r)
+		}
+	}
+	return e
+}
+
+// BlockSpan returns the longest period an ip or prefix quota blocks over,
+// or 0 when breaches never block. A nil *Engine blocks nothing.
+func (e *Engine) BlockSpan() time.Duration {
+	if e == nil || !e.cfg.Actions[ActionBlock] {
+		return 0
+	}
+	var span time.Duration
+	for _, r := range e.cfg.Rules {
+		if r.Scope == ScopeHost {
+			continue
+		}
+		d := 24 * time.Hour
+		if r.Period == PeriodMonthly {
+			d = 31 * 24 * time.Hour // the longest month
+		}
+		if d > span {
+			span = d
+		}
+	}
+	return span
+}
+
+// FromEnv reads QUOTA_{IP,PREFIX,HOST}_{DAILY,MONTHLY}, QUOTA_DIRECTION,
+// QUOTA_ACTIONS and QUOTA_WEBHOOK.
+func FromEnv(hostname string, h *bpfgo.Handles) *Engine {
+	cfg := Config{
+		Direction: strings.ToLower(os.Getenv("QUOTA_DIRECTION")),
+		Actions:   make(map[string]bool),
+		Webhook:   os.Getenv("QUOTA_WEBHOOK"),
+	}
+	switch cfg.Direction {
+	case "":
+		cfg.Direction = DirUp
+	case DirUp, DirDown, DirTotal:
+	default:
+		log.Printf("quota: unknown QUOTA_DIRECTION %q, using %s", cfg.Direction, DirUp)
+		cfg.Direction = DirUp
+	}
+
+	actions := os.Getenv("QUOTA_ACTIONS")
+	if actions == "" {
+		actions = ActionLog
+	}
+	for _, a := range strings.Split(actions, ",") {
+		switch a = strings.ToLower(strings.TrimSpace(a)); a {
+		case ActionLog, ActionWebhook, ActionBlock:
+			cfg.Actions[a] = true
+		case "":
+		default:
+			log.Printf("quota: unknown action %q in QUOTA_ACTIONS", a)
+		}
+	}
+
+	for _, scope := range []string{ScopeIP, ScopePrefix, ScopeHost} {
+		for _, period := range []string{PeriodDaily, PeriodMonthly} {
+			env := "QUOTA_" + strings.ToUpper(scope) + "_" + strings.ToUpper(period)
+			v := os.Getenv(env)
+			if v == "" {
+				continue
+			}
+			limit, err := ParseSize(v)
+			if err != nil || limit == 0 {
+				log.Printf("quota: invalid value for %s: %q", env, v)
+				continue
+			}
+			cfg.Rules = append(cfg.Rules, Rule{Scope: scope, Period: period, Limit: limit})
+		}
+	}
+	return New(cfg, hostname, h)
+}
+
+// Check lifts blocks whose period has ended and then compares every rule
+// against the totals stored since the start of its period.
+func (e *Engine) Check(now time.Time) {
+	if e == nil {
+		return
+	}
+	now = now.UTC()
+
+	e.liftExpired(now)
+	e.logDrops()
+
+	for _, r := range e.cfg.Rules {
+		start, end := periodBounds(r.Period, now)
+
+		group := map[string]string{
+			ScopeIP:     storage.GroupIP,
+			ScopePrefix: storage.GroupPrefix,
+			ScopeHost:   storage.GroupHost,
+		}[r.Scope]
+		rows, err := storage.QueryHostTotalsSince(e.hostname, group, start)
+		if err != nil {
+			log.Printf("quota: %s: query totals: %v", r, err)
+			continue
+		}
+
+		if r.Scope == ScopeHost {
+			// legacy rows without a hostname come back as a second group
+			var total model.AggregatedRecord
+			for _, row := range rows {
+				addRecord(&total, row)
+			}
+			total.IP = e.hostname
+			rows = []model.AggregatedRecord{total}
+		}
+
+		for _, row := range rows {
+			used := e.bytes(row)
+			if used <= r.Limit {
+				continue
+			}
+			key := r.Scope + ":" + r.Period + ":" + row.IP
+			if acted, ok := e.breached[key]; ok && acted.Equal(start) {
+				continue
+			}
+			e.breached[key] = start
+			e.breach(r, row.IP, used, end)
+		}
+	}
+
+	// forget breaches from earlier periods
+	for key, start := range e.breached {
+		if _, end := periodBounds(PeriodMonthly, start); !now.Before(end) {
+			delete(e.breached, key)
+		}
+	}
+}
+
+// breach runs the configured actions for subject.
+func (e *Engine) breach(r Rule, subject string, used uint64, until time.Time) {
+	msg := fmt.Sprintf("%s %s exceeded: %s of %s %s", subject, r, human(used), human(r.Limit), e.cfg.Direction)
+
+	if e.cfg.Actions[ActionBlock] && r.Scope != ScopeHost {
+		blocked, err := e.block(subject, r.String(), until)
+		switch {
+		case err != nil:
+			log.Printf("quota: block %s: %v", subject, err)
+		case !blocked:
+			// already blocked before a restart; don't notify again
+			return
+		default:
+			msg += ", new connections blocked until " + until.Format(time.RFC3339)
+		}
+	}
+
+	e.notify(alert.Alert{
+		Key:       "quota:" + r.Scope + ":" + r.Period + ":" + subject,
+		Rule:      "quota_" + r.Period + "_" + r.Scope,
+		State:     alert.Firing,
+		Hostname:  e.hostname,
+		Subject:   subject,
+		Class:     e.cfg.Direction,
+		Value:     float64(used),
+		Threshold: float64(r.Limit),
+		Message:   msg,
+		Time:      time.Now(),
+	})
+}
+
+// block adds subject to the BPF blocklist until the end of the period. It
+// returns false when the quota engine had already blocked it, e.g. before a
+// restart.
+func (e *Engine) block(subject, reason string, until time.Time) (bool, error) {
+	p, err := bpfgo.ParsePrefix(subject)
+	if err != nil {
+		return false, err
+	}
+	// never record a block that cannot be applied
+	f, err := e.filters()
+	if err != nil {
+		return false, err
+	}
+	already, err := storage.QuotaBlocked(p.String())
+	if err != nil {
+		return false, err
+	}
+
+	// record first so a crash never leaves an entry nobody will lift; a
+	// longer period extends an existing block
+	if err := storage.AddQuotaBlock(p.String(), reason, until.Unix()); err != nil {
+		return false, err
+	}
+	if already {
+		return false, nil
+	}
+
+	if err := f.Add(bpfgo.FilterBlock, p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// liftExpired removes blocks whose quota period has ended. Only an engine
+// holding the BPF maps lifts them; others leave the rows to it.
+func (e *Engine) liftExpired(now time.Time) {
+	if e.h == nil {
+		return
+	}
+	expired, err := storage.ExpiredQuotaBlocks(now.Unix())
+	if err != nil {
+		log.Printf("quota: expired blocks: %v", err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	f, err := e.filters()
+	if err != nil {
+		log.Printf("quota: lift blocks: %v", err)
+		return
+	}
+	for _, s := range expired {
+		p, err := bpfgo.ParsePrefix(s)
+		if err == nil {
+			// an entry removed by hand is fine
+			if err := f.Remove(bpfgo.FilterBlock, p); err != nil && !errors.Is(err, bpfgo.ErrNotInList) {
+				log.Printf("quota: unblock %s: %v", s, err)
+				continue
+			}
+		}
+		if err := storage.RemoveQuotaBlock(s); err != nil {
+			log.Printf("quota: forget block %s: %v", s, err)
+			continue
+		}
+		e.notify(alert.Alert{
+			Key:      "quota:block:" + s,
+			Rule:     "quota",
+			State:    alert.Resolved,
+			Hostname: e.hostname,
+			Subject:  s,
+			Message:  s + " quota period ended, unblocked",
+			Time:     time.Now(),
+		})
+	}
+}
+
+// logDrops logs how many packets the blocklist dropped since the last check.
+func (e *Engine) logDrops() {
+	if e.h == nil {
+		return
+	}
+	n, err := e.h.BlockDrops()
+	if err != nil {
+		log.Printf("quota: %v", err)
+		return
+	}
+	if n > e.drops {
+		log.Printf("quota: blocklist dropped %d new connection packets", n-e.drops)
+	}
+	e.drops = n
+}
+
+func (e *Engine) filters() (*bpfgo.Filters, error) {
+	if e.h == nil {
+		return nil, fmt.Errorf("no BPF handles")
+	}
+	return e.h.Filters()
+}
+
+func (e *Engine) notify(a alert.Alert) {
+	for _, o := range e.outputs {
+		if err := o.Send(a); err != nil {
+			log.Printf("quota: %s: %v", o.Name(), err)
+		}
+	}
+}
+
+func (e *Engine) bytes(r model.AggregatedRecord) uint64 {
+	up := r.ConsensusUp + r.SiamuxUp + r.QuicUp + r.OtherUp
+	down := r.ConsensusDown + r.SiamuxDown + r.QuicDown + r.OtherDown
+	switch e.cfg.Direction {
+	case DirDown:
+		return down
+	case DirTotal:
+		return up + down
+	default:
+		return up
+	}
+}
+
+func addRecord(dst *model.AggregatedRecord, r model.AggregatedRecord) {
+	dst.ConsensusUp += r.ConsensusUp
+	dst.ConsensusDown += r.ConsensusDown
+	dst.SiamuxUp += r.SiamuxUp
+	dst.SiamuxDown += r.SiamuxDown
+	dst.QuicUp += r.QuicUp
+	dst.QuicDown += r.QuicDown
+	dst.OtherUp += r.OtherUp
+	dst.OtherDown += r.OtherDown
+}
+
+// periodBounds returns the UTC start and end of the period containing t.
+func periodBounds(period string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	if period == PeriodMonthly {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a byte count such as "500GB", "2TiB" or "1048576".
+func ParseSize(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(f * float64(mult)), nil
+}
+
+func human(b uint64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,218 @@
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/alert"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"1048576", 1048576, true},
+		{"500GB", 500e9, true},
+		{"500 gb", 500e9, true},
+		{"2TiB", 2 << 40, true},
+		{"1.5k", 1500, true},
+		{" 10M ", 10e6, true},
+		{"7b", 7, true},
+		{"10 xb", 0, false},
+		{"GB", 0, false},
+		{"-5GB", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseSize(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok=%v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPeriodBounds(t *testing.T) {
+	utc := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, time.UTC) }
+	// 05:00 on the 16th in UTC+10 is still the 15th in UTC
+	east := time.Date(2024, 3, 16, 5, 0, 0, 0, time.FixedZone("UTC+10", 10*3600))
+
+	for _, tc := range []struct {
+		period     string
+		at         time.Time
+		start, end time.Time
+	}{
+		{PeriodDaily, utc(2024, 3, 15, 13), utc(2024, 3, 15, 0), utc(2024, 3, 16, 0)},
+		{PeriodDaily, utc(2024, 12, 31, 23), utc(2024, 12, 31, 0), utc(2025, 1, 1, 0)},
+		{PeriodDaily, east, utc(2024, 3, 15, 0), utc(2024, 3, 16, 0)},
+		{PeriodMonthly, utc(2024, 3, 15, 13), utc(2024, 3, 1, 0), utc(2024, 4, 1, 0)},
+		{PeriodMonthly, utc(2024, 2, 29, 12), utc(2024, 2, 1, 0), utc(2024, 3, 1, 0)},
+		{PeriodMonthly, utc(2024, 12, 31, 23), utc(2024, 12, 1, 0), utc(2025, 1, 1, 0)},
+		{PeriodMonthly, time.Date(2024, 4, 1, 2, 0, 0, 0, time.FixedZone("UTC+10", 10*3600)), utc(2024, 3, 1, 0), utc(2024, 4, 1, 0)},
+	} {
+		start, end := periodBounds(tc.period, tc.at)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) || start.Location() != time.UTC {
+			t.Errorf("periodBounds(%s, %s) = %s, %s; want %s, %s", tc.period, tc.at, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestBlockSpan(t *testing.T) {
+	block := map[string]bool{ActionBlock: true}
+	for _, tc := range []struct {
+		name  string
+		rules []Rule
+		acts  map[string]bool
+		want  time.Duration
+	}{
+		{"log only", []Rule{{ScopeIP, PeriodMonthly, 1}}, map[string]bool{ActionLog: true}, 0},
+		{"daily ip", []Rule{{ScopeIP, PeriodDaily, 1}}, block, 24 * time.Hour},
+		{"monthly prefix", []Rule{{ScopeIP, PeriodDaily, 1}, {ScopePrefix, PeriodMonthly, 1}}, block, 31 * 24 * time.Hour},
+		{"host never blocks", []Rule{{ScopeHost, PeriodMonthly, 1}}, block, 0},
+	} {
+		e := New(Config{Rules: tc.rules, Actions: tc.acts}, "host-a", nil)
+		if got := e.BlockSpan(); got != tc.want {
+			t.Errorf("%s: BlockSpan = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	if (*Engine)(nil).BlockSpan() != 0 {
+		t.Error("nil engine blocks")
+	}
+}
+
+// recorder is an alert.Output keeping every alert it is sent.
+type recorder struct {
+	mu     sync.Mutex
+	alerts []alert.Alert
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Send(a alert.Alert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+// fired returns the sent alerts as sorted "state rule subject" strings.
+func (r *recorder) fired() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for _, a := range r.alerts {
+		out = append(out, a.State+" "+a.Rule+" "+a.Subject)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func newTestEngine(t *testing.T, cfg Config) (*Engine, *recorder) {
+	t.Helper()
+	e := New(cfg, "host-a", nil)
+	if e == nil {
+		t.Fatal("no engine")
+	}
+	rec := &recorder{}
+	e.outputs = []alert.Output{rec}
+	return e, rec
+}
+
+func insert(t *testing.T, recs ...model.TrafficRecord) {
+	t.Helper()
+	if err := storage.InsertTraffic(storage.DB, recs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	now := time.Now().UTC()
+	start, _ := periodBounds(PeriodDaily, now)
+
+	rules := []Rule{
+		{ScopeIP, PeriodDaily, 1000},
+		{ScopePrefix, PeriodDaily, 1500},
+		{ScopeHost, PeriodDaily, 3000},
+	}
+	for _, tc := range []struct {
+		direction string
+		want      []string
+	}{
+		{DirUp, []string{
+			"firing quota_daily_ip 192.0.2.1",
+			"firing quota_daily_prefix 192.0.2.0/24",
+		}},
+		{DirDown, []string{
+			"firing quota_daily_host host-a",
+			"firing quota_daily_ip 198.51.100.1",
+			"firing quota_daily_prefix 198.51.100.0/24",
+		}},
+		{DirTotal, []string{
+			"firing quota_daily_host host-a",
+			"firing quota_daily_ip 192.0.2.1",
+			"firing quota_daily_ip 198.51.100.1",
+			"firing quota_daily_prefix 192.0.2.0/24",
+			"firing quota_daily_prefix 198.51.100.0/24",
+		}},
+	} {
+		t.Run(tc.direction, func(t *testing.T) {
+			storagetest.Open(t)
+			insert(t,
+				model.TrafficRecord{Hostname: "host-a", IP: "192.0.2.1", Prefix: "192.0.2.0/24", QuicUp: 600, SiamuxUp: 600, Timestamp: now.Unix()},
+				model.TrafficRecord{Hostname: "host-a", IP: "192.0.2.2", Prefix: "192.0.2.0/24", SiamuxUp: 800, Timestamp: now.Unix()},
+				model.TrafficRecord{Hostname: "host-a", IP: "198.51.100.1", Prefix: "198.51.100.0/24", QuicUp: 900, QuicDown: 5000, Timestamp: now.Unix()},
+				// before the period and from another host: not counted
+				model.TrafficRecord{Hostname: "host-a", IP: "203.0.113.1", Prefix: "203.0.113.0/24", QuicUp: 1 << 30, QuicDown: 1 << 30, Timestamp: start.Unix() - 1},
+				model.TrafficRecord{Hostname: "host-b", IP: "203.0.113.2", Prefix: "203.0.113.0/24", QuicUp: 1 << 30, QuicDown: 1 << 30, Timestamp: now.Unix()},
+			)
+
+			e, rec := newTestEngine(t, Config{Rules: rules, Direction: tc.direction})
+			e.Check(now)
+			if got := rec.fired(); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("alerts = %q, want %q", got, tc.want)
+			}
+
+			// one notification per subject and period
+			e.Check(now.Add(time.Second))
+			if n := len(rec.fired()); n != len(tc.want) {
+				t.Fatalf("%d alerts after a second check, want %d", n, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestBlockWithoutHandles(t *testing.T) {
+	storagetest.Open(t)
+	now := time.Now().UTC()
+	insert(t, model.TrafficRecord{Hostname: "host-a", IP: "192.0.2.1", Prefix: "192.0.2.0/24", QuicUp: 2000, Timestamp: now.Unix()})
+	// a block left by the daemon whose period has ended
+	if err := storage.AddQuotaBlock("198.51.100.1/32", "daily ip quota", now.Add(-time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	e, rec := newTestEngine(t, Config{
+		Rules:   []Rule{{ScopeIP, PeriodDaily, 1000}},
+		Actions: map[string]bool{ActionBlock: true},
+	})
+	e.Check(now)
+
+	// the breach is still reported, but not recorded as a block nobody can
+	// apply or lift
+	if got := rec.fired(); len(got) != 1 || got[0] != "firing quota_daily_ip 192.0.2.1" {
+		t.Fatalf("alerts = %q", got)
+	}
+	if blocked, err := storage.QuotaBlocked("192.0.2.1/32"); err != nil || blocked {
+		t.Fatalf("QuotaBlocked = %v, %v; want no block without BPF handles", blocked, err)
+	}
+	// the expired block stays for the engine holding the maps
+	expired, err := storage.ExpiredQuotaBlocks(now.Unix())
+	if err != nil || len(expired) != 1 || expired[0] != "198.51.100.1/32" {
+		t.Fatalf("expired blocks = %v, %v", expired, err)
+	}
+}
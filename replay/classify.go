@@ -0,0 +1,259 @@
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	ethPIP   = 0x0800
+	ethPIPv6 = 0x86dd
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// Traffic classes, as returned by classify() in prog.c.
+const (
+	ClassNone = iota
+	ClassConsensus
+	ClassSiamux
+	ClassQuic
+	ClassOther
+)
+
+// Ports are the host ports of each class (port_config in prog.c).
+type Ports struct {
+	Consensus uint16
+	Siamux    uint16
+	Quic      uint16
+}
+
+// Classifier applies the rules of prog.c to captured packets.
+//
+// The BPF programs know the direction from the hook they run in. A capture
+// does not, so a packet is egress when its source is one of Local, or,
+// without Local addresses, when its source port is a Sia port. Traffic on
+// other ports (COUNT_OTHER) can only be attributed with Local set.
+type Classifier struct {
+	Ports      Ports
+	CountOther bool
+	Local      map[netip.Addr]bool
+	Deny       []netip.Prefix
+	Allow      []netip.Prefix
+}
+
+// ClassifierFromEnv configures the classifier like the loader configures
+// prog.c: PORT_SIA_CONSENSUS, PORT_RHP4_SIAMUX, PORT_RHP4_QUIC (defaulting
+// to 9981/9984/9984 here), COUNT_OTHER, CIDR_DENY and CIDR_ALLOW.
+func ClassifierFromEnv() (*Classifier, error) {
+	c := &Classifier{
+		Ports:      Ports{Consensus: 9981, Siamux: 9984, Quic: 9984},
+		CountOther: os.Getenv("COUNT_OTHER") == "1",
+		Local:      make(map[netip.Addr]bool),
+	}
+	for _, p := range []struct {
+		env string
+		dst *uint16
+	}{
+		{"PORT_SIA_CONSENSUS", &c.Ports.Consensus},
+		{"PORT_RHP4_SIAMUX", &c.Ports.Siamux},
+		{"PORT_RHP4_QUIC", &c.Ports.Quic},
+	} {
+		if v := os.Getenv(p.env); v != "" {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", p.env, err)
+			}
+			*p.dst = uint16(n)
+		}
+	}
+
+	var err error
+	if c.Deny, err = bpfgo.ParsePrefixList(os.Getenv("CIDR_DENY")); err != nil {
+		return nil, fmt.Errorf("invalid value for CIDR_DENY: %v", err)
+	}
+	if c.Allow, err = bpfgo.ParsePrefixList(os.Getenv("CIDR_ALLOW")); err != nil {
+		return nil, fmt.Errorf("invalid value for CIDR_ALLOW: %v", err)
+	}
+	return c, nil
+}
+
+// classify mirrors classify() in prog.c.
+func (c *Classifier) classify(proto uint8, sport, dport uint16, egress bool) int {
+	port := dport
+	if egress {
+		port = sport
+	}
+
+	switch proto {
+	case protoTCP:
+		if port == c.Ports.Consensus {
+			return ClassConsensus
+		}
+		if port == c.Ports.Siamux {
+			return ClassSiamux
+		}
+	case protoUDP:
+		if port == c.Ports.Quic {
+			return ClassQuic
+		}
+	}
+
+	if c.CountOther {
+		return ClassOther
+	}
+	return ClassNone
+}
+
+// allowed mirrors peer_allowed4/6.
+func (c *Classifier) allowed(peer netip.Addr) bool {
+	for _, p := range c.Deny {
+		if p.Contains(peer) {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, p := range c.Allow {
+		if p.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// direction decides whether the packet was sent by the host.
+func (c *Classifier) direction(src, dst netip.Addr, proto uint8, sport, dport uint16) (egress, ok bool) {
+	if len(c.Local) > 0 {
+		switch {
+		case c.Local[src]:
+			return true, true
+		case c.Local[dst]:
+			return false, true
+		}
+		return false, false
+	}
+
+	sia := func(class int) bool { return class != ClassNone && class != ClassOther }
+	switch {
+	case sia(c.classify(proto, sport, dport, true)):
+		return true, true
+	case sia(c.classify(proto, sport, dport, false)):
+		return false, true
+	}
+	return false, false
+}
+
+// Account adds one captured packet to mem. It returns false when the
+// packet was not counted.
+func (c *Classifier) Account(mem *counters.Memory, ip []byte, ethType uint16, wire uint64) bool {
+	var (
+		src, dst netip.Addr
+		proto    uint8
+		l4       []byte
+	)
+
+	switch ethType {
+	case ethPIP:
+		if len(ip) < 20 {
+			return false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return false
+		}
+		proto = ip[9]
+		src = netip.AddrFrom4([4]byte(ip[12:16]))
+		dst = netip.AddrFrom4([4]byte(ip[16:20]))
+		l4 = ip[ihl:]
+	case ethPIPv6:
+		// like prog.c, extension headers are not walked
+		if len(ip) < 40 {
+			return false
+		}
+		proto = ip[6]
+		src = netip.AddrFrom16([16]byte(ip[8:24]))
+		dst = netip.AddrFrom16([16]byte(ip[24:40]))
+		l4 = ip[40:]
+	default:
+		return false
+	}
+
+	var sport, dport uint16
+	switch proto {
+	case protoTCP:
+		if len(l4) < 20 {
+			return false
+		}
+	case protoUDP:
+		if len(l4) < 8 {
+			return false
+		}
+	default:
+		return false
+	}
+	sport = binary.BigEndian.Uint16(l4[0:2])
+	dport = binary.BigEndian.Uint16(l4[2:4])
+
+	egress, ok := c.direction(src, dst, proto, sport, dport)
+	if !ok {
+		return false
+	}
+
+	class := c.classify(proto, sport, dport, egress)
+	if class == ClassNone {
+		return false
+	}
+
+	peer := src
+	if egress {
+		peer = dst
+	}
+	if !c.allowed(peer) {
+		return false
+	}
+
+	var st bpfgo.SiaIPStats
+	addBytes(&st, class, wire, egress)
+	mem.Add(model.PeerFrom(peer), st)
+	return true
+}
+
+// addBytes mirrors add_bytes in prog.c.
+func addBytes(st *bpfgo.SiaIPStats, class int, bytes uint64, egress bool) {
+	switch class {
+	case ClassConsensus:
+		if egress {
+			st.ConsensusUp += bytes
+		} else {
+			st.ConsensusDown += bytes
+		}
+	case ClassSiamux:
+		if egress {
+			st.SiamuxUp += bytes
+		} else {
+			st.SiamuxDown += bytes
+		}
+	case ClassQuic:
+		if egress {
+			st.QuicUp += bytes
+		} else {
+			st.QuicDown += bytes
+		}
+	case ClassOther:
+		if egress {
+			st.OtherUp += bytes
+		} else {
+			st.OtherDown += bytes
+		}
+	}
+}
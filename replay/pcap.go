@@ -0,0 +1,147 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types understood by Reader (see pcap-linktype(7)).
+const (
+	LinkEthernet = 1
+	LinkRaw      = 101
+	LinkSLL      = 113
+	LinkIPv4     = 228
+	LinkIPv6     = 229
+	LinkSLL2     = 276
+
+	ethHeaderLen = 14
+	maxSnapLen   = 1 << 20
+)
+
+// Packet is one captured frame.
+type Packet struct {
+	Time    time.Time
+	Data    []byte // captured bytes, starting at the link header
+	OrigLen int    // length on the wire, including the link header
+}
+
+// Reader reads classic libpcap files (microsecond or nanosecond
+// timestamps, either byte order). pcapng is not supported; convert with
+// `editcap -F pcap in.pcapng out.pcap`.
+type Reader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	LinkType uint32
+}
+
+// NewReader reads the file header.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+
+	pr := &Reader{r: r}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); magic {
+	case 0xa1b2c3d4:
+		pr.order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		pr.order = binary.BigEndian
+	case 0xa1b23c4d:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		pr.order, pr.nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng is not supported, convert with: editcap -F pcap in.pcapng out.pcap")
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic %#08x)", magic)
+	}
+
+	// the upper bits of the link type field carry FCS information
+	pr.LinkType = pr.order.Uint32(hdr[20:24]) & 0x0fffffff
+	switch pr.LinkType {
+	case LinkEthernet, LinkRaw, LinkSLL, LinkSLL2, LinkIPv4, LinkIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", pr.LinkType)
+	}
+	return pr, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the file.
+func (r *Reader) Next() (Packet, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Packet{}, fmt.Errorf("truncated packet header: %w", err)
+		}
+		return Packet{}, err
+	}
+
+	sec := int64(r.order.Uint32(hdr[0:4]))
+	frac := int64(r.order.Uint32(hdr[4:8]))
+	capLen := r.order.Uint32(hdr[8:12])
+	origLen := r.order.Uint32(hdr[12:16])
+
+	if capLen > maxSnapLen {
+		return Packet{}, fmt.Errorf("packet of %d bytes exceeds the snap length limit", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, fmt.Errorf("truncated packet: %w", err)
+	}
+
+	if !r.nano {
+		frac *= 1000
+	}
+	return Packet{
+		Time:    time.Unix(sec, frac).UTC(),
+		Data:    data,
+		OrigLen: int(origLen),
+	}, nil
+}
+
+// network strips the link header and returns the IP packet, its
+// ethertype and the on-wire size the BPF programs would have counted (a
+// full Ethernet frame). ok is false for frames the programs ignore.
+func (r *Reader) network(p Packet) (ip []byte, ethType uint16, wire uint64, ok bool) {
+	var hdrLen int
+	switch r.LinkType {
+	case LinkEthernet:
+		hdrLen = ethHeaderLen
+		if len(p.Data) < hdrLen {
+			return nil, 0, 0, false
+		}
+		// like prog.c, VLAN tagged frames are not looked into
+		ethType = binary.BigEndian.Uint16(p.Data[12:14])
+	case LinkSLL:
+		hdrLen = 16
+		if len(p.Data) < hdrLen {
+			return nil, 0, 0, false
+		}
+		ethType = binary.BigEndian.Uint16(p.Data[14:16])
+	case LinkSLL2:
+		hdrLen = 20
+		if len(p.Data) < hdrLen {
+			return nil, 0, 0, false
+		}
+		ethType = binary.BigEndian.Uint16(p.Data[0:2])
+	case LinkRaw, LinkIPv4, LinkIPv6:
+		if len(p.Data) == 0 {
+			return nil, 0, 0, false
+		}
+		switch p.Data[0] >> 4 {
+		case 4:
+			ethType = ethPIP
+		case 6:
+			ethType = ethPIPv6
+		}
+	}
+
+	// XDP and TC see the frame from the Ethernet header on
+	wire = uint64(p.OrigLen - hdrLen + ethHeaderLen)
+	return p.Data[hdrLen:], ethType, wire, true
+}
@@ -0,0 +1,96 @@
+package replay
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+)
+
+// FlushFunc stores the counters of mem as the flush at now and resets
+// them, e.g. agg.Aggregator.FlushAt.
+type FlushFunc func(now time.Time)
+
+// Summary describes a finished replay.
+type Summary struct {
+	Packets   int // frames read
+	Accounted int // frames counted by the classifier
+	Flushes   int
+	First     time.Time
+	Last      time.Time
+	Totals    map[model.Peer]bpfgo.SiaIPStats // per peer over the whole capture
+}
+
+// Run feeds every packet of r through c into mem and calls flush whenever
+// the capture clock passes a multiple of interval, so the flushes carry the
+// timestamps the daemon would have written. With a nil flush the counters
+// are only summed into the Summary.
+func Run(r *Reader, c *Classifier, mem *counters.Memory, interval time.Duration, flush FlushFunc) (Summary, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	sum := Summary{Totals: make(map[model.Peer]bpfgo.SiaIPStats)}
+	var end time.Time // end of the current flush interval
+
+	emit := func() error {
+		snap, err := mem.Snapshot()
+		if err != nil {
+			return err
+		}
+		if len(snap) == 0 {
+			return nil
+		}
+		for p, st := range snap {
+			t := sum.Totals[p]
+			t.Add(st)
+			sum.Totals[p] = t
+		}
+		sum.Flushes++
+		if flush != nil {
+			flush(end)
+		} else if err := mem.Reset(); err != nil {
+			return err
+		}
+		return mem.Cleanup()
+	}
+
+	for {
+		p, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return sum, err
+		}
+
+		sum.Packets++
+		if sum.First.IsZero() {
+			sum.First = p.Time
+		}
+		sum.Last = p.Time
+
+		if end.IsZero() {
+			end = p.Time.Truncate(interval).Add(interval)
+		}
+		if !p.Time.Before(end) {
+			if err := emit(); err != nil {
+				return sum, err
+			}
+			end = p.Time.Truncate(interval).Add(interval)
+		}
+
+		ip, ethType, wire, ok := r.network(p)
+		if ok && c.Account(mem, ip, ethType, wire) {
+			sum.Accounted++
+		}
+	}
+
+	if err := emit(); err != nil {
+		return sum, err
+	}
+	return sum, nil
+}
@@ -0,0 +1,153 @@
+package replay
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/bpfgo"
+	"github.com/back2basic/collector/counters"
+	"github.com/back2basic/collector/model"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden")
+
+// The fixtures hold the same ten frames (renter siamux, consensus, QUIC
+// over IPv6, a non-Sia TCP flow and an ARP frame, over two minutes),
+// snapped at 96 bytes, in each supported link type. sll2.pcap is big
+// endian with nanosecond timestamps; raw.pcap has no ARP frame.
+var fixtures = []struct {
+	file string
+	link uint32
+}{
+	{"ethernet.pcap", LinkEthernet},
+	{"sll.pcap", LinkSLL},
+	{"sll2.pcap", LinkSLL2},
+	{"raw.pcap", LinkRaw},
+}
+
+func replayFixture(t *testing.T, file string, link uint32) (string, Summary) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType != link {
+		t.Fatalf("link type %d, want %d", r.LinkType, link)
+	}
+
+	c := &Classifier{Ports: Ports{Consensus: 9981, Siamux: 9984, Quic: 9984}}
+	mem := counters.NewMemory()
+	var out strings.Builder
+	sum, err := Run(r, c, mem, time.Minute, func(now time.Time) {
+		snap, _ := mem.Snapshot()
+		fmt.Fprintf(&out, "flush %s\n", now.Format(time.RFC3339))
+		writeStats(&out, snap)
+		mem.Reset()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&out, "total packets=%d accounted=%d flushes=%d first=%s last=%s\n",
+		sum.Packets, sum.Accounted, sum.Flushes,
+		sum.First.Format(time.RFC3339Nano), sum.Last.Format(time.RFC3339Nano))
+	writeStats(&out, sum.Totals)
+	return out.String(), sum
+}
+
+// writeStats prints one line per peer in address order, counters as
+// down/up.
+func writeStats(b *strings.Builder, m map[model.Peer]bpfgo.SiaIPStats) {
+	peers := make([]model.Peer, 0, len(m))
+	for p := range m {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Less(peers[j]) })
+	for _, p := range peers {
+		st := m[p]
+		fmt.Fprintf(b, "  %s consensus=%d/%d siamux=%d/%d quic=%d/%d other=%d/%d\n", p,
+			st.ConsensusDown, st.ConsensusUp, st.SiamuxDown, st.SiamuxUp,
+			st.QuicDown, st.QuicUp, st.OtherDown, st.OtherUp)
+	}
+}
+
+func TestReplayGolden(t *testing.T) {
+	for _, fx := range fixtures {
+		t.Run(fx.file, func(t *testing.T) {
+			got, _ := replayFixture(t, fx.file, fx.link)
+			golden := filepath.Join("testdata", strings.TrimSuffix(fx.file, ".pcap")+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s:\n--- got\n%s--- want\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// Every link type must count the same bytes: the readers normalise the
+// wire size to an Ethernet frame, as XDP and TC see it.
+func TestReplayLinkTypesAgree(t *testing.T) {
+	_, want := replayFixture(t, fixtures[0].file, fixtures[0].link)
+	for _, fx := range fixtures[1:] {
+		_, got := replayFixture(t, fx.file, fx.link)
+		if len(got.Totals) != len(want.Totals) {
+			t.Fatalf("%s: %d peers, want %d", fx.file, len(got.Totals), len(want.Totals))
+		}
+		for p, st := range want.Totals {
+			if got.Totals[p] != st {
+				t.Errorf("%s: %s = %+v, want %+v", fx.file, p, got.Totals[p], st)
+			}
+		}
+	}
+}
+
+func TestClassifierCountOtherWithLocal(t *testing.T) {
+	c := &Classifier{
+		Ports:      Ports{Consensus: 9981, Siamux: 9984, Quic: 9984},
+		CountOther: true,
+		Local:      map[netip.Addr]bool{netip.MustParseAddr("192.0.2.10"): true},
+		Deny:       []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+	}
+	f, err := os.Open(filepath.Join("testdata", "ethernet.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := Run(r, c, counters.NewMemory(), time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 203.0.113.7 is denied; the HTTPS flow is other traffic of its peer
+	if _, ok := sum.Totals[model.PeerFrom(netip.MustParseAddr("203.0.113.7"))]; ok {
+		t.Error("denied peer was counted")
+	}
+	st := sum.Totals[model.PeerFrom(netip.MustParseAddr("198.51.100.9"))]
+	if st.OtherDown == 0 || st.SiamuxDown != 0 {
+		t.Errorf("non-Sia flow: %+v, want other traffic only", st)
+	}
+}
@@ -0,0 +1,249 @@
+package revenue
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	// flag reasons
+	FlagNoRenter    = "no renter"
+	FlagNotActive   = "no active contract"
+	FlagOverRevenue = "exceeds revenue"
+
+	// PaidLifetime in Peer.PaidSince: a contract had no usage snapshot
+	// from the period, so its whole lifetime usage counts as paid
+	PaidLifetime = "lifetime"
+)
+
+// Options decide which peers are flagged.
+type Options struct {
+	Factor   float64 // flag when expected revenue exceeds Factor times the paid revenue
+	MinBytes uint64  // peers with less data traffic in the period are never flagged
+}
+
+// Day is the data traffic of one peer on one day. Ingress is what the peer
+// sent to the host, Egress what it received; both count siamux and QUIC.
+type Day struct {
+	Day        string         `json:"day"`
+	Peer       string         `json:"peer"`
+	RenterKey  string         `json:"renter_key,omitempty"`
+	ContractID string         `json:"contract_id,omitempty"`
+	Ingress    uint64         `json:"ingress"`
+	Egress     uint64         `json:"egress"`
+	Expected   hostd.Currency `json:"expected"` // at the host's prices
+}
+
+// Peer is a peer over the whole period. Paid is the bandwidth revenue of
+// the contract, or of every active contract of the renter, that funds the
+// peer; peers sharing a contract or renter are compared together. Paid
+// counts from the usage snapshot taken on PaidSince, or is PaidLifetime.
+type Peer struct {
+	Peer       string         `json:"peer"`
+	RenterKey  string         `json:"renter_key,omitempty"`
+	ContractID string         `json:"contract_id,omitempty"`
+	Ingress    uint64         `json:"ingress"`
+	Egress     uint64         `json:"egress"`
+	Expected   hostd.Currency `json:"expected"`
+	Paid       hostd.Currency `json:"paid"`
+	PaidSince  string         `json:"paid_since,omitempty"`
+	Flag       string         `json:"flag,omitempty"`
+}
+
+// Report reconciles measured traffic with hostd revenue.
+type Report struct {
+	Prices   hostd.Settings `json:"prices"` // hastings per byte
+	Days     []Day          `json:"days"`
+	Peers    []Peer         `json:"peers"` // flagged first, then by expected revenue
+	Expected hostd.Currency `json:"expected"`
+	Paid     hostd.Currency `json:"paid"` // bandwidth revenue of all active contracts in the window
+}
+
+// funds is the bandwidth revenue of one or more contracts.
+type funds struct {
+	paid     big.Int
+	since    string // latest snapshot day counted from
+	lifetime bool   // some contract had no snapshot
+}
+
+func (f *funds) add(o *funds) {
+	f.paid.Add(&f.paid, &o.paid)
+	if o.since > f.since {
+		f.since = o.since
+	}
+	f.lifetime = f.lifetime || o.lifetime
+}
+
+// source is what funds a group of peers.
+type source struct {
+	funds
+	expected big.Int
+	known    bool // the contract or renter has an active contract
+}
+
+// Build computes the report for days at prices against the active
+// contracts. baselines holds the usage snapshot of each contract at the
+// start of the period (storage.UsageBaselines); contracts without one are
+// counted over their lifetime.
+func Build(days []model.PeerDay, contracts []hostd.Contract, baselines map[string]hostd.UsageSnapshot, prices hostd.Settings, opts Options) Report {
+	rep := Report{Prices: prices}
+
+	byContract := make(map[string]*funds, len(contracts))
+	byRenter := make(map[string]*funds)
+	for _, c := range contracts {
+		f := windowed(c, baselines)
+		byContract[c.ID] = f
+		if byRenter[c.RenterPublicKey] == nil {
+			byRenter[c.RenterPublicKey] = &funds{}
+		}
+		byRenter[c.RenterPublicKey].add(f)
+		rep.Paid.Add(&rep.Paid.Int, &f.paid)
+	}
+
+	peers := make(map[string]*Peer)
+	for _, d := range days {
+		day := Day{
+			Day:        d.Day,
+			Peer:       d.IP,
+			RenterKey:  d.RenterKey,
+			ContractID: d.ContractID,
+			Ingress:    d.SiamuxDown + d.QuicDown,
+			Egress:     d.SiamuxUp + d.QuicUp,
+		}
+		day.Expected = expected(prices, day.Ingress, day.Egress)
+		rep.Days = append(rep.Days, day)
+		rep.Expected.Add(&rep.Expected.Int, &day.Expected.Int)
+
+		p := peers[d.IP]
+		if p == nil {
+			p = &Peer{Peer: d.IP}
+			peers[d.IP] = p
+		}
+		// the latest day wins when a peer changed hands
+		if day.RenterKey != "" || day.ContractID != "" {
+			p.RenterKey, p.ContractID = day.RenterKey, day.ContractID
+		}
+		p.Ingress += day.Ingress
+		p.Egress += day.Egress
+		p.Expected.Add(&p.Expected.Int, &day.Expected.Int)
+	}
+
+	sources := make(map[string]*source)
+	key := func(p *Peer) string {
+		switch {
+		case p.ContractID != "":
+			return "contract:" + p.ContractID
+		case p.RenterKey != "":
+			return "renter:" + p.RenterKey
+		}
+		return ""
+	}
+	for _, p := range peers {
+		k := key(p)
+		if k == "" {
+			continue
+		}
+		s := sources[k]
+		if s == nil {
+			s = &source{}
+			f := byContract[p.ContractID]
+			if p.ContractID == "" {
+				f = byRenter[p.RenterKey]
+			}
+			if f != nil {
+				s.add(f)
+				s.known = true
+			}
+			sources[k] = s
+		}
+		s.expected.Add(&s.expected, &p.Expected.Int)
+	}
+
+	factor := new(big.Rat).SetFloat64(opts.Factor)
+	if factor == nil {
+		factor = new(big.Rat).SetInt64(1)
+	}
+	for _, p := range peers {
+		s := sources[key(p)]
+		if s != nil {
+			p.Paid = hostd.NewCurrency(&s.paid)
+			switch {
+			case !s.known:
+			case s.lifetime:
+				p.PaidSince = PaidLifetime
+			default:
+				p.PaidSince = s.since
+			}
+		}
+		if p.Ingress+p.Egress >= opts.MinBytes {
+			switch {
+			case s == nil:
+				p.Flag = FlagNoRenter
+			case !s.known:
+				p.Flag = FlagNotActive
+			case exceeds(&s.expected, &s.paid, factor):
+				p.Flag = FlagOverRevenue
+			}
+		}
+		rep.Peers = append(rep.Peers, *p)
+	}
+
+	sort.SliceStable(rep.Peers, func(i, j int) bool {
+		a, b := rep.Peers[i], rep.Peers[j]
+		if (a.Flag != "") != (b.Flag != "") {
+			return a.Flag != ""
+		}
+		if c := a.Expected.Cmp(&b.Expected.Int); c != 0 {
+			return c > 0
+		}
+		return a.Peer < b.Peer
+	})
+	return rep
+}
+
+// Flagged returns the flagged peers.
+func (r Report) Flagged() []Peer {
+	var out []Peer
+	for _, p := range r.Peers {
+		if p.Flag != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// windowed returns the revenue c earned since its baseline snapshot, or
+// over its lifetime without one.
+func windowed(c hostd.Contract, baselines map[string]hostd.UsageSnapshot) *funds {
+	f := &funds{}
+	f.paid.Add(&c.Usage.Ingress.Int, &c.Usage.Egress.Int)
+	b, ok := baselines[c.ID]
+	if !ok {
+		f.lifetime = true
+		return f
+	}
+	f.since = b.Day
+	f.paid.Sub(&f.paid, &b.Usage.Ingress.Int)
+	f.paid.Sub(&f.paid, &b.Usage.Egress.Int)
+	if f.paid.Sign() < 0 {
+		// usage only grows; never count negative revenue
+		f.paid.SetInt64(0)
+	}
+	return f
+}
+
+// expected is the revenue ingress and egress bytes earn at prices.
+func expected(prices hostd.Settings, ingress, egress uint64) hostd.Currency {
+	in := new(big.Int).Mul(&prices.IngressPrice.Int, new(big.Int).SetUint64(ingress))
+	out := new(big.Int).Mul(&prices.EgressPrice.Int, new(big.Int).SetUint64(egress))
+	return hostd.NewCurrency(in.Add(in, out))
+}
+
+// exceeds reports whether expected > factor * paid.
+func exceeds(expected, paid *big.Int, factor *big.Rat) bool {
+	limit := new(big.Rat).Mul(new(big.Rat).SetInt(paid), factor)
+	return new(big.Rat).SetInt(expected).Cmp(limit) > 0
+}
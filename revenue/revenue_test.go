@@ -0,0 +1,91 @@
+package revenue
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/model"
+)
+
+func sc(n int64) hostd.Currency {
+	return hostd.NewCurrency(big.NewInt(n))
+}
+
+func usage(ingress, egress int64) hostd.Usage {
+	return hostd.Usage{Ingress: sc(ingress), Egress: sc(egress)}
+}
+
+func peerDay(day, ip, renter, contract string, egress uint64) model.PeerDay {
+	return model.PeerDay{Day: day, AggregatedRecord: model.AggregatedRecord{
+		IP: ip, RenterKey: renter, ContractID: contract, SiamuxUp: egress,
+	}}
+}
+
+func TestBuildWindowsPaidRevenue(t *testing.T) {
+	prices := hostd.Settings{IngressPrice: sc(0), EgressPrice: sc(1)} // 1 hasting per egress byte
+	contracts := []hostd.Contract{
+		{ID: "c-window", RenterPublicKey: "r-a", Usage: usage(0, 10_000)},
+		{ID: "c-lifetime", RenterPublicKey: "r-b", Usage: usage(0, 10_000)},
+		{ID: "c-renter-1", RenterPublicKey: "r-c", Usage: usage(100, 400)},
+		{ID: "c-renter-2", RenterPublicKey: "r-c", Usage: usage(0, 500)},
+	}
+	baselines := map[string]hostd.UsageSnapshot{
+		"c-window":   {Day: "2024-05-01", Usage: usage(0, 9_500)}, // 500 paid in the window
+		"c-renter-1": {Day: "2024-05-01", Usage: usage(0, 0)},
+		"c-renter-2": {Day: "2024-05-02", Usage: usage(0, 100)},
+	}
+	days := []model.PeerDay{
+		peerDay("2024-05-01", "192.0.2.1", "r-a", "c-window", 600),
+		peerDay("2024-05-02", "192.0.2.1", "r-a", "c-window", 600),
+		peerDay("2024-05-01", "192.0.2.2", "r-b", "c-lifetime", 1_200),
+		peerDay("2024-05-01", "192.0.2.3", "r-c", "", 1_000),
+		peerDay("2024-05-01", "192.0.2.4", "", "", 5_000),
+	}
+
+	rep := Build(days, contracts, baselines, prices, Options{Factor: 2})
+	peers := make(map[string]Peer)
+	for _, p := range rep.Peers {
+		peers[p.Peer] = p
+	}
+
+	for _, tc := range []struct {
+		peer      string
+		paid      int64
+		paidSince string
+		flag      string
+	}{
+		// expected 1200 against 500 paid since the snapshot
+		{"192.0.2.1", 500, "2024-05-01", FlagOverRevenue},
+		// without a snapshot the lifetime usage hides the shortfall
+		{"192.0.2.2", 10_000, PaidLifetime, ""},
+		// both contracts of the renter, each from its own snapshot
+		{"192.0.2.3", 900, "2024-05-02", ""},
+		{"192.0.2.4", 0, "", FlagNoRenter},
+	} {
+		p := peers[tc.peer]
+		if p.Paid.Cmp(big.NewInt(tc.paid)) != 0 || p.PaidSince != tc.paidSince || p.Flag != tc.flag {
+			t.Errorf("%s: paid %s since %q flag %q; want %d since %q flag %q",
+				tc.peer, p.Paid.String(), p.PaidSince, p.Flag, tc.paid, tc.paidSince, tc.flag)
+		}
+	}
+	if rep.Paid.Cmp(big.NewInt(500+10_000+900)) != 0 {
+		t.Errorf("total paid = %s, want %d", rep.Paid.String(), 500+10_000+900)
+	}
+	if rep.Expected.Cmp(big.NewInt(8_400)) != 0 {
+		t.Errorf("total expected = %s, want 8400", rep.Expected.String())
+	}
+	if f := rep.Flagged(); len(f) != 2 || f[0].Flag == "" || f[1].Flag == "" {
+		t.Errorf("flagged = %+v, want the two flagged peers first", f)
+	}
+}
+
+func TestBuildClampsShrinkingUsage(t *testing.T) {
+	contracts := []hostd.Contract{{ID: "c", RenterPublicKey: "r", Usage: usage(0, 100)}}
+	baselines := map[string]hostd.UsageSnapshot{"c": {Day: "2024-05-01", Usage: usage(0, 200)}}
+	rep := Build([]model.PeerDay{peerDay("2024-05-01", "192.0.2.1", "r", "c", 1)}, contracts, baselines,
+		hostd.Settings{IngressPrice: sc(1), EgressPrice: sc(1)}, Options{Factor: 1})
+	if rep.Paid.Sign() != 0 || rep.Peers[0].Paid.Sign() != 0 {
+		t.Fatalf("paid = %s / %s, want 0", rep.Paid.String(), rep.Peers[0].Paid.String())
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+)
+
+const dashboardTopN = 25
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": bytesHuman,
+	"ago": func(ts int64) string {
+		return time.Since(time.Unix(ts, 0)).Truncate(time.Second).String()
+	},
+	"up": func(r model.AggregatedRecord) uint64 {
+		return r.ConsensusUp + r.SiamuxUp + r.QuicUp
+	},
+	"down": func(r model.AggregatedRecord) uint64 {
+		return r.ConsensusDown + r.SiamuxDown + r.QuicDown
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>collector fleet — {{.Day}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Fleet traffic {{.Day}} (UTC)</h1>
+
+<h2>Hosts</h2>
+<table>
+<tr><th>Host</th><th>Last seen</th><th>Peers</th><th>Up</th><th>Down</th></tr>
+{{range .Hosts}}<tr><td>{{.Hostname}}</td><td>{{ago .LastSeen}} ago</td><td>{{.Peers}}</td><td>{{bytes .TotalUp}}</td><td>{{bytes .TotalDown}}</td></tr>
+{{end}}</table>
+
+<h2>Top peers</h2>
+<table>
+<tr><th>Peer</th><th>DNS</th><th>ASN</th><th>Consensus down/up</th><th>Siamux down/up</th><th>QUIC down/up</th><th>Total up</th><th>Total down</th></tr>
+{{range .Peers}}<tr><td>{{.IP}}</td><td>{{.DNS}}</td><td>{{if .ASN}}AS{{.ASN}} {{.ASOrg}}{{end}}</td><td>{{bytes .ConsensusDown}} / {{bytes .ConsensusUp}}</td><td>{{bytes .SiamuxDown}} / {{bytes .SiamuxUp}}</td><td>{{bytes .QuicDown}} / {{bytes .QuicUp}}</td><td>{{bytes (up .)}}</td><td>{{bytes (down .)}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	day, err := parseDay(r.URL.Query().Get("day"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hosts, err := storage.FleetHosts(day)
+	if err != nil {
+		log.Printf("server: dashboard hosts: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	peers, err := storage.QueryFleetTotals(day, storage.GroupIP, "")
+	if err != nil {
+		log.Printf("server: dashboard peers: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(peers) > dashboardTopN {
+		peers = peers[:dashboardTopN]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = dashboardTmpl.Execute(w, struct {
+		Day   string
+		Hosts []model.HostSummary
+		Peers []model.AggregatedRecord
+	}{day.Format("2006-01-02"), hosts, peers})
+	if err != nil {
+		log.Printf("server: render dashboard: %v", err)
+	}
+}
+
+// bytesHuman matches the live dashboard's formatting (1024 base).
+func bytesHuman(b uint64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+		TB = GB * 1024
+	)
+
+	switch {
+	case b >= TB:
+		return fmt.Sprintf("%.2f TB", float64(b)/float64(TB))
+	case b >= GB:
+		return fmt.Sprintf("%.2f GB", float64(b)/float64(GB))
+	case b >= MB:
+		return fmt.Sprintf("%.2f MB", float64(b)/float64(MB))
+	case b >= KB:
+		return fmt.Sprintf("%.2f KB", float64(b)/float64(KB))
+	default:
+		return fmt.Sprintf("%d B", b)
+	}
+}
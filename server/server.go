@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/httpauth"
+	"github.com/back2basic/collector/privacy"
+	"github.com/back2basic/collector/sink"
+	"github.com/back2basic/collector/storage"
+)
+
+const (
+	defaultListen = ":8080"
+	maxBodyBytes  = 32 << 20
+)
+
+// Server receives HTTP sink batches from many collectors and serves
+// fleet-wide queries and a dashboard.
+type Server struct {
+	Listen     string
+	Tokens     map[string]string // ingest bearer token -> the hostname it may push for, AnyHost for all
+	SigningKey []byte            // HMAC key; empty disables signature checks
+	Auth       *httpauth.Config
+	Privacy    *privacy.Policy // RAW_IP_RETENTION_DAYS for fleet rows; nil keeps them
+
+	// AllowAnonymous accepts ingest without a token or client certificate
+	// when neither is configured. Without it the server refuses to start.
+	AllowAnonymous bool
+}
+
+// AnyHost in SERVER_TOKENS lets a token push for every hostname.
+const AnyHost = "*"
+
+// FromEnv configures the server from SERVER_LISTEN, SERVER_TOKENS,
+// SERVER_SIGNING_KEY and SERVER_ALLOW_ANONYMOUS=1, TLS and query access
+// from the SERVER_* variables of httpauth.FromEnv and the retention of raw
+// addresses from privacy.FromEnv. SERVER_TOKENS is a comma separated list
+// of hostname:token.
+func FromEnv() (*Server, error) {
+	pol, err := privacy.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("privacy: %w", err)
+	}
+	s := &Server{
+		Listen:         os.Getenv("SERVER_LISTEN"),
+		Tokens:         make(map[string]string),
+		SigningKey:     []byte(os.Getenv("SERVER_SIGNING_KEY")),
+		Auth:           httpauth.FromEnv("server", "SERVER"),
+		AllowAnonymous: os.Getenv("SERVER_ALLOW_ANONYMOUS") == "1",
+		Privacy:        pol,
+	}
+	if s.Listen == "" {
+		s.Listen = defaultListen
+	}
+	for _, t := range strings.Split(os.Getenv("SERVER_TOKENS"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		host, token, ok := strings.Cut(t, ":")
+		if !ok || host == "" || token == "" {
+			return nil, fmt.Errorf("SERVER_TOKENS: want hostname:token, got %q", t)
+		}
+		s.Tokens[token] = host
+	}
+	return s, nil
+}
+
+// Handler returns the HTTP routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/ingest", s.handleIngest)
+	mux.Handle("GET /v1/hosts", s.Auth.Require(httpauth.ScopeRead, http.HandlerFunc(s.handleHosts)))
+	mux.Handle("GET /v1/traffic", s.Auth.Require(httpauth.ScopeRead, http.HandlerFunc(s.handleTraffic)))
+	mux.Handle("GET /{$}", s.Auth.Require(httpauth.ScopeRead, http.HandlerFunc(s.handleDashboard)))
+	return mux
+}
+
+// ListenAndServe creates the fleet tables and serves until it fails.
+func (s *Server) ListenAndServe() error {
+	if err := storage.InitFleet(); err != nil {
+		return fmt.Errorf("init fleet tables: %w", err)
+	}
+	if s.anonymous() {
+		if !s.AllowAnonymous {
+			return fmt.Errorf("server: set SERVER_TOKENS or SERVER_CLIENT_CA, or SERVER_ALLOW_ANONYMOUS=1 to accept unauthenticated ingest")
+		}
+		log.Println("server: SERVER_ALLOW_ANONYMOUS=1, ingest is unauthenticated")
+	}
+	if s.Privacy != nil {
+		go s.purge()
+	}
+	log.Printf("server: listening on %s (tls=%v)", s.Listen, s.Auth.TLS())
+	return s.Auth.ListenAndServe(context.Background(), s.Listen, s.Handler())
+}
+
+// purge rewrites fleet rows past the raw address retention, hourly.
+func (s *Server) purge() {
+	for ; ; time.Sleep(time.Hour) {
+		s.Privacy.PurgeFleet(time.Now())
+	}
+}
+
+// anonymous reports whether ingest has no credentials configured.
+func (s *Server) anonymous() bool {
+	return len(s.Tokens) == 0 && s.Auth.ClientCA == ""
+}
+
+// ingestHost returns the hostname the client of r may push for: the host of
+// its SERVER_TOKENS entry, or the common name of its verified client
+// certificate. ok is false for unauthenticated requests.
+func (s *Server) ingestHost(r *http.Request) (host string, ok bool) {
+	if s.anonymous() && s.AllowAnonymous {
+		return AnyHost, true
+	}
+	if t := bearer(r); t != "" {
+		for token, h := range s.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return h, true
+			}
+		}
+	}
+	return httpauth.ClientCert(r)
+}
+
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	owner, ok := s.ingestHost(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+	if len(s.SigningKey) > 0 && !sink.VerifySignature(s.SigningKey, body, r.Header.Get(sink.SignatureHeader)) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	var b sink.Batch
+	if err := json.Unmarshal(body, &b); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b.Version != sink.BatchVersion {
+		http.Error(w, fmt.Sprintf("unsupported batch version %d", b.Version), http.StatusBadRequest)
+		return
+	}
+	if b.Hostname == "" {
+		http.Error(w, "missing hostname", http.StatusBadRequest)
+		return
+	}
+	if owner != AnyHost && owner != b.Hostname {
+		http.Error(w, fmt.Sprintf("not allowed to push for %q", b.Hostname), http.StatusForbidden)
+		return
+	}
+
+	accepted := 0
+	switch b.Kind {
+	case sink.KindMinute:
+		recs := make([]storage.FleetRecord, 0, len(b.Records))
+		for _, rec := range b.Records {
+			recs = append(recs, storage.FleetRecord{ID: rec.ID, TrafficRecord: rec.Traffic()})
+		}
+		err = storage.UpsertFleetMinute(b.Hostname, recs)
+		accepted = len(recs)
+	case sink.KindDaily:
+		// fleet totals are summed from minute batches; daily batches are
+		// accepted so collectors with the default API_KINDS keep working
+		if _, perr := time.Parse("2006-01-02", b.Day); perr != nil {
+			http.Error(w, "invalid day", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown kind %q", b.Kind), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("server: ingest %s from %s: %v", b.Kind, b.Hostname, err)
+		http.Error(w, "store failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]int{"accepted": accepted})
+}
+
+func (s *Server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	day, err := parseDay(r.URL.Query().Get("day"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hosts, err := storage.FleetHosts(day)
+	if err != nil {
+		log.Printf("server: hosts: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, hosts)
+}
+
+// handleTraffic serves fleet totals: ?day=YYYY-MM-DD&group=host|ip|prefix|asn|country&host=&limit=
+func (s *Server) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	day, err := parseDay(q.Get("day"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group := q.Get("group")
+	if group == "" {
+		group = storage.GroupHost
+	}
+
+	recs, err := storage.QueryFleetTotals(day, group, q.Get("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n < len(recs) {
+		recs = recs[:n]
+	}
+	writeJSON(w, recs)
+}
+
+// parseDay returns UTC midnight of s, or of today when s is empty.
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour), nil
+	}
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid day %q", s)
+	}
+	return d, nil
+}
+
+func bearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if t, ok := strings.CutPrefix(h, "Bearer "); ok {
+		return t
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("server: write response: %v", err)
+	}
+}
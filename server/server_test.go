@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/httpauth"
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/sink"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func newTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	storagetest.Open(t)
+	if err := storage.InitFleet(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Auth == nil {
+		s.Auth = &httpauth.Config{Name: "server"}
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func post(t *testing.T, url, token string, b sink.Batch) int {
+	t.Helper()
+	body, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, url+"/v1/ingest", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func minuteBatch(host string, seq uint64, ts int64, quicUp uint64) sink.Batch {
+	return sink.Batch{
+		Version:  sink.BatchVersion,
+		Hostname: host,
+		Kind:     sink.KindMinute,
+		Seq:      seq,
+		Records: []sink.Record{{
+			ID:        sink.RecordID(host, "192.0.2.1", fmt.Sprintf("%d/%d", ts, seq)),
+			Timestamp: ts,
+			IP:        "192.0.2.1",
+			QuicUp:    quicUp,
+		}},
+	}
+}
+
+func hostTotals(t *testing.T, day time.Time) map[string]model.AggregatedRecord {
+	t.Helper()
+	recs, err := storage.QueryFleetTotals(day, storage.GroupHost, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]model.AggregatedRecord)
+	for _, r := range recs {
+		out[r.IP] = r
+	}
+	return out
+}
+
+func TestIngestSumsFlushesAndSkipsRetries(t *testing.T) {
+	srv := newTestServer(t, &Server{Tokens: map[string]string{"t-a": "host-a"}})
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	ts := day.Add(time.Hour).Unix()
+
+	first := minuteBatch("host-a", 1, ts, 100)
+	for i := 0; i < 2; i++ { // the second post is a retry
+		if code := post(t, srv.URL, "t-a", first); code != http.StatusOK {
+			t.Fatalf("ingest: status %d", code)
+		}
+	}
+	// the final flush on shutdown lands in the same minute
+	if code := post(t, srv.URL, "t-a", minuteBatch("host-a", 2, ts+30, 40)); code != http.StatusOK {
+		t.Fatalf("ingest: status %d", code)
+	}
+
+	if got := hostTotals(t, day)["host-a"].QuicUp; got != 140 {
+		t.Fatalf("quic_up = %d, want 140 (both flushes once)", got)
+	}
+}
+
+func TestIngestIgnoresDailyBatches(t *testing.T) {
+	srv := newTestServer(t, &Server{Tokens: map[string]string{"t-a": "host-a"}})
+	b := sink.Batch{Version: sink.BatchVersion, Hostname: "host-a", Kind: sink.KindDaily, Day: "2024-01-02",
+		Records: []sink.Record{{ID: "x", IP: "192.0.2.1", QuicUp: 5}}}
+	if code := post(t, srv.URL, "t-a", b); code != http.StatusOK {
+		t.Fatalf("daily batch: status %d", code)
+	}
+	day, _ := time.Parse("2006-01-02", "2024-01-02")
+	if n := len(hostTotals(t, day)); n != 0 {
+		t.Fatalf("daily batch stored %d groups", n)
+	}
+}
+
+func TestIngestBindsTokenToHostname(t *testing.T) {
+	srv := newTestServer(t, &Server{Tokens: map[string]string{"t-a": "host-a", "t-any": AnyHost}})
+	ts := time.Now().Unix()
+
+	for _, tc := range []struct {
+		token, host string
+		want        int
+	}{
+		{"t-a", "host-a", http.StatusOK},
+		{"t-a", "host-b", http.StatusForbidden},
+		{"t-any", "host-b", http.StatusOK},
+		{"wrong", "host-a", http.StatusUnauthorized},
+		{"", "host-a", http.StatusUnauthorized},
+	} {
+		if code := post(t, srv.URL, tc.token, minuteBatch(tc.host, 1, ts, 1)); code != tc.want {
+			t.Errorf("token %q pushing for %s: status %d, want %d", tc.token, tc.host, code, tc.want)
+		}
+	}
+}
+
+func TestAnonymousIngestNeedsOptIn(t *testing.T) {
+	s := &Server{Listen: "127.0.0.1:0"}
+	newTestServer(t, s)
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "SERVER_ALLOW_ANONYMOUS") {
+		t.Fatalf("ListenAndServe without credentials: %v", err)
+	}
+
+	open := newTestServer(t, &Server{AllowAnonymous: true})
+	if code := post(t, open.URL, "", minuteBatch("host-a", 1, time.Now().Unix(), 1)); code != http.StatusOK {
+		t.Fatalf("anonymous ingest with opt-in: status %d", code)
+	}
+}
+
+func TestFromEnvTokens(t *testing.T) {
+	t.Setenv("SERVER_TOKENS", "host-a:t-a, *:t-any")
+	s, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Tokens["t-a"] != "host-a" || s.Tokens["t-any"] != AnyHost {
+		t.Fatalf("tokens = %v", s.Tokens)
+	}
+
+	t.Setenv("SERVER_TOKENS", "bare-token")
+	if _, err := FromEnv(); err == nil {
+		t.Fatal("a token without hostname was accepted")
+	}
+}
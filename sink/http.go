@@ -0,0 +1,315 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	BatchVersion = 1
+
+	// SignatureHeader carries "sha256=<hex HMAC of the body>".
+	SignatureHeader = "X-Collector-Signature"
+	// IdempotencyHeader identifies a batch across retries.
+	IdempotencyHeader = "Idempotency-Key"
+
+	defaultBatchSize = 500
+	defaultRetries   = 3
+	httpTimeout      = 15 * time.Second
+	retryBase        = 2 * time.Second
+)
+
+// Batch is the JSON document POSTed by the HTTP sink.
+type Batch struct {
+	Version  int      `json:"version"`
+	Hostname string   `json:"hostname"`
+	Kind     string   `json:"kind"`          // KindMinute or KindDaily
+	Day      string   `json:"day,omitempty"` // daily batches only
+	Seq      uint64   `json:"seq,omitempty"` // minute batches only: the flush, unique per collector
+	Records  []Record `json:"records"`
+}
+
+// Record is one peer (or group) in a Batch.
+type Record struct {
+	ID            string `json:"id"`
+	Timestamp     int64  `json:"timestamp,omitempty"` // minute batches only
+	Interface     string `json:"interface,omitempty"` // minute batches only
+	IP            string `json:"ip"`
+	Prefix        string `json:"prefix,omitempty"`
+	DNS           string `json:"dns,omitempty"`
+	DNSVerified   int    `json:"dns_verified,omitempty"`
+	Country       string `json:"country,omitempty"`
+	ASN           uint   `json:"asn,omitempty"`
+	ASOrg         string `json:"as_org,omitempty"`
+	RenterKey     string `json:"renter_key,omitempty"`
+	ContractID    string `json:"contract_id,omitempty"`
+	ConsensusUp   uint64 `json:"consensus_up"`
+	ConsensusDown uint64 `json:"consensus_down"`
+	SiamuxUp      uint64 `json:"siamux_up"`
+	SiamuxDown    uint64 `json:"siamux_down"`
+	QuicUp        uint64 `json:"quic_up"`
+	QuicDown      uint64 `json:"quic_down"`
+	OtherUp       uint64 `json:"other_up,omitempty"`
+	OtherDown     uint64 `json:"other_down,omitempty"`
+}
+
+// HTTP POSTs signed JSON batches to a collection endpoint.
+type HTTP struct {
+	Endpoint   string
+	Token      string // sent as a bearer token
+	SigningKey []byte // HMAC-SHA256 key for SignatureHeader
+	BatchSize  int
+	Retries    int
+	Kinds      map[string]bool
+
+	client *http.Client
+	seq    atomic.Uint64 // last flush sequence number
+}
+
+// HTTPFromEnv configures the sink from API_ENDPOINT, API_TOKEN,
+// API_SIGNING_KEY (defaults to the token), API_BATCH_SIZE, API_RETRIES and
+// API_KINDS (minute,daily). It returns nil when API_ENDPOINT is unset.
+func HTTPFromEnv() *HTTP {
+	endpoint := os.Getenv("API_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	h := &HTTP{
+		Endpoint:  endpoint,
+		Token:     os.Getenv("API_TOKEN"),
+		BatchSize: envInt("API_BATCH_SIZE", defaultBatchSize),
+		Retries:   envInt("API_RETRIES", defaultRetries),
+		Kinds:     parseKinds(os.Getenv("API_KINDS")),
+	}
+	h.SigningKey = []byte(os.Getenv("API_SIGNING_KEY"))
+	if len(h.SigningKey) == 0 {
+		h.SigningKey = []byte(h.Token)
+	}
+	// start from the clock so a restarted collector never reuses a number
+	h.seq.Store(uint64(time.Now().UnixNano()))
+	return h
+}
+
+func (h *HTTP) Name() string { return "http" }
+
+// SendMinute posts one flush worth of records. Every flush gets its own
+// sequence number, so two flushes in the same minute (a final flush on
+// shutdown, say) have distinct record IDs and receivers add them up.
+func (h *HTTP) SendMinute(hostname string, at time.Time, recs []model.TrafficRecord) error {
+	if !h.Kinds[KindMinute] {
+		return nil
+	}
+	seq := h.seq.Add(1)
+	slot := func(ts int64) string {
+		return strconv.FormatInt(ts, 10) + "/" + strconv.FormatUint(seq, 10)
+	}
+	out := make([]Record, 0, len(recs))
+	for _, r := range recs {
+		out = append(out, Record{
+			ID:            RecordID(hostname, r.IP, slot(r.Timestamp)),
+			Timestamp:     r.Timestamp,
+			Interface:     r.Interface,
+			IP:            r.IP,
+			Prefix:        r.Prefix,
+			DNS:           r.DNS,
+			DNSVerified:   r.DNSVerified,
+			Country:       r.Country,
+			ASN:           r.ASN,
+			ASOrg:         r.ASOrg,
+			RenterKey:     r.RenterKey,
+			ContractID:    r.ContractID,
+			ConsensusUp:   r.ConsensusUp,
+			ConsensusDown: r.ConsensusDown,
+			SiamuxUp:      r.SiamuxUp,
+			SiamuxDown:    r.SiamuxDown,
+			QuicUp:        r.QuicUp,
+			QuicDown:      r.QuicDown,
+			OtherUp:       r.OtherUp,
+			OtherDown:     r.OtherDown,
+		})
+	}
+	return h.send(Batch{Version: BatchVersion, Hostname: hostname, Kind: KindMinute, Seq: seq}, out)
+}
+
+// SendDaily posts today's totals.
+func (h *HTTP) SendDaily(hostname, day string, recs []model.AggregatedRecord) error {
+	if !h.Kinds[KindDaily] {
+		return nil
+	}
+	out := make([]Record, 0, len(recs))
+	for _, r := range recs {
+		out = append(out, Record{
+			ID:            RecordID(hostname, r.IP, day),
+			IP:            r.IP,
+			DNS:           r.DNS,
+			DNSVerified:   r.DNSVerified,
+			Country:       r.Country,
+			ASN:           r.ASN,
+			ASOrg:         r.ASOrg,
+			RenterKey:     r.RenterKey,
+			ContractID:    r.ContractID,
+			ConsensusUp:   r.ConsensusUp,
+			ConsensusDown: r.ConsensusDown,
+			SiamuxUp:      r.SiamuxUp,
+			SiamuxDown:    r.SiamuxDown,
+			QuicUp:        r.QuicUp,
+			QuicDown:      r.QuicDown,
+			OtherUp:       r.OtherUp,
+			OtherDown:     r.OtherDown,
+		})
+	}
+	return h.send(Batch{Version: BatchVersion, Hostname: hostname, Kind: KindDaily, Day: day}, out)
+}
+
+// send splits recs into BatchSize chunks and posts each one.
+func (h *HTTP) send(tmpl Batch, recs []Record) error {
+	size := h.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	for i := 0; i < len(recs); i += size {
+		end := i + size
+		if end > len(recs) {
+			end = len(recs)
+		}
+		b := tmpl
+		b.Records = recs[i:end]
+		if err := h.post(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one batch, retrying network errors, 429 and 5xx with
+// exponential backoff. The idempotency key is the same for every attempt.
+func (h *HTTP) post(b Batch) error {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	key := batchKey(body)
+
+	if h.client == nil {
+		h.client = &http.Client{Timeout: httpTimeout}
+	}
+
+	return retry(h.Retries, func() error { return h.do(body, key) })
+}
+
+func (h *HTTP) do(body []byte, key string) error {
+	req, err := http.NewRequest(http.MethodPost, h.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyHeader, key)
+	req.Header.Set(SignatureHeader, Sign(h.SigningKey, body))
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	return doRequest(h.client, req)
+}
+
+// Sign returns the SignatureHeader value for body.
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether sig is a valid SignatureHeader for body.
+func VerifySignature(key, body []byte, sig string) bool {
+	return hmac.Equal([]byte(Sign(key, body)), []byte(sig))
+}
+
+// batchKey derives the idempotency key from the encoded batch: retries
+// send the same body, while a batch with new values gets a new key even
+// when it reuses record IDs (daily totals do).
+func batchKey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:16])
+}
+
+func parseKinds(s string) map[string]bool {
+	if s == "" {
+		return map[string]bool{KindMinute: true, KindDaily: true}
+	}
+	out := make(map[string]bool)
+	for _, k := range strings.Split(s, ",") {
+		out[strings.TrimSpace(strings.ToLower(k))] = true
+	}
+	return out
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+// Traffic converts a minute batch record back into a model.TrafficRecord.
+func (r Record) Traffic() model.TrafficRecord {
+	return model.TrafficRecord{
+		Interface:     r.Interface,
+		IP:            r.IP,
+		Prefix:        r.Prefix,
+		DNS:           r.DNS,
+		DNSVerified:   r.DNSVerified,
+		Country:       r.Country,
+		ASN:           r.ASN,
+		ASOrg:         r.ASOrg,
+		RenterKey:     r.RenterKey,
+		ContractID:    r.ContractID,
+		ConsensusUp:   r.ConsensusUp,
+		ConsensusDown: r.ConsensusDown,
+		SiamuxUp:      r.SiamuxUp,
+		SiamuxDown:    r.SiamuxDown,
+		QuicUp:        r.QuicUp,
+		QuicDown:      r.QuicDown,
+		OtherUp:       r.OtherUp,
+		OtherDown:     r.OtherDown,
+		Timestamp:     r.Timestamp,
+	}
+}
+
+// Aggregated converts a daily batch record back into a model.AggregatedRecord.
+func (r Record) Aggregated() model.AggregatedRecord {
+	return model.AggregatedRecord{
+		IP:            r.IP,
+		DNS:           r.DNS,
+		DNSVerified:   r.DNSVerified,
+		Country:       r.Country,
+		ASN:           r.ASN,
+		ASOrg:         r.ASOrg,
+		RenterKey:     r.RenterKey,
+		ContractID:    r.ContractID,
+		ConsensusUp:   r.ConsensusUp,
+		ConsensusDown: r.ConsensusDown,
+		SiamuxUp:      r.SiamuxUp,
+		SiamuxDown:    r.SiamuxDown,
+		QuicUp:        r.QuicUp,
+		QuicDown:      r.QuicDown,
+		OtherUp:       r.OtherUp,
+		OtherDown:     r.OtherDown,
+	}
+}
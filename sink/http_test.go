@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+type received struct {
+	key   string
+	batch Batch
+}
+
+func newHTTPSink(t *testing.T, fail int) (*HTTP, func() []received) {
+	t.Helper()
+	var (
+		mu  sync.Mutex
+		got []received
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var b Batch
+		if err := json.Unmarshal(body, &b); err != nil {
+			t.Errorf("decode batch: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, received{key: r.Header.Get(IdempotencyHeader), batch: b})
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	h := &HTTP{Endpoint: srv.URL, BatchSize: 100, Retries: 2, Kinds: parseKinds("")}
+	return h, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received(nil), got...)
+	}
+}
+
+func TestBatchKeyTracksPayload(t *testing.T) {
+	h, got := newHTTPSink(t, 1)
+	recs := []model.TrafficRecord{{IP: "192.0.2.1", Timestamp: 1700000040, SiamuxUp: 10}}
+
+	// one failure and a retry, then a second flush in the same minute
+	if err := h.SendMinute("host-a", time.Unix(1700000040, 0), recs); err != nil {
+		t.Fatal(err)
+	}
+	recs[0].SiamuxUp = 20
+	if err := h.SendMinute("host-a", time.Unix(1700000040, 0), recs); err != nil {
+		t.Fatal(err)
+	}
+
+	r := got()
+	if len(r) != 3 {
+		t.Fatalf("%d requests, want 3", len(r))
+	}
+	if r[0].key != r[1].key {
+		t.Errorf("retry changed the idempotency key: %s, %s", r[0].key, r[1].key)
+	}
+	if r[1].key == r[2].key {
+		t.Errorf("second flush reused idempotency key %s", r[1].key)
+	}
+	if r[1].batch.Seq == r[2].batch.Seq || r[1].batch.Records[0].ID == r[2].batch.Records[0].ID {
+		t.Errorf("flushes in the same minute share seq %d / record id %s", r[2].batch.Seq, r[2].batch.Records[0].ID)
+	}
+
+	// daily totals keep one id per peer and day, but new values get a new key
+	day := []model.AggregatedRecord{{IP: "192.0.2.1", QuicDown: 5}}
+	h.SendDaily("host-a", "2024-01-02", day)
+	day[0].QuicDown = 6
+	h.SendDaily("host-a", "2024-01-02", day)
+	r = got()
+	a, b := r[len(r)-2], r[len(r)-1]
+	if a.batch.Records[0].ID != b.batch.Records[0].ID {
+		t.Errorf("daily record id changed between pushes")
+	}
+	if a.key == b.key {
+		t.Errorf("daily batches with different totals share key %s", a.key)
+	}
+}
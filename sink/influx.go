@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	defaultMeasurement     = "sia_traffic"
+	defaultInfluxBatchSize = 5000
+
+	// keep UDP datagrams below a typical MTU
+	maxUDPPayload = 1400
+)
+
+// Influx writes minute deltas as InfluxDB line protocol, one line per peer,
+// class and direction:
+//
+//	sia_traffic,host=h1,class=quic,direction=up,ip=203.0.113.7 bytes=1234i 1700000040
+//
+// Lines are POSTed to URL (a v1 /write or v2 /api/v2/write endpoint) or sent
+// as UDP datagrams to UDPAddr.
+type Influx struct {
+	URL         string
+	UDPAddr     string
+	Token       string // sent as "Authorization: Token <token>"
+	Measurement string
+	Tags        tagSet
+	BatchSize   int // lines per request
+	Retries     int
+
+	client *http.Client
+}
+
+// InfluxFromEnv configures the sink from INFLUX_URL or INFLUX_UDP,
+// INFLUX_TOKEN, INFLUX_MEASUREMENT, INFLUX_TAGS, INFLUX_BATCH_SIZE and
+// INFLUX_RETRIES. It returns nil when neither INFLUX_URL nor INFLUX_UDP is
+// set.
+func InfluxFromEnv() *Influx {
+	i := &Influx{
+		URL:         os.Getenv("INFLUX_URL"),
+		UDPAddr:     os.Getenv("INFLUX_UDP"),
+		Token:       os.Getenv("INFLUX_TOKEN"),
+		Measurement: os.Getenv("INFLUX_MEASUREMENT"),
+		Tags:        parseTags("INFLUX_TAGS", os.Getenv("INFLUX_TAGS")),
+		BatchSize:   envInt("INFLUX_BATCH_SIZE", defaultInfluxBatchSize),
+		Retries:     envInt("INFLUX_RETRIES", defaultRetries),
+	}
+	if i.URL == "" && i.UDPAddr == "" {
+		return nil
+	}
+	return i
+}
+
+func (i *Influx) Name() string { return "influx" }
+
+// SendMinute writes one flush worth of deltas, timestamped with the flush
+// so two flushes in the same minute are separate points.
+func (i *Influx) SendMinute(hostname string, at time.Time, recs []model.TrafficRecord) error {
+	pts := points(hostname, at, recs, i.Tags)
+	if len(pts) == 0 {
+		return nil
+	}
+	if i.UDPAddr != "" {
+		if err := i.sendUDP(pts); err != nil {
+			return err
+		}
+	}
+	if i.URL != "" {
+		return chunk(pts, i.BatchSize, i.post)
+	}
+	return nil
+}
+
+// SendDaily is a no-op: Influx derives daily totals from the deltas.
+func (i *Influx) SendDaily(hostname, day string, recs []model.AggregatedRecord) error {
+	return nil
+}
+
+func (i *Influx) post(pts []point) error {
+	u, err := url.Parse(i.URL)
+	if err != nil {
+		return fmt.Errorf("invalid INFLUX_URL: %w", err)
+	}
+	// timestamps are unix seconds
+	q := u.Query()
+	if q.Get("precision") == "" {
+		q.Set("precision", "s")
+		u.RawQuery = q.Encode()
+	}
+
+	var buf bytes.Buffer
+	for _, p := range pts {
+		i.writeLine(&buf, p)
+	}
+	body := buf.Bytes()
+
+	if i.client == nil {
+		i.client = &http.Client{Timeout: httpTimeout}
+	}
+	return retry(i.Retries, func() error {
+		req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if i.Token != "" {
+			req.Header.Set("Authorization", "Token "+i.Token)
+		}
+		return doRequest(i.client, req)
+	})
+}
+
+// sendUDP packs lines into datagrams of at most maxUDPPayload bytes.
+func (i *Influx) sendUDP(pts []point) error {
+	conn, err := net.Dial("udp", i.UDPAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var pkt, line bytes.Buffer
+	flush := func() error {
+		if pkt.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(pkt.Bytes())
+		pkt.Reset()
+		return err
+	}
+	for _, p := range pts {
+		line.Reset()
+		i.writeLine(&line, p)
+		if pkt.Len()+line.Len() > maxUDPPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		pkt.Write(line.Bytes())
+	}
+	return flush()
+}
+
+func (i *Influx) writeLine(buf *bytes.Buffer, p point) {
+	m := i.Measurement
+	if m == "" {
+		m = defaultMeasurement
+	}
+	buf.WriteString(escapeInflux(m, false))
+	for _, t := range p.tags {
+		// empty tag values are not allowed in line protocol
+		if t.value == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(escapeInflux(t.key, true))
+		buf.WriteByte('=')
+		buf.WriteString(escapeInflux(t.value, true))
+	}
+	buf.WriteString(" bytes=")
+	buf.WriteString(strconv.FormatUint(p.bytes, 10))
+	buf.WriteString("i ")
+	buf.WriteString(strconv.FormatInt(p.time, 10))
+	buf.WriteByte('\n')
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// escapeInflux escapes a measurement name or a tag key/value.
+func escapeInflux(s string, tag bool) string {
+	if tag {
+		return tagEscaper.Replace(s)
+	}
+	return measurementEscaper.Replace(s)
+}
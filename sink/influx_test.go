@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// influxServer records the query and line bodies of every write.
+type influxServer struct {
+	mu      sync.Mutex
+	queries []string
+	auth    []string
+	bodies  []string
+}
+
+func newInfluxServer(t *testing.T) (*influxServer, *httptest.Server) {
+	t.Helper()
+	s := &influxServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.queries = append(s.queries, r.URL.RawQuery)
+		s.auth = append(s.auth, r.Header.Get("Authorization"))
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestInfluxPost(t *testing.T) {
+	s, srv := newInfluxServer(t)
+	i := &Influx{
+		URL:         srv.URL + "/api/v2/write?org=o&bucket=b",
+		Token:       "secret",
+		Measurement: "sia traffic,v2",
+		Tags:        parseTags("INFLUX_TAGS", ""),
+	}
+	at := time.Date(2024, 1, 2, 12, 1, 0, 0, time.UTC)
+	recs := []model.TrafficRecord{{IP: "192.0.2.1", QuicUp: 10, SiamuxDown: 3}}
+
+	if err := i.SendMinute("web 1,dc=eu", at, recs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.bodies) != 1 {
+		t.Fatalf("%d requests, want 1", len(s.bodies))
+	}
+	if q := s.queries[0]; q != "bucket=b&org=o&precision=s" {
+		t.Errorf("query = %q, want precision=s added to the configured parameters", q)
+	}
+	if s.auth[0] != "Token secret" {
+		t.Errorf("Authorization = %q", s.auth[0])
+	}
+	want := fmt.Sprintf(`sia\ traffic\,v2,host=web\ 1\,dc\=eu,class=siamux,direction=down,ip=192.0.2.1 bytes=3i %[1]d
+sia\ traffic\,v2,host=web\ 1\,dc\=eu,class=quic,direction=up,ip=192.0.2.1 bytes=10i %[1]d
+`, at.Unix())
+	if s.bodies[0] != want {
+		t.Errorf("body:\n%s\nwant:\n%s", s.bodies[0], want)
+	}
+}
+
+func TestInfluxKeepsPrecision(t *testing.T) {
+	s, srv := newInfluxServer(t)
+	i := &Influx{URL: srv.URL + "/write?db=sia&precision=s", Tags: parseTags("INFLUX_TAGS", "")}
+	recs := []model.TrafficRecord{{IP: "192.0.2.1", QuicUp: 1}}
+
+	if err := i.SendMinute("h1", time.Unix(1700000040, 0), recs); err != nil {
+		t.Fatal(err)
+	}
+	if q := s.queries[0]; q != "db=sia&precision=s" {
+		t.Fatalf("query = %q", q)
+	}
+}
+
+func TestInfluxTags(t *testing.T) {
+	const ts = 1700000040
+	recs := []model.TrafficRecord{
+		{IP: "192.0.2.1", Prefix: "192.0.2.0/24", QuicUp: 10, SiamuxDown: 3},
+		{IP: "192.0.2.2", Prefix: "192.0.2.0/24", QuicUp: 5},
+		{IP: "198.51.100.1", QuicDown: 7},
+	}
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{"host,class,direction,ip", []string{
+			"sia_traffic,host=h1,class=siamux,direction=down,ip=192.0.2.1 bytes=3i 1700000040",
+			"sia_traffic,host=h1,class=quic,direction=up,ip=192.0.2.1 bytes=10i 1700000040",
+			"sia_traffic,host=h1,class=quic,direction=up,ip=192.0.2.2 bytes=5i 1700000040",
+			"sia_traffic,host=h1,class=quic,direction=down,ip=198.51.100.1 bytes=7i 1700000040",
+		}},
+		{"host,class,direction", []string{
+			"sia_traffic,host=h1,class=siamux,direction=down bytes=3i 1700000040",
+			"sia_traffic,host=h1,class=quic,direction=up bytes=15i 1700000040",
+			"sia_traffic,host=h1,class=quic,direction=down bytes=7i 1700000040",
+		}},
+		// the peer without a prefix gets no prefix tag rather than an empty one
+		{"prefix", []string{
+			"sia_traffic,prefix=192.0.2.0/24 bytes=18i 1700000040",
+			"sia_traffic bytes=7i 1700000040",
+		}},
+		{"direction,bogus,host", []string{
+			"sia_traffic,direction=down,host=h1 bytes=10i 1700000040",
+			"sia_traffic,direction=up,host=h1 bytes=15i 1700000040",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tags, func(t *testing.T) {
+			i := &Influx{Tags: parseTags("INFLUX_TAGS", tt.tags)}
+			var buf bytes.Buffer
+			for _, p := range points("h1", time.Unix(ts, 0), recs, i.Tags) {
+				i.writeLine(&buf, p)
+			}
+			if got, want := buf.String(), strings.Join(tt.want, "\n")+"\n"; got != want {
+				t.Errorf("lines:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestInfluxBatches(t *testing.T) {
+	s, srv := newInfluxServer(t)
+	i := &Influx{URL: srv.URL + "/write", Tags: parseTags("INFLUX_TAGS", ""), BatchSize: 2}
+	var recs []model.TrafficRecord
+	for n := 1; n <= 5; n++ {
+		recs = append(recs, model.TrafficRecord{IP: fmt.Sprintf("192.0.2.%d", n), QuicUp: uint64(n)})
+	}
+
+	if err := i.SendMinute("h1", time.Unix(1700000040, 0), recs); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, b := range s.bodies {
+		sizes = append(sizes, strings.Count(b, "\n"))
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Fatalf("lines per request = %v, want [2 2 1]", sizes)
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	i := &Influx{UDPAddr: conn.LocalAddr().String(), Tags: parseTags("INFLUX_TAGS", "")}
+	var recs []model.TrafficRecord
+	for n := 0; n < 60; n++ {
+		recs = append(recs, model.TrafficRecord{IP: fmt.Sprintf("2001:db8::%x", n), QuicUp: 1, QuicDown: 2})
+	}
+	if err := i.SendMinute("h1", time.Unix(1700000040, 0), recs); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines, datagrams int
+	buf := make([]byte, 64<<10)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for lines < 2*len(recs) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("after %d lines: %v", lines, err)
+		}
+		if n > maxUDPPayload {
+			t.Errorf("datagram of %d bytes, limit %d", n, maxUDPPayload)
+		}
+		if buf[n-1] != '\n' {
+			t.Errorf("datagram splits a line: %q", buf[n-20:n])
+		}
+		lines += bytes.Count(buf[:n], []byte("\n"))
+		datagrams++
+	}
+	if datagrams < 2 {
+		t.Fatalf("%d lines sent in %d datagram, want them spread over several", lines, datagrams)
+	}
+}
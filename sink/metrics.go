@@ -0,0 +1,142 @@
+package sink
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// Tags that metric sinks can attach to each point (INFLUX_TAGS, OTLP_TAGS).
+// Leaving a tag out sums the points that differ only in that tag, e.g.
+// without ip every point is a host-wide total per class and direction.
+const (
+	TagHost      = "host"
+	TagClass     = "class"
+	TagDirection = "direction"
+	TagIP        = "ip"
+	TagPrefix    = "prefix"
+
+	defaultTags = "host,class,direction,ip"
+)
+
+// point is one class/direction byte delta for a peer, reduced to the
+// configured tags.
+type point struct {
+	tags  []tag // in the order of the tag set
+	bytes uint64
+	time  int64 // unix seconds, end of the flush interval
+}
+
+type tag struct{ key, value string }
+
+// tagSet is an ordered set of tag names.
+type tagSet []string
+
+func (t tagSet) has(name string) bool {
+	for _, n := range t {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags parses a comma separated tag list, falling back to defaultTags
+// when s is empty.
+func parseTags(env, s string) tagSet {
+	if strings.TrimSpace(s) == "" {
+		s = defaultTags
+	}
+	var out tagSet
+	for _, n := range strings.Split(s, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		switch n {
+		case "":
+			continue
+		case TagHost, TagClass, TagDirection, TagIP, TagPrefix:
+			if !out.has(n) {
+				out = append(out, n)
+			}
+		default:
+			log.Printf("sink: %s: ignoring unknown tag %q", env, n)
+		}
+	}
+	return out
+}
+
+// points flattens one flush at time at into one point per non-zero counter
+// and sums the points that share all configured tags.
+func points(hostname string, at time.Time, recs []model.TrafficRecord, tags tagSet) []point {
+	idx := make(map[string]int)
+	var out []point
+
+	for _, r := range recs {
+		for _, c := range []struct {
+			class, dir string
+			n          uint64
+		}{
+			{"consensus", "up", r.ConsensusUp},
+			{"consensus", "down", r.ConsensusDown},
+			{"siamux", "up", r.SiamuxUp},
+			{"siamux", "down", r.SiamuxDown},
+			{"quic", "up", r.QuicUp},
+			{"quic", "down", r.QuicDown},
+			{"other", "up", r.OtherUp},
+			{"other", "down", r.OtherDown},
+		} {
+			if c.n == 0 {
+				continue
+			}
+
+			p := point{bytes: c.n, time: at.Unix()}
+			for _, name := range tags {
+				var v string
+				switch name {
+				case TagHost:
+					v = hostname
+				case TagClass:
+					v = c.class
+				case TagDirection:
+					v = c.dir
+				case TagIP:
+					v = r.IP
+				case TagPrefix:
+					v = r.Prefix
+				}
+				p.tags = append(p.tags, tag{name, v})
+			}
+
+			key := fmt.Sprint(p.time, p.tags)
+			if i, ok := idx[key]; ok {
+				out[i].bytes += p.bytes
+				continue
+			}
+			idx[key] = len(out)
+			out = append(out, p)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].time < out[j].time })
+	return out
+}
+
+// chunk calls fn for consecutive slices of at most size points.
+func chunk(pts []point, size int, fn func([]point) error) error {
+	if size <= 0 {
+		size = len(pts)
+	}
+	for i := 0; i < len(pts); i += size {
+		end := i + size
+		if end > len(pts) {
+			end = len(pts)
+		}
+		if err := fn(pts[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
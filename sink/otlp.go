@@ -0,0 +1,206 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+const (
+	otlpMetricName       = "sia.traffic.bytes"
+	otlpScope            = "github.com/back2basic/collector"
+	otlpDeltaTemporality = 1 // AGGREGATION_TEMPORALITY_DELTA
+
+	defaultOTLPBatchSize = 1000
+	flushInterval        = time.Minute
+)
+
+// OTLP exports minute deltas as an OTLP/HTTP JSON metrics request: a
+// monotonic delta sum named sia.traffic.bytes with one data point per peer,
+// class and direction. The host tag becomes the host.name resource
+// attribute, the other tags data point attributes.
+type OTLP struct {
+	Endpoint  string // e.g. http://localhost:4318/v1/metrics
+	Headers   map[string]string
+	Tags      tagSet
+	BatchSize int // data points per request
+	Retries   int
+
+	client *http.Client
+	mu     sync.Mutex
+	last   map[string]time.Time // end of the previous interval per host
+}
+
+// OTLPFromEnv configures the sink from OTLP_ENDPOINT, OTLP_HEADERS
+// (k=v,k=v), OTLP_TAGS, OTLP_BATCH_SIZE and OTLP_RETRIES. It returns nil
+// when OTLP_ENDPOINT is unset.
+func OTLPFromEnv() *OTLP {
+	endpoint := os.Getenv("OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+	return &OTLP{
+		Endpoint:  endpoint,
+		Headers:   parseHeaders(os.Getenv("OTLP_HEADERS")),
+		Tags:      parseTags("OTLP_TAGS", os.Getenv("OTLP_TAGS")),
+		BatchSize: envInt("OTLP_BATCH_SIZE", defaultOTLPBatchSize),
+		Retries:   envInt("OTLP_RETRIES", defaultRetries),
+	}
+}
+
+func (o *OTLP) Name() string { return "otlp" }
+
+// SendMinute exports one flush worth of deltas. The counters were reset
+// at the previous flush, so each interval starts where the last one ended;
+// the first interval after a start covers one flushInterval.
+func (o *OTLP) SendMinute(hostname string, at time.Time, recs []model.TrafficRecord) error {
+	start := o.interval(hostname, at)
+	pts := points(hostname, at, recs, o.Tags)
+	return chunk(pts, o.BatchSize, func(pts []point) error {
+		return o.post(hostname, start, at, pts)
+	})
+}
+
+// interval returns the start of the interval ending at end and remembers
+// end as the next start.
+func (o *OTLP) interval(hostname string, end time.Time) time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.last == nil {
+		o.last = make(map[string]time.Time)
+	}
+	start, ok := o.last[hostname]
+	if !ok || !start.Before(end) {
+		start = end.Add(-flushInterval)
+	}
+	o.last[hostname] = end
+	return start
+}
+
+// SendDaily is a no-op: the backend derives daily totals from the deltas.
+func (o *OTLP) SendDaily(hostname, day string, recs []model.AggregatedRecord) error {
+	return nil
+}
+
+// JSON encoding of ExportMetricsServiceRequest (opentelemetry-proto).
+// 64-bit integers are strings in the protobuf JSON mapping.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScopeInfo `json:"scope"`
+		Metrics []otlpMetric  `json:"metrics"`
+	}
+	otlpScopeInfo struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name string  `json:"name"`
+		Unit string  `json:"unit"`
+		Sum  otlpSum `json:"sum"`
+	}
+	otlpSum struct {
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsInt             string         `json:"asInt"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+func (o *OTLP) post(hostname string, start, end time.Time, pts []point) error {
+	res := []otlpKeyValue{{"service.name", otlpValue{"collector"}}}
+	if o.Tags.has(TagHost) {
+		res = append(res, otlpKeyValue{"host.name", otlpValue{hostname}})
+	}
+
+	dps := make([]otlpDataPoint, 0, len(pts))
+	for _, p := range pts {
+		var attrs []otlpKeyValue
+		for _, t := range p.tags {
+			if t.key == TagHost {
+				continue
+			}
+			attrs = append(attrs, otlpKeyValue{"sia." + t.key, otlpValue{t.value}})
+		}
+		dps = append(dps, otlpDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			TimeUnixNano:      strconv.FormatInt(end.UnixNano(), 10),
+			AsInt:             strconv.FormatUint(p.bytes, 10),
+		})
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: res},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScopeInfo{Name: otlpScope},
+			Metrics: []otlpMetric{{
+				Name: otlpMetricName,
+				Unit: "By",
+				Sum: otlpSum{
+					AggregationTemporality: otlpDeltaTemporality,
+					IsMonotonic:            true,
+					DataPoints:             dps,
+				},
+			}},
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	if o.client == nil {
+		o.client = &http.Client{Timeout: httpTimeout}
+	}
+	return retry(o.Retries, func() error {
+		req, err := http.NewRequest(http.MethodPost, o.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range o.Headers {
+			req.Header.Set(k, v)
+		}
+		return doRequest(o.client, req)
+	})
+}
+
+// parseHeaders parses "k=v,k=v" as used by OTEL_EXPORTER_OTLP_HEADERS.
+func parseHeaders(s string) map[string]string {
+	out := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+func TestOTLPDeltaIntervals(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []otlpRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type %q", ct)
+		}
+		if r.Header.Get("X-Team") != "ops" {
+			t.Errorf("OTLP_HEADERS not sent")
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	o := &OTLP{
+		Endpoint:  srv.URL,
+		Headers:   parseHeaders("X-Team=ops"),
+		Tags:      parseTags("OTLP_TAGS", ""),
+		BatchSize: 100,
+	}
+	minute := time.Date(2024, 1, 2, 12, 1, 0, 0, time.UTC)
+	recs := []model.TrafficRecord{{IP: "192.0.2.1", Timestamp: minute.Unix(), QuicUp: 10, SiamuxDown: 3}}
+
+	// the regular flush, then the final flush on shutdown in the same minute
+	flushes := []time.Time{minute.Add(300 * time.Millisecond), minute.Add(40 * time.Second)}
+	for _, at := range flushes {
+		if err := o.SendMinute("host-a", at, recs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(reqs) != 2 {
+		t.Fatalf("%d requests, want 2", len(reqs))
+	}
+	wantStart := []time.Time{flushes[0].Add(-flushInterval), flushes[0]}
+	for i, req := range reqs {
+		rm := req.ResourceMetrics[0]
+		if got := rm.Resource.Attributes; len(got) != 2 || got[1] != (otlpKeyValue{"host.name", otlpValue{"host-a"}}) {
+			t.Errorf("resource attributes = %v", got)
+		}
+		m := rm.ScopeMetrics[0].Metrics[0]
+		if m.Name != otlpMetricName || m.Sum.AggregationTemporality != otlpDeltaTemporality || !m.Sum.IsMonotonic {
+			t.Errorf("metric = %+v", m)
+		}
+		if len(m.Sum.DataPoints) != 2 {
+			t.Fatalf("%d data points, want 2", len(m.Sum.DataPoints))
+		}
+		for _, dp := range m.Sum.DataPoints {
+			if dp.StartTimeUnixNano != nanos(wantStart[i]) || dp.TimeUnixNano != nanos(flushes[i]) {
+				t.Errorf("flush %d: interval %s-%s, want %s-%s", i,
+					dp.StartTimeUnixNano, dp.TimeUnixNano, nanos(wantStart[i]), nanos(flushes[i]))
+			}
+		}
+	}
+	values := map[string]bool{}
+	for _, dp := range reqs[0].ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum.DataPoints {
+		values[dp.AsInt] = true
+	}
+	if !values["10"] || !values["3"] {
+		t.Errorf("data point values %v, want 10 and 3", values)
+	}
+}
+
+func nanos(t time.Time) string {
+	b, _ := json.Marshal(t.UnixNano())
+	return string(b)
+}
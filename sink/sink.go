@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// Kinds of batches sent to sinks.
+const (
+	KindMinute = "minute"
+	KindDaily  = "daily"
+)
+
+// Sink is a remote destination for flushed records.
+type Sink interface {
+	Name() string
+	SendMinute(hostname string, at time.Time, recs []model.TrafficRecord) error
+	SendDaily(hostname, day string, recs []model.AggregatedRecord) error
+}
+
+// FromEnv returns every sink configured in the environment.
+func FromEnv() []Sink {
+	var out []Sink
+	if s := HTTPFromEnv(); s != nil {
+		out = append(out, s)
+	}
+	if s := InfluxFromEnv(); s != nil {
+		out = append(out, s)
+	}
+	if s := OTLPFromEnv(); s != nil {
+		out = append(out, s)
+	}
+	return out
+}
+
+// RecordID derives a stable id for one record, like storage.makeRowID does
+// for Appwrite rows, so receivers can deduplicate retried uploads.
+func RecordID(hostname, ip, slot string) string {
+	h := sha1.New()
+	h.Write([]byte(hostname))
+	h.Write([]byte(ip))
+	h.Write([]byte(slot))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+type job struct {
+	kind     string
+	hostname string
+	at       time.Time // flush time of minute batches
+	day      string
+	minute   []model.TrafficRecord
+	daily    []model.AggregatedRecord
+}
+
+// Dispatcher hands batches to sinks on a background goroutine so a slow or
+// unreachable endpoint never delays a flush. The queue is bounded; when it
+// is full the batch is dropped and logged.
+type Dispatcher struct {
+	sinks []Sink
+	queue chan job
+	wg    sync.WaitGroup
+}
+
+// NewDispatcher starts a dispatcher for sinks. It returns nil when there are
+// no sinks; a nil *Dispatcher ignores all calls.
+func NewDispatcher(sinks []Sink, queueSize int) *Dispatcher {
+	if len(sinks) == 0 {
+		return nil
+	}
+	d := &Dispatcher{sinks: sinks, queue: make(chan job, queueSize)}
+	d.wg.Add(1)
+	go d.run()
+	return d
+}
+
+// Minute queues one flush worth of records. at is the time of the flush;
+// the record timestamps are truncated to the minute.
+func (d *Dispatcher) Minute(hostname string, at time.Time, recs []model.TrafficRecord) {
+	if d == nil || len(recs) == 0 {
+		return
+	}
+	d.enqueue(job{kind: KindMinute, hostname: hostname, at: at, minute: recs})
+}
+
+// Daily queues today's totals.
+func (d *Dispatcher) Daily(hostname, day string, recs []model.AggregatedRecord) {
+	if d == nil || len(recs) == 0 {
+		return
+	}
+	d.enqueue(job{kind: KindDaily, hostname: hostname, day: day, daily: recs})
+}
+
+// Close stops accepting batches and waits until queued ones are sent.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+	close(d.queue)
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) enqueue(j job) {
+	select {
+	case d.queue <- j:
+	default:
+		log.Printf("sink: queue full, dropping %s batch", j.kind)
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+	for j := range d.queue {
+		for _, s := range d.sinks {
+			var err error
+			switch j.kind {
+			case KindMinute:
+				err = s.SendMinute(j.hostname, j.at, j.minute)
+			case KindDaily:
+				err = s.SendDaily(j.hostname, j.day, j.daily)
+			}
+			if err != nil {
+				log.Printf("sink %s: %s batch: %v", s.Name(), j.kind, err)
+			}
+		}
+	}
+}
+
+// retry calls fn until it succeeds, fails with a non-retryable errStatus or
+// has been tried retries+1 times, backing off exponentially in between.
+func retry(retries int, fn func() error) error {
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBase << (attempt - 1))
+		}
+
+		lastErr = fn()
+		if lastErr == nil {
+			return nil
+		}
+		var se errStatus
+		if errors.As(lastErr, &se) && !se.retryable() {
+			return lastErr
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", retries+1, lastErr)
+}
+
+// doRequest sends req and turns a non-2xx response into an errStatus.
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errStatus{code: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// errStatus is an HTTP error response; 5xx and 429 are retried.
+type errStatus struct {
+	code int
+	body string
+}
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("http %d: %s", e.code, e.body)
+}
+
+func (e errStatus) retryable() bool {
+	return e.code >= 500 || e.code == 429
+}
@@ -17,6 +17,12 @@ import (
 
 var sdk *Appwrite
 
+const (
+	outboxBatchSize = 100
+	retryBase       = 30 * time.Second
+	retryMax        = time.Hour
+)
+
 type Appwrite struct {
 	client *client.Client
 	db     *tablesdb.TablesDB
@@ -32,6 +38,12 @@ func init() {
 		return
 	}
 
+	ConfigureAppwrite(endpoint, project, apiKey)
+}
+
+// ConfigureAppwrite (re)initialises the Appwrite client. init calls it from
+// APPWRITE_ENDPOINT/PROJECT/API_KEY; tests can point it at a local server.
+func ConfigureAppwrite(endpoint, project, apiKey string) {
 	client := appwrite.NewClient(
 		appwrite.WithEndpoint(endpoint),
 		appwrite.WithProject(project),
@@ -55,6 +67,9 @@ func makeRowID(hostname, ip, day string) string {
 	return sum[:32] // Appwrite max 36 chars, keep 32 }
 }
 
+// PushDailyToAppwrite queues today's totals in the durable outbox and then
+// drains every due outbox row. Rows that fail stay queued and are retried
+// with exponential backoff on later pushes, including after a restart.
 func PushDailyToAppwrite(hostname string, rows []model.AggregatedRecord) error {
 	if sdk == nil || sdk.client == nil {
 		return nil
@@ -69,7 +84,6 @@ func PushDailyToAppwrite(hostname string, rows []model.AggregatedRecord) error {
 
 	day := time.Now().Format("2006-01-02")
 
-	totalRows := 0
 	for _, r := range rows {
 		rowID := makeRowID(hostname, r.IP, day)
 
@@ -97,23 +111,27 @@ func PushDailyToAppwrite(hostname string, rows []model.AggregatedRecord) error {
 			// "updated_at":    time.Now().Unix(),
 		}
 
-		// log.Println("APPWRITE: upserting row", data)
+		// only sent when GeoIP enrichment produced something, so tables
+		// without these columns keep working
+		if r.Country != "" || r.ASN != 0 {
+			data["country"] = r.Country
+			data["asn"] = r.ASN
+			data["as_org"] = r.ASOrg
+		}
 
-		_, err := sdk.db.UpsertRow(dbID, tableID, rowID, sdk.db.WithUpsertRowData(data))
-		if err != nil {
-			log.Printf("APPWRITE: failed to upsert %s: %v", rowID, err)
+		if err := enqueueOutbox(rowID, data); err != nil {
+			return fmt.Errorf("queue %s: %w", rowID, err)
 		}
-		totalRows++
-		// _, err := sdk.db.UpdateRow(dbID, tableID, rowID, sdk.db.WithUpdateRowData(data))
-		// if err != nil {
-		// 	_, err = sdk.db.CreateRow(dbID, tableID, rowID, data)
-		// 	if err != nil {
-		// 		log.Printf("APPWRITE: failed to upsert %s: %v", rowID, err)
-		// 	}
-		// }
 	}
 
-	log.Printf("APPWRITE: pushed %d rows to Appwrite", totalRows)
+	res, err := drainOutbox(dbID, tableID)
+	log.Printf("APPWRITE: pushed %d rows to Appwrite, %d failed, %d pending", res.sent, res.failed, res.pending)
+	if err != nil {
+		return err
+	}
+	if res.failed > 0 {
+		return fmt.Errorf("%d of %d rows failed, last error: %s", res.failed, res.sent+res.failed, res.lastErr)
+	}
 	return nil
 }
 
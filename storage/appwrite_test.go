@@ -0,0 +1,244 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/model"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+// appwriteStub records the row upserts it receives and fails them while
+// fail is set.
+type appwriteStub struct {
+	mu       sync.Mutex
+	fail     bool
+	requests []string                  // method and path per request
+	rows     map[string]map[string]any // row ID -> last data
+}
+
+func newAppwriteStub(t *testing.T) *appwriteStub {
+	t.Helper()
+	s := &appwriteStub{rows: map[string]map[string]any{}}
+	srv := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("APPWRITE_DATABASE", "db")
+	t.Setenv("APPWRITE_TABLE", "traffic")
+	storage.ConfigureAppwrite(srv.URL+"/v1", "project", "key")
+	t.Cleanup(storage.ResetAppwrite)
+	return s
+}
+
+func (s *appwriteStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	if s.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"message": "unavailable", "code": 503})
+		return
+	}
+
+	var body struct {
+		Data map[string]any   `json:"data"`
+		Rows []map[string]any `json:"rows"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/v1/tablesdb/db/tables/traffic/rows":
+		for _, row := range body.Rows {
+			s.rows[row["$id"].(string)] = row
+		}
+		json.NewEncoder(w).Encode(map[string]any{"total": len(body.Rows), "rows": []any{}})
+	default:
+		id := filepath.Base(r.URL.Path)
+		s.rows[id] = body.Data
+		json.NewEncoder(w).Encode(map[string]any{"$id": id})
+	}
+}
+
+func (s *appwriteStub) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func (s *appwriteStub) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func dailyRows(ips ...string) []model.AggregatedRecord {
+	out := make([]model.AggregatedRecord, 0, len(ips))
+	for i, ip := range ips {
+		out = append(out, model.AggregatedRecord{IP: ip, SiamuxDown: uint64(1000 * (i + 1)), QuicUp: 7})
+	}
+	return out
+}
+
+type outboxState struct {
+	attempts    int
+	nextAttempt int64
+}
+
+func outboxRows(t *testing.T) map[string]outboxState {
+	t.Helper()
+	rows, err := storage.DB.Query(`SELECT row_id, attempts, next_attempt FROM appwrite_outbox`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	out := map[string]outboxState{}
+	for rows.Next() {
+		var id string
+		var st outboxState
+		if err := rows.Scan(&id, &st.attempts, &st.nextAttempt); err != nil {
+			t.Fatal(err)
+		}
+		out[id] = st
+	}
+	return out
+}
+
+func TestPushDailyBatchUpsert(t *testing.T) {
+	storagetest.Open(t)
+	stub := newAppwriteStub(t)
+
+	// the zero row is skipped
+	rows := append(dailyRows("192.0.2.1", "192.0.2.2", "2001:db8::1"), model.AggregatedRecord{IP: "192.0.2.9"})
+	if err := storage.PushDailyToAppwrite("host-a", rows); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := stub.calls(); len(got) != 1 || got[0] != "PUT /v1/tablesdb/db/tables/traffic/rows" {
+		t.Fatalf("requests = %v, want one bulk upsert", got)
+	}
+	if len(stub.rows) != 3 {
+		t.Fatalf("upserted %d rows, want 3", len(stub.rows))
+	}
+	day := time.Now().Format("2006-01-02")
+	row := stub.rows[storage.MakeRowID("host-a", "192.0.2.2", day)]
+	if row == nil || row["ip"] != "192.0.2.2" || row["down_9984_tcp"] != float64(2000) || row["hostname"] != "host-a" {
+		t.Fatalf("row for 192.0.2.2 = %v", row)
+	}
+	if n := len(outboxRows(t)); n != 0 {
+		t.Fatalf("%d rows left in the outbox", n)
+	}
+}
+
+func TestPushDailySingleRowEndpoint(t *testing.T) {
+	storagetest.Open(t)
+	stub := newAppwriteStub(t)
+	t.Setenv("APPWRITE_BATCH_SIZE", "1")
+
+	if err := storage.PushDailyToAppwrite("host-a", dailyRows("192.0.2.1", "192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls()
+	if len(calls) != 2 || calls[0] == "PUT /v1/tablesdb/db/tables/traffic/rows" {
+		t.Fatalf("requests = %v, want two single row upserts", calls)
+	}
+}
+
+func TestPushDailyRetryBackoff(t *testing.T) {
+	storagetest.Open(t)
+	stub := newAppwriteStub(t)
+	stub.setFail(true)
+	id := storage.MakeRowID("host-a", "192.0.2.1", time.Now().Format("2006-01-02"))
+
+	start := time.Now().Unix()
+	if err := storage.PushDailyToAppwrite("host-a", dailyRows("192.0.2.1")); err == nil {
+		t.Fatal("push against a failing server succeeded")
+	}
+	st := outboxRows(t)[id]
+	if st.attempts != 1 || st.nextAttempt < start+int64(storage.RetryBase/time.Second) {
+		t.Fatalf("after one failure: %+v, want 1 attempt and a retry in %s", st, storage.RetryBase)
+	}
+
+	// not due yet: nothing is sent
+	if err := storage.PushDailyToAppwrite("host-a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.calls()); n != 1 {
+		t.Fatalf("%d requests, want the row to wait for its backoff", n)
+	}
+
+	// due again and failing: the delay doubles
+	if _, err := storage.DB.Exec(`UPDATE appwrite_outbox SET next_attempt = 0`); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now().Unix()
+	storage.PushDailyToAppwrite("host-a", nil)
+	st = outboxRows(t)[id]
+	if st.attempts != 2 || st.nextAttempt < start+int64(2*storage.RetryBase/time.Second) {
+		t.Fatalf("after two failures: %+v, want 2 attempts and a retry in %s", st, 2*storage.RetryBase)
+	}
+
+	stub.setFail(false)
+	if _, err := storage.DB.Exec(`UPDATE appwrite_outbox SET next_attempt = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PushDailyToAppwrite("host-a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(outboxRows(t)) != 0 || stub.rows[id] == nil {
+		t.Fatalf("row not delivered after the server recovered")
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	path := storagetest.Open(t)
+	stub := newAppwriteStub(t)
+	stub.setFail(true)
+
+	storage.PushDailyToAppwrite("host-a", dailyRows("192.0.2.1", "192.0.2.2"))
+	if n := len(outboxRows(t)); n != 2 {
+		t.Fatalf("%d rows queued, want 2", n)
+	}
+
+	// restart: reopen the same file
+	storage.DB.Close()
+	if err := storage.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(outboxRows(t)); n != 2 {
+		t.Fatalf("%d rows queued after reopening, want 2", n)
+	}
+
+	stub.setFail(false)
+	if _, err := storage.DB.Exec(`UPDATE appwrite_outbox SET next_attempt = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PushDailyToAppwrite("host-a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.rows) != 2 || len(outboxRows(t)) != 0 {
+		t.Fatalf("delivered %d rows, %d left queued", len(stub.rows), len(outboxRows(t)))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, storage.RetryBase},
+		{2, 2 * storage.RetryBase},
+		{3, 4 * storage.RetryBase},
+		{20, storage.RetryMax},
+	} {
+		if got := storage.Backoff(tc.attempts); got != tc.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/back2basic/collector/dns"
+)
+
+// DNSCache persists the reverse DNS cache in the dns_cache table so a
+// restart does not trigger a burst of PTR queries.
+type DNSCache struct{}
+
+// LoadDNSCache returns all unexpired cache rows.
+func (DNSCache) LoadDNSCache() ([]dns.Entry, error) {
+	rows, err := DB.Query(`SELECT ip, name, verified, expires FROM dns_cache WHERE expires > ?`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []dns.Entry
+	for rows.Next() {
+		var e dns.Entry
+		var exp int64
+		if err := rows.Scan(&e.IP, &e.Name, &e.Verified, &exp); err != nil {
+			return nil, err
+		}
+		e.Expires = time.Unix(exp, 0)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// SaveDNSCache replaces the stored cache with entries.
+func (DNSCache) SaveDNSCache(entries []dns.Entry) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM dns_cache`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO dns_cache (ip, name, verified, expires) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.Exec(e.IP, e.Name, int(e.Verified), e.Expires.Unix()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ClearDNSCache deletes every stored name.
+func ClearDNSCache() error {
+	_, err := DB.Exec(`DELETE FROM dns_cache`)
+	return err
+}
+
+// PurgeDNSCache deletes stored names that expired before before.
+func PurgeDNSCache(before int64) (int64, error) {
+	res, err := DB.Exec(`DELETE FROM dns_cache WHERE expires < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,12 @@
+package storage
+
+// Unexported names used by the external tests.
+var (
+	MakeRowID = makeRowID
+	Backoff   = backoff
+	RetryBase = retryBase
+	RetryMax  = retryMax
+)
+
+// ResetAppwrite forgets the client set with ConfigureAppwrite.
+func ResetAppwrite() { sdk = nil }
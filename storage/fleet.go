@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/back2basic/collector/model"
+)
+
+// Tables used by `collector server` to hold pushes from many collectors.
+// fleet_minute sums every flush a collector sent for (hostname, ip, minute);
+// fleet_seen remembers the record IDs already added, so a retried upload is
+// skipped instead of counted twice.
+const fleetSchema = `
+    CREATE TABLE IF NOT EXISTS fleet_minute (
+        hostname TEXT NOT NULL,
+        ip TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        interface TEXT DEFAULT '',
+        prefix TEXT DEFAULT '',
+        dns TEXT DEFAULT '',
+        country TEXT DEFAULT '',
+        asn INTEGER DEFAULT 0,
+        as_org TEXT DEFAULT '',
+        renter_key TEXT DEFAULT '',
+        contract_id TEXT DEFAULT '',
+        consensus_up INTEGER DEFAULT 0,
+        consensus_down INTEGER DEFAULT 0,
+        siamux_up INTEGER DEFAULT 0,
+        siamux_down INTEGER DEFAULT 0,
+        quic_up INTEGER DEFAULT 0,
+        quic_down INTEGER DEFAULT 0,
+        other_up INTEGER DEFAULT 0,
+        other_down INTEGER DEFAULT 0,
+        PRIMARY KEY (hostname, ip, timestamp)
+    );
+    CREATE INDEX IF NOT EXISTS fleet_minute_ts ON fleet_minute (timestamp);
+
+    CREATE TABLE IF NOT EXISTS fleet_seen (
+        hostname TEXT NOT NULL,
+        id TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        PRIMARY KEY (hostname, id)
+    );
+    CREATE INDEX IF NOT EXISTS fleet_seen_ts ON fleet_seen (timestamp);
+
+    -- daily totals are summed from fleet_minute
+    DROP TABLE IF EXISTS fleet_daily;
+`
+
+// fleetSeenRetention is how long record IDs are remembered. Collectors
+// give up retrying long before.
+const fleetSeenRetention = 48 * time.Hour
+
+// FleetRecord is a minute record received from a collector. ID is the sink
+// record ID; empty IDs are never deduplicated.
+type FleetRecord struct {
+	ID string
+	model.TrafficRecord
+}
+
+// fleetGroupColumns maps the groupings of QueryDailyTotalsBy onto the
+// fleet_minute table.
+var fleetGroupColumns = map[string]string{
+	GroupHost:     "hostname",
+	GroupIP:       "ip",
+	GroupPrefix:   "COALESCE(NULLIF(prefix, ''), ip)",
+	GroupASN:      "'AS' || asn",
+	GroupCountry:  "country",
+	GroupRenter:   "renter_key",
+	GroupContract: "contract_id",
+}
+
+// InitFleet creates the fleet tables.
+func InitFleet() error {
+	if _, err := DB.Exec(fleetSchema); err != nil {
+		return err
+	}
+	for _, col := range []string{"interface", "renter_key", "contract_id"} {
+		if err := addColumn("fleet_minute", col, "TEXT DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertFleetMinute adds minute records received from hostname to the
+// stored totals. Records whose ID was added before are skipped.
+func UpsertFleetMinute(hostname string, recs []FleetRecord) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	seen, err := tx.Prepare(`INSERT OR IGNORE INTO fleet_seen (hostname, id, timestamp) VALUES (?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer seen.Close()
+	stmt, err := tx.Prepare(`
+        INSERT INTO fleet_minute (
+            hostname, ip, timestamp, interface, prefix, dns, country, asn, as_org,
+            renter_key, contract_id,
+            consensus_up, consensus_down, siamux_up, siamux_down,
+            quic_up, quic_down, other_up, other_down
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (hostname, ip, timestamp) DO UPDATE SET
+            interface = excluded.interface, prefix = excluded.prefix, dns = excluded.dns,
+            country = excluded.country, asn = excluded.asn, as_org = excluded.as_org,
+            renter_key = excluded.renter_key, contract_id = excluded.contract_id,
+            consensus_up = consensus_up + excluded.consensus_up,
+            consensus_down = consensus_down + excluded.consensus_down,
+            siamux_up = siamux_up + excluded.siamux_up,
+            siamux_down = siamux_down + excluded.siamux_down,
+            quic_up = quic_up + excluded.quic_up,
+            quic_down = quic_down + excluded.quic_down,
+            other_up = other_up + excluded.other_up,
+            other_down = other_down + excluded.other_down
+    `)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, r := range recs {
+		if r.ID != "" {
+			res, err := seen.Exec(hostname, r.ID, now.Unix())
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("record %s: %w", r.ID, err)
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue // retried upload
+			}
+		}
+
+		// collectors flush on minute boundaries; normalise anyway so
+		// flushes of the same minute share a row
+		ts := r.Timestamp - r.Timestamp%60
+		_, err := stmt.Exec(
+			hostname, r.IP, ts, r.Interface, r.Prefix, r.DNS, r.Country, r.ASN, r.ASOrg,
+			r.RenterKey, r.ContractID,
+			r.ConsensusUp, r.ConsensusDown, r.SiamuxUp, r.SiamuxDown,
+			r.QuicUp, r.QuicDown, r.OtherUp, r.OtherDown,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("upsert %s/%s: %w", hostname, r.IP, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM fleet_seen WHERE timestamp < ?`, now.Add(-fleetSeenRetention).Unix()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RewriteFleetIPs is RewriteTrafficIPs for fleet_minute. Rows that end up
+// with the same (hostname, ip, timestamp) are summed. Record IDs seen
+// before before are forgotten as well, since they are derived from the raw
+// address.
+func RewriteFleetIPs(before int64, rewrite func(ip, prefix string) (string, string)) (int64, error) {
+	rows, err := DB.Query(`
+        SELECT DISTINCT ip, prefix FROM fleet_minute
+        WHERE timestamp < ? AND ip NOT LIKE 'anon-%'
+    `, before)
+	if err != nil {
+		return 0, err
+	}
+	type pair struct{ ip, prefix string }
+	var pending []pair
+	for rows.Next() {
+		var p pair
+		if err := rows.Scan(&p.ip, &p.prefix); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	move, err := tx.Prepare(`
+        INSERT INTO fleet_minute (
+            hostname, ip, timestamp, interface, prefix, dns, country, asn, as_org,
+            renter_key, contract_id,
+            consensus_up, consensus_down, siamux_up, siamux_down,
+            quic_up, quic_down, other_up, other_down
+        )
+        SELECT hostname, ?, timestamp, interface, ?, '', country, asn, as_org,
+               renter_key, contract_id,
+               consensus_up, consensus_down, siamux_up, siamux_down,
+               quic_up, quic_down, other_up, other_down
+        FROM fleet_minute
+        WHERE ip = ? AND prefix = ? AND timestamp < ?
+        ON CONFLICT (hostname, ip, timestamp) DO UPDATE SET
+            dns = '',
+            consensus_up = consensus_up + excluded.consensus_up,
+            consensus_down = consensus_down + excluded.consensus_down,
+            siamux_up = siamux_up + excluded.siamux_up,
+            siamux_down = siamux_down + excluded.siamux_down,
+            quic_up = quic_up + excluded.quic_up,
+            quic_down = quic_down + excluded.quic_down,
+            other_up = other_up + excluded.other_up,
+            other_down = other_down + excluded.other_down
+    `)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	defer move.Close()
+
+	var changed int64
+	for _, p := range pending {
+		ip, prefix := rewrite(p.ip, p.prefix)
+		if ip == p.ip && prefix == p.prefix {
+			continue
+		}
+		var res sql.Result
+		if ip == p.ip {
+			// the key stays, only the prefix column changes
+			res, err = tx.Exec(`UPDATE fleet_minute SET prefix = ?, dns = '' WHERE ip = ? AND prefix = ? AND timestamp < ?`,
+				prefix, p.ip, p.prefix, before)
+		} else if _, err = move.Exec(ip, prefix, p.ip, p.prefix, before); err == nil {
+			res, err = tx.Exec(`DELETE FROM fleet_minute WHERE ip = ? AND prefix = ? AND timestamp < ?`, p.ip, p.prefix, before)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		changed += n
+	}
+	if _, err := tx.Exec(`DELETE FROM fleet_seen WHERE timestamp < ?`, before); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return changed, tx.Commit()
+}
+
+// QueryFleetTotals sums the minute records of every host for the UTC day
+// starting at dayStart, grouped by group. host limits the result to one
+// collector when non-empty.
+func QueryFleetTotals(dayStart time.Time, group, host string) ([]model.AggregatedRecord, error) {
+	key, ok := fleetGroupColumns[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown grouping %q", group)
+	}
+
+	from := dayStart.Unix()
+	to := dayStart.Add(24 * time.Hour).Unix()
+
+	rows, err := DB.Query(fmt.Sprintf(`
+        SELECT %s AS grp, MAX(dns), MAX(country), MAX(asn), MAX(as_org),
+               MAX(renter_key), MAX(contract_id),
+               SUM(consensus_up),
+               SUM(consensus_down),
+               SUM(siamux_up),
+               SUM(siamux_down),
+               SUM(quic_up),
+               SUM(quic_down),
+               SUM(other_up),
+               SUM(other_down)
+        FROM fleet_minute
+        WHERE timestamp >= ? AND timestamp < ? AND (? = '' OR hostname = ?)
+        GROUP BY grp
+        ORDER BY SUM(consensus_up + consensus_down + siamux_up + siamux_down + quic_up + quic_down) DESC
+    `, key), from, to, host, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []model.AggregatedRecord
+	for rows.Next() {
+		var r model.AggregatedRecord
+		err := rows.Scan(
+			&r.IP, &r.DNS,
+			&r.Country, &r.ASN, &r.ASOrg,
+			&r.RenterKey, &r.ContractID,
+			&r.ConsensusUp, &r.ConsensusDown,
+			&r.SiamuxUp, &r.SiamuxDown,
+			&r.QuicUp, &r.QuicDown,
+			&r.OtherUp, &r.OtherDown,
+		)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// FleetHosts lists every collector that has pushed minute records, with
+// its totals for the UTC day starting at dayStart.
+func FleetHosts(dayStart time.Time) ([]model.HostSummary, error) {
+	from := dayStart.Unix()
+	to := dayStart.Add(24 * time.Hour).Unix()
+
+	rows, err := DB.Query(`
+        SELECT hostname,
+               MAX(timestamp),
+               COUNT(DISTINCT CASE WHEN timestamp >= ? AND timestamp < ? THEN ip END),
+               SUM(CASE WHEN timestamp >= ? AND timestamp < ? THEN consensus_up + siamux_up + quic_up ELSE 0 END),
+               SUM(CASE WHEN timestamp >= ? AND timestamp < ? THEN consensus_down + siamux_down + quic_down ELSE 0 END)
+        FROM fleet_minute
+        GROUP BY hostname
+        ORDER BY hostname
+    `, from, to, from, to, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []model.HostSummary
+	for rows.Next() {
+		var h model.HostSummary
+		if err := rows.Scan(&h.Hostname, &h.LastSeen, &h.Peers, &h.TotalUp, &h.TotalDown); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
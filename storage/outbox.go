@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outboxRow is a pending Appwrite upsert.
+type outboxRow struct {
+	rowID    string
+	payload  map[string]interface{}
+	attempts int
+}
+
+type drainResult struct {
+	sent, failed, pending int
+	lastErr               string
+}
+
+// enqueueOutbox stores the latest payload for rowID. A row that is already
+// waiting keeps its retry schedule and only gets the fresher payload.
+func enqueueOutbox(rowID string, data map[string]interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+        INSERT INTO appwrite_outbox (row_id, payload, attempts, next_attempt, last_error)
+        VALUES (?, ?, 0, 0, '')
+        ON CONFLICT(row_id) DO UPDATE SET payload = excluded.payload
+    `, rowID, string(payload))
+	return err
+}
+
+// drainOutbox pushes every due outbox row in batches. Successful rows are
+// removed, failed ones are rescheduled with exponential backoff.
+func drainOutbox(dbID, tableID string) (drainResult, error) {
+	var res drainResult
+	now := time.Now()
+
+	due, err := dueOutbox(now.Unix())
+	if err != nil {
+		return res, fmt.Errorf("read outbox: %w", err)
+	}
+
+	size := outboxBatchSize
+	if v := os.Getenv("APPWRITE_BATCH_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			size = n
+		}
+	}
+
+	for i := 0; i < len(due); i += size {
+		end := i + size
+		if end > len(due) {
+			end = len(due)
+		}
+		batch := due[i:end]
+
+		if err := upsertBatch(dbID, tableID, batch); err != nil {
+			res.failed += len(batch)
+			res.lastErr = err.Error()
+			for _, r := range batch {
+				if err := rescheduleOutbox(r, now, err); err != nil {
+					return res, fmt.Errorf("reschedule %s: %w", r.rowID, err)
+				}
+			}
+			continue
+		}
+
+		for _, r := range batch {
+			if _, err := DB.Exec(`DELETE FROM appwrite_outbox WHERE row_id = ?`, r.rowID); err != nil {
+				return res, fmt.Errorf("delete %s: %w", r.rowID, err)
+			}
+		}
+		res.sent += len(batch)
+	}
+
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM appwrite_outbox`).Scan(&res.pending); err != nil {
+		return res, fmt.Errorf("count outbox: %w", err)
+	}
+	return res, nil
+}
+
+// upsertBatch sends one batch. A batch of one uses the single-row endpoint,
+// so APPWRITE_BATCH_SIZE=1 also works against servers without bulk upsert.
+func upsertBatch(dbID, tableID string, batch []outboxRow) error {
+	if len(batch) == 1 {
+		r := batch[0]
+		_, err := sdk.db.UpsertRow(dbID, tableID, r.rowID, sdk.db.WithUpsertRowData(r.payload))
+		return err
+	}
+
+	rows := make([]interface{}, 0, len(batch))
+	for _, r := range batch {
+		row := make(map[string]interface{}, len(r.payload)+1)
+		for k, v := range r.payload {
+			row[k] = v
+		}
+		row["$id"] = r.rowID
+		rows = append(rows, row)
+	}
+	_, err := sdk.db.UpsertRows(dbID, tableID, rows)
+	return err
+}
+
+func dueOutbox(now int64) ([]outboxRow, error) {
+	rows, err := DB.Query(`
+        SELECT row_id, payload, attempts FROM appwrite_outbox
+        WHERE next_attempt <= ?
+        ORDER BY next_attempt, row_id
+    `, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []outboxRow
+	for rows.Next() {
+		var r outboxRow
+		var payload string
+		if err := rows.Scan(&r.rowID, &payload, &r.attempts); err != nil {
+			return nil, err
+		}
+		if r.payload, err = decodePayload(payload); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", r.rowID, err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func rescheduleOutbox(r outboxRow, now time.Time, cause error) error {
+	attempts := r.attempts + 1
+	next := now.Add(backoff(attempts))
+	_, err := DB.Exec(`
+        UPDATE appwrite_outbox SET attempts = ?, next_attempt = ?, last_error = ?
+        WHERE row_id = ?
+    `, attempts, next.Unix(), cause.Error(), r.rowID)
+	return err
+}
+
+// backoff returns retryBase doubled per failed attempt, capped at retryMax.
+func backoff(attempts int) time.Duration {
+	d := retryBase
+	for i := 1; i < attempts && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		d = retryMax
+	}
+	return d
+}
+
+// RewriteOutboxIPs rewrites queued rows of days before beforeDay that still
+// hold raw addresses and drops their names. The row ID follows the new ip;
+// rows that end up with the same ID are summed, like the traffic rows
+// they came from.
+func RewriteOutboxIPs(beforeDay string, rewrite func(ip, prefix string) (string, string)) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT row_id, payload FROM appwrite_outbox`)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	queued := make(map[string]map[string]interface{})
+	var order []string
+	for rows.Next() {
+		var id, payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		data, err := decodePayload(payload)
+		if err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("decode %s: %w", id, err)
+		}
+		queued[id] = data
+		order = append(order, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	var changed int64
+	for _, id := range order {
+		data := queued[id]
+		day, _ := data["day"].(string)
+		ip, _ := data["ip"].(string)
+		if day >= beforeDay || strings.HasPrefix(ip, "anon-") {
+			continue
+		}
+		newIP, _ := rewrite(ip, "")
+		if newIP == ip {
+			continue
+		}
+		hostname, _ := data["hostname"].(string)
+		data["ip"], data["dns"] = newIP, ""
+		newID := makeRowID(hostname, newIP, day)
+		if cur, ok := queued[newID]; ok && newID != id {
+			addCounters(data, cur)
+		}
+		queued[newID] = data
+		delete(queued, id)
+
+		payload, err := json.Marshal(data)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM appwrite_outbox WHERE row_id = ?`, id); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(`
+            INSERT INTO appwrite_outbox (row_id, payload, attempts, next_attempt, last_error)
+            VALUES (?, ?, 0, 0, '')
+            ON CONFLICT(row_id) DO UPDATE SET payload = excluded.payload
+        `, newID, string(payload)); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		changed++
+	}
+	return changed, tx.Commit()
+}
+
+// addCounters adds the byte counters (up_* and down_* fields) of from to
+// into.
+func addCounters(into, from map[string]interface{}) {
+	for k, v := range from {
+		if !strings.HasPrefix(k, "up_") && !strings.HasPrefix(k, "down_") {
+			continue
+		}
+		a, _ := strconv.ParseUint(fmt.Sprint(into[k]), 10, 64)
+		b, _ := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+		into[k] = a + b
+	}
+}
+
+// decodePayload decodes a queued row. UseNumber keeps byte counters exact
+// instead of float64.
+func decodePayload(payload string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.UseNumber()
+	err := dec.Decode(&data)
+	return data, err
+}
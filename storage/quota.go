@@ -0,0 +1,46 @@
+package storage
+
+// AddQuotaBlock records that prefix was put on the BPF blocklist by the
+// quota engine until the given unix time.
+func AddQuotaBlock(prefix, reason string, until int64) error {
+	_, err := DB.Exec(`
+        INSERT INTO quota_blocks (prefix, reason, until) VALUES (?, ?, ?)
+        ON CONFLICT (prefix) DO UPDATE SET
+            reason = excluded.reason,
+            until = MAX(until, excluded.until)
+    `, prefix, reason, until)
+	return err
+}
+
+// QuotaBlocked reports whether prefix is on the quota blocklist.
+func QuotaBlocked(prefix string) (bool, error) {
+	var n int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM quota_blocks WHERE prefix = ?`, prefix).Scan(&n)
+	return n > 0, err
+}
+
+// ExpiredQuotaBlocks returns the blocked prefixes whose quota period ended
+// before now (unix time).
+func ExpiredQuotaBlocks(now int64) ([]string, error) {
+	rows, err := DB.Query(`SELECT prefix FROM quota_blocks WHERE until <= ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// RemoveQuotaBlock forgets a block once it has been lifted.
+func RemoveQuotaBlock(prefix string) error {
+	_, err := DB.Exec(`DELETE FROM quota_blocks WHERE prefix = ?`, prefix)
+	return err
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -14,106 +15,396 @@ import (
 
 var DB *sql.DB
 
+// Path is the database file (SQLITE_PATH).
+var Path string
+
 func init() {
 	path := os.Getenv("SQLITE_PATH")
 	if path == "" {
 		path = "data/traffic.db" // fallback
 	}
+	if err := Open(path); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	dir := filepath.Dir(path)
-	_ = os.MkdirAll(dir, 0755)
+// Open makes the database at path the current DB, creating and migrating
+// it as needed. init opens SQLITE_PATH; tests open a temporary file.
+func Open(path string) error {
+	_ = os.MkdirAll(filepath.Dir(path), 0755)
 
-	var err error
-	DB, err = sql.Open("sqlite3", path)
+	// WAL lets `collector report` and the fleet server read while a flush
+	// or an ingest writes; the busy timeout waits out the remaining locks
+	// instead of failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
 	if err != nil {
-		log.Fatalf("sqlite open: %v", err)
+		return fmt.Errorf("sqlite open: %w", err)
 	}
+	DB, Path = db, path
 
 	schema := `
     CREATE TABLE IF NOT EXISTS traffic (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
+        hostname TEXT DEFAULT '',
+        interface TEXT DEFAULT '',
         ip TEXT,
+        prefix TEXT DEFAULT '',
         dns TEXT,
+        dns_verified INTEGER DEFAULT 0,
+        country TEXT DEFAULT '',
+        asn INTEGER DEFAULT 0,
+        as_org TEXT DEFAULT '',
+        renter_key TEXT DEFAULT '',
+        contract_id TEXT DEFAULT '',
         consensus_up INTEGER,
         consensus_down INTEGER,
         siamux_up INTEGER,
         siamux_down INTEGER,
         quic_up INTEGER,
         quic_down INTEGER,
+        other_up INTEGER DEFAULT 0,
+        other_down INTEGER DEFAULT 0,
         timestamp INTEGER
     );
+
+    CREATE TABLE IF NOT EXISTS dns_cache (
+        ip TEXT PRIMARY KEY,
+        name TEXT,
+        verified INTEGER DEFAULT 0,
+        expires INTEGER
+    );
+
+    CREATE TABLE IF NOT EXISTS appwrite_outbox (
+        row_id TEXT PRIMARY KEY,
+        payload TEXT,
+        attempts INTEGER DEFAULT 0,
+        next_attempt INTEGER DEFAULT 0,
+        last_error TEXT DEFAULT ''
+    );
+
+    CREATE TABLE IF NOT EXISTS quota_blocks (
+        prefix TEXT PRIMARY KEY,
+        reason TEXT,
+        until INTEGER
+    );
+
+    -- hostd contract usage as first seen each UTC day, in hastings
+    CREATE TABLE IF NOT EXISTS contract_usage (
+        contract_id TEXT NOT NULL,
+        day TEXT NOT NULL,
+        ingress TEXT NOT NULL,
+        egress TEXT NOT NULL,
+        PRIMARY KEY (contract_id, day)
+    );
     `
 	if _, err := DB.Exec(schema); err != nil {
-		log.Fatalf("sqlite schema: %v", err)
+		return fmt.Errorf("sqlite schema: %w", err)
+	}
+
+	// Columns added after v0.1; existing databases are upgraded in place.
+	migrations := []struct{ table, column, def string }{
+		{"traffic", "other_up", "INTEGER DEFAULT 0"},
+		{"traffic", "other_down", "INTEGER DEFAULT 0"},
+		{"traffic", "prefix", "TEXT DEFAULT ''"},
+		{"traffic", "country", "TEXT DEFAULT ''"},
+		{"traffic", "asn", "INTEGER DEFAULT 0"},
+		{"traffic", "as_org", "TEXT DEFAULT ''"},
+		{"traffic", "dns_verified", "INTEGER DEFAULT 0"},
+		{"traffic", "hostname", "TEXT DEFAULT ''"},
+		{"traffic", "interface", "TEXT DEFAULT ''"},
+		{"traffic", "renter_key", "TEXT DEFAULT ''"},
+		{"traffic", "contract_id", "TEXT DEFAULT ''"},
+		{"dns_cache", "verified", "INTEGER DEFAULT 0"},
+	}
+	for _, m := range migrations {
+		if err := addColumn(m.table, m.column, m.def); err != nil {
+			return fmt.Errorf("sqlite migrate %s.%s: %w", m.table, m.column, err)
+		}
 	}
+	return nil
 }
 
-// func FlushSQLite(hostname string, rec4 []model.TrafficRecord4, rec6 []model.TrafficRecord6) error {
-// 	tx, err := DB.Begin()
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	stmt, err := tx.Prepare(`
-//         INSERT INTO traffic (
-//             hostname, ip, dns,
-//             consensus_up, consensus_down,
-//             siamux_up, siamux_down,
-//             quic_up, quic_down,
-//             timestamp
-//         ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-//     `)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	defer stmt.Close()
-
-// 	for _, r := range rec4 {
-// 		_, err = stmt.Exec(
-// 			hostname, r.IP, r.DNS,
-// 			r.ConsensusUp, r.ConsensusDown,
-// 			r.SiamuxUp, r.SiamuxDown,
-// 			r.QuicUp, r.QuicDown,
-// 			r.Timestamp,
-// 		)
-// 		if err != nil {
-// 			_ = tx.Rollback()
-// 			return err
-// 		}
-// 	}
-
-// 	for _, r := range rec6 {
-// 		_, err = stmt.Exec(
-// 			hostname, r.IP, r.DNS,
-// 			r.ConsensusUp, r.ConsensusDown,
-// 			r.SiamuxUp, r.SiamuxDown,
-// 			r.QuicUp, r.QuicDown,
-// 			r.Timestamp,
-// 		)
-// 		if err != nil {
-// 			_ = tx.Rollback()
-// 			return err
-// 		}
-// 	}
-
-// 	return tx.Commit()
-// }
+// addColumn adds column to table unless it already exists.
+func addColumn(table, column, def string) error {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-func QueryDailyTotals() ([]model.AggregatedRecord, error) {
-	midnight := time.Now().Truncate(24 * time.Hour).Unix()
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			ctype   string
+			notnull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
+// Grouping keys accepted by QueryDailyTotalsBy.
+const (
+	GroupHost     = "host"
+	GroupIP       = "ip"
+	GroupPrefix   = "prefix"
+	GroupASN      = "asn"
+	GroupCountry  = "country"
+	GroupRenter   = "renter"   // hostd renter public key
+	GroupContract = "contract" // hostd contract ID
+)
+
+// groupColumns maps a grouping key to the SQL expressions selected as
+// AggregatedRecord.IP (the group key) and its descriptive columns.
+var groupColumns = map[string]struct {
+	key, dns, verified, country, asn, org, renter, contract string
+}{
+	// rows written before the hostname column existed have an empty host
+	GroupHost: {"hostname", "''", "0", "''", "0", "''", "''", "''"},
+	GroupIP:   {"ip", "MAX(dns)", "MAX(dns_verified)", "MAX(country)", "MAX(asn)", "MAX(as_org)", "MAX(renter_key)", "MAX(contract_id)"},
+	// rows written before the prefix column existed fall back to their ip
+	GroupPrefix:  {"COALESCE(NULLIF(prefix, ''), ip)", "''", "0", "MAX(country)", "MAX(asn)", "MAX(as_org)", "''", "''"},
+	GroupASN:     {"'AS' || asn", "''", "0", "''", "MAX(asn)", "MAX(as_org)", "''", "''"},
+	GroupCountry: {"country", "''", "0", "MAX(country)", "0", "''", "''", "''"},
+	// traffic not attributed to a renter is grouped under ''
+	GroupRenter:   {"COALESCE(renter_key, '')", "''", "0", "''", "0", "''", "COALESCE(renter_key, '')", "''"},
+	GroupContract: {"COALESCE(contract_id, '')", "''", "0", "''", "0", "''", "CASE WHEN COALESCE(contract_id, '') = '' THEN '' ELSE MAX(renter_key) END", "COALESCE(contract_id, '')"},
+}
+
+// ValidGroup reports whether g is accepted by QueryDailyTotalsBy.
+func ValidGroup(g string) bool {
+	_, ok := groupColumns[g]
+	return ok
+}
+
+// InsertTraffic writes one flush worth of records in a single transaction.
+func InsertTraffic(db *sql.DB, recs []model.TrafficRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+        INSERT INTO traffic (
+            timestamp,
+            hostname,
+            interface,
+            ip,
+            prefix,
+            dns,
+            dns_verified,
+            country,
+            asn,
+            as_org,
+            renter_key,
+            contract_id,
+            consensus_up,
+            consensus_down,
+            siamux_up,
+            siamux_down,
+            quic_up,
+            quic_down,
+            other_up,
+            other_down
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range recs {
+		_, err := stmt.Exec(
+			r.Timestamp,
+			r.Hostname,
+			r.Interface,
+			r.IP,
+			r.Prefix,
+			r.DNS,
+			r.DNSVerified,
+			r.Country,
+			r.ASN,
+			r.ASOrg,
+			r.RenterKey,
+			r.ContractID,
+			r.ConsensusUp,
+			r.ConsensusDown,
+			r.SiamuxUp,
+			r.SiamuxDown,
+			r.QuicUp,
+			r.QuicDown,
+			r.OtherUp,
+			r.OtherDown,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("insert %s: %w", r.IP, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// PendingDNS returns the distinct IPs stored since the given unix time whose
+// dns column is still empty.
+func PendingDNS(since int64) ([]model.Peer, error) {
+	rows, err := DB.Query(`
+        SELECT DISTINCT ip FROM traffic
+        WHERE timestamp >= ? AND (dns IS NULL OR dns = '')
+    `, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []model.Peer
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		// prefix rows (AGG_MODE=prefix) have no name to look up
+		p, err := model.ParsePeer(ip)
+		if err != nil {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// BackfillDNS sets the dns and dns_verified columns of rows for p stored
+// since the given unix time that have no name yet.
+func BackfillDNS(p model.Peer, name string, verified int, since int64) error {
+	_, err := DB.Exec(`
+        UPDATE traffic SET dns = ?, dns_verified = ?
+        WHERE ip = ? AND timestamp >= ? AND (dns IS NULL OR dns = '')
+    `, name, verified, p.String(), since)
+	return err
+}
 
+// RewriteTrafficIPs replaces the ip and prefix columns of rows stored
+// before the given unix time with the result of rewrite and clears their
+// names. Rows already pseudonymised ("anon-") are skipped. It returns the
+// number of rows changed.
+func RewriteTrafficIPs(before int64, rewrite func(ip, prefix string) (string, string)) (int64, error) {
 	rows, err := DB.Query(`
-        SELECT ip, dns,
+        SELECT DISTINCT ip, prefix FROM traffic
+        WHERE timestamp < ? AND ip NOT LIKE 'anon-%'
+    `, before)
+	if err != nil {
+		return 0, err
+	}
+	type pair struct{ ip, prefix string }
+	var pending []pair
+	for rows.Next() {
+		var ip, prefix sql.NullString
+		if err := rows.Scan(&ip, &prefix); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, pair{ip.String, prefix.String})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`
+        UPDATE traffic SET ip = ?, prefix = ?, dns = '', dns_verified = 0
+        WHERE ip = ? AND prefix = ? AND timestamp < ?
+    `)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var changed int64
+	for _, p := range pending {
+		ip, prefix := rewrite(p.ip, p.prefix)
+		if ip == p.ip && prefix == p.prefix {
+			continue
+		}
+		res, err := stmt.Exec(ip, prefix, p.ip, p.prefix, before)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		changed += n
+	}
+	return changed, tx.Commit()
+}
+
+// QueryDailyTotals returns today's totals per IP.
+func QueryDailyTotals() ([]model.AggregatedRecord, error) {
+	return QueryDailyTotalsBy(GroupIP)
+}
+
+// QueryDailyTotalsBy returns today's totals grouped by group (GroupHost,
+// GroupIP, GroupPrefix, GroupASN, GroupCountry, GroupRenter or
+// GroupContract).
+func QueryDailyTotalsBy(group string) ([]model.AggregatedRecord, error) {
+	return QueryHostDailyTotals("", group)
+}
+
+// QueryHostDailyTotals is QueryDailyTotalsBy limited to the rows recorded by
+// hostname, plus rows stored before hostnames were recorded. An empty
+// hostname selects every row.
+func QueryHostDailyTotals(hostname, group string) ([]model.AggregatedRecord, error) {
+	midnight := time.Now().Truncate(24 * time.Hour)
+	return QueryHostTotalsSince(hostname, group, midnight)
+}
+
+// QueryHostTotalsSince is QueryHostDailyTotals for the rows stored since the
+// given time.
+func QueryHostTotalsSince(hostname, group string, since time.Time) ([]model.AggregatedRecord, error) {
+	col, ok := groupColumns[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown grouping %q", group)
+	}
+
+	rows, err := DB.Query(fmt.Sprintf(`
+        SELECT %s AS grp, %s, %s, %s, %s, %s, %s, %s,
                SUM(consensus_up),
                SUM(consensus_down),
                SUM(siamux_up),
                SUM(siamux_down),
                SUM(quic_up),
-               SUM(quic_down)
+               SUM(quic_down),
+               SUM(other_up),
+               SUM(other_down)
         FROM traffic
-        WHERE timestamp >= ?
-        GROUP BY ip
-    `, midnight)
+        WHERE timestamp >= ? AND (? = '' OR hostname = ? OR hostname = '')
+        GROUP BY grp
+    `, col.key, col.dns, col.verified, col.country, col.asn, col.org, col.renter, col.contract), since.Unix(), hostname, hostname)
 	if err != nil {
 		return nil, err
 	}
@@ -124,10 +415,13 @@ func QueryDailyTotals() ([]model.AggregatedRecord, error) {
 	for rows.Next() {
 		var r model.AggregatedRecord
 		err := rows.Scan(
-			&r.IP, &r.DNS,
+			&r.IP, &r.DNS, &r.DNSVerified,
+			&r.Country, &r.ASN, &r.ASOrg,
+			&r.RenterKey, &r.ContractID,
 			&r.ConsensusUp, &r.ConsensusDown,
 			&r.SiamuxUp, &r.SiamuxDown,
 			&r.QuicUp, &r.QuicDown,
+			&r.OtherUp, &r.OtherDown,
 		)
 		if err != nil {
 			return nil, err
@@ -135,5 +429,50 @@ func QueryDailyTotals() ([]model.AggregatedRecord, error) {
 		out = append(out, r)
 	}
 
-	return out, nil
+	return out, rows.Err()
+}
+
+// QueryPeerDays returns the totals of every peer per UTC day for the rows
+// recorded by hostname (see QueryHostDailyTotals) since the given time,
+// ordered by day and address.
+func QueryPeerDays(hostname string, since time.Time) ([]model.PeerDay, error) {
+	col := groupColumns[GroupIP]
+	rows, err := DB.Query(fmt.Sprintf(`
+        SELECT date(timestamp, 'unixepoch') AS day, ip, %s, %s, %s, %s, %s, %s, %s,
+               SUM(consensus_up),
+               SUM(consensus_down),
+               SUM(siamux_up),
+               SUM(siamux_down),
+               SUM(quic_up),
+               SUM(quic_down),
+               SUM(other_up),
+               SUM(other_down)
+        FROM traffic
+        WHERE timestamp >= ? AND (? = '' OR hostname = ? OR hostname = '')
+        GROUP BY day, ip
+        ORDER BY day, ip
+    `, col.dns, col.verified, col.country, col.asn, col.org, col.renter, col.contract), since.Unix(), hostname, hostname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []model.PeerDay
+	for rows.Next() {
+		var r model.PeerDay
+		err := rows.Scan(
+			&r.Day, &r.IP, &r.DNS, &r.DNSVerified,
+			&r.Country, &r.ASN, &r.ASOrg,
+			&r.RenterKey, &r.ContractID,
+			&r.ConsensusUp, &r.ConsensusDown,
+			&r.SiamuxUp, &r.SiamuxDown,
+			&r.QuicUp, &r.QuicDown,
+			&r.OtherUp, &r.OtherDown,
+		)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
 }
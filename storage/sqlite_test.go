@@ -0,0 +1,21 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func TestOpenPragmas(t *testing.T) {
+	storagetest.Open(t)
+
+	var mode string
+	if err := storage.DB.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode = %q, %v; want wal", mode, err)
+	}
+	var timeout int
+	if err := storage.DB.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout); err != nil || timeout != 5000 {
+		t.Fatalf("busy_timeout = %d, %v; want 5000", timeout, err)
+	}
+}
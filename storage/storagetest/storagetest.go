@@ -0,0 +1,21 @@
+// Package storagetest opens throwaway databases for tests.
+package storagetest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/back2basic/collector/storage"
+)
+
+// Open makes a fresh database in a temporary directory the current
+// storage.DB, closes it when the test ends and returns its path.
+func Open(t testing.TB) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "traffic.db")
+	if err := storage.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.DB.Close() })
+	return path
+}
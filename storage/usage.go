@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/back2basic/collector/hostd"
+)
+
+// usageRetention is how long contract usage snapshots are kept.
+const usageRetention = 400 * 24 * time.Hour
+
+// ContractUsage stores daily snapshots of hostd contract usage in the
+// contract_usage table.
+type ContractUsage struct{}
+
+// SaveUsage records the usage of contracts as their snapshot for day. The
+// first snapshot of a day is kept, so it is the usage at the start of it.
+func (ContractUsage) SaveUsage(day string, contracts []hostd.Contract) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO contract_usage (contract_id, day, ingress, egress) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range contracts {
+		if _, err := stmt.Exec(c.ID, day, c.Usage.Ingress.String(), c.Usage.Egress.String()); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("contract %s: %w", c.ID, err)
+		}
+	}
+	cutoff := time.Now().UTC().Add(-usageRetention).Format("2006-01-02")
+	if _, err := tx.Exec(`DELETE FROM contract_usage WHERE day < ?`, cutoff); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UsageBaselines returns per contract the snapshot revenue in a window
+// starting on day is counted from: the latest one taken on or before day,
+// else the earliest one after it.
+func UsageBaselines(day string) (map[string]hostd.UsageSnapshot, error) {
+	rows, err := DB.Query(`
+        SELECT contract_id, day, ingress, egress FROM contract_usage
+        ORDER BY contract_id, day
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]hostd.UsageSnapshot)
+	for rows.Next() {
+		var id, in, eg string
+		var s hostd.UsageSnapshot
+		if err := rows.Scan(&id, &s.Day, &in, &eg); err != nil {
+			return nil, err
+		}
+		if _, ok := s.Usage.Ingress.SetString(in, 10); !ok {
+			return nil, fmt.Errorf("contract %s: invalid ingress %q", id, in)
+		}
+		if _, ok := s.Usage.Egress.SetString(eg, 10); !ok {
+			return nil, fmt.Errorf("contract %s: invalid egress %q", id, eg)
+		}
+		// rows come in day order: later ones replace earlier ones up to
+		// day, the first one after day only when there is none before
+		if _, ok := out[id]; !ok || s.Day <= day {
+			out[id] = s
+		}
+	}
+	return out, rows.Err()
+}
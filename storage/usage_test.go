@@ -0,0 +1,71 @@
+package storage_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/back2basic/collector/hostd"
+	"github.com/back2basic/collector/storage"
+	"github.com/back2basic/collector/storage/storagetest"
+)
+
+func contract(id string, egress int64) hostd.Contract {
+	return hostd.Contract{ID: id, Usage: hostd.Usage{Egress: hostd.NewCurrency(big.NewInt(egress))}}
+}
+
+func TestUsageBaselines(t *testing.T) {
+	today := time.Now().UTC()
+	day := func(n int) string { return today.AddDate(0, 0, n).Format("2006-01-02") }
+
+	storagetest.Open(t)
+	st := storage.ContractUsage{}
+	for _, s := range []struct {
+		day       string
+		contracts []hostd.Contract
+	}{
+		{day(-6), []hostd.Contract{contract("old", 10)}},
+		{day(-4), []hostd.Contract{contract("old", 20)}},
+		{day(-3), []hostd.Contract{contract("old", 30), contract("new", 5)}},
+		{day(-3), []hostd.Contract{contract("old", 35), contract("new", 6)}}, // later the same day
+		{day(-1), []hostd.Contract{contract("old", 50), contract("new", 9), contract("late", 1)}},
+		{day(0), []hostd.Contract{contract("late", 2)}},
+	} {
+		if err := st.SaveUsage(s.day, s.contracts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := storage.UsageBaselines(day(-4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]struct {
+		day    string
+		egress int64
+	}{
+		"old":  {day(-4), 20}, // latest on or before the day
+		"new":  {day(-3), 5},  // first snapshot of the day wins
+		"late": {day(-1), 1},  // earliest after the day
+	} {
+		s := got[id]
+		if s.Day != want.day || s.Usage.Egress.Cmp(big.NewInt(want.egress)) != 0 {
+			t.Errorf("%s: snapshot %s egress %s, want %s egress %d", id, s.Day, s.Usage.Egress.String(), want.day, want.egress)
+		}
+	}
+}
+
+func TestSaveUsagePrunesOldSnapshots(t *testing.T) {
+	storagetest.Open(t)
+	if _, err := storage.DB.Exec(`INSERT INTO contract_usage (contract_id, day, ingress, egress) VALUES ('c', '2000-01-01', '0', '0')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := (storage.ContractUsage{}).SaveUsage(time.Now().UTC().Format("2006-01-02"), []hostd.Contract{contract("c", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	storage.DB.QueryRow(`SELECT COUNT(*) FROM contract_usage`).Scan(&n)
+	if n != 1 {
+		t.Fatalf("%d snapshots, want the old one pruned", n)
+	}
+}